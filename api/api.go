@@ -0,0 +1,121 @@
+/* Api serves the runtime management of client and server over HTTP/JSON. */
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxBodySize is the largest request body read.
+const maxBodySize = 64 * 1024
+
+// Serve serves handler on addr in the background until the returned server
+// is closed. An addr prefixed with unix: is taken as the path of a unix
+// socket, which replaces a stale one, is only accessible by the owner and is
+// removed on close.
+//
+// If token is not empty, requests have to carry it as a bearer token.
+// Otherwise, a tcp addr has to be a loopback one, as the api can reroute the
+// traffic.
+func Serve(addr string, token string, handler http.Handler) (*http.Server, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+		if err := os.Remove(addr); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	} else if token == "" && !isLoopback(addr) {
+		return nil, fmt.Errorf("api on non-loopback address %s requires api_token", addr)
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0o600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if token != "" {
+		handler = requireToken(token, handler)
+	}
+	server := &http.Server{Addr: listener.Addr().String(), Handler: handler}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Println("error serving api:", err)
+		}
+	}()
+	return server, nil
+}
+
+// isLoopback reports whether a tcp addr only listens on loopback.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireToken rejects requests without token as bearer token.
+func requireToken(token string, handler http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			WriteError(w, http.StatusUnauthorized, errors.New("invalid api token"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("error writing api response:", err)
+	}
+}
+
+func WriteError(w http.ResponseWriter, status int, err error) {
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// ReadBody reads the body of r, up to maxBodySize.
+func ReadBody(r *http.Request) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+}
+
+// ReadJSON decodes the body of r into v, rejecting unknown fields.
+func ReadJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// ScatterRequest changes the scatter type, as in the config file.
+type ScatterRequest struct {
+	ScatterType string `json:"scatter_type"`
+}
+
+// DrainRequest stops or resumes scattering on a path, which stays connected.
+type DrainRequest struct {
+	Path  string `json:"path"`
+	Drain bool   `json:"drain"`
+}
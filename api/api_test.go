@@ -0,0 +1,50 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/chenx-dust/paracat/api"
+)
+
+func TestServeNonLoopback(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0", "[::]:0"} {
+		if server, err := api.Serve(addr, "", http.NotFoundHandler()); err == nil {
+			server.Close()
+			t.Errorf("served on %s without token", addr)
+		}
+	}
+}
+
+func TestServeToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	server, err := api.Serve("127.0.0.1:0", "secret", ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	url := "http://" + server.Addr
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		request, _ := http.NewRequest(http.MethodGet, url, nil)
+		if tt.authorization != "" {
+			request.Header.Set("Authorization", tt.authorization)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != tt.want {
+			t.Errorf("with %q got %d, want %d", tt.authorization, response.StatusCode, tt.want)
+		}
+	}
+}
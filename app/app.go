@@ -1,5 +1,18 @@
 package app
 
+import (
+	"context"
+
+	"github.com/chenx-dust/paracat/config"
+)
+
 type App interface {
-	Run() error
+	// Run runs until ctx is done or it fails, and returns nil once stopped
+	// by ctx.
+	Run(ctx context.Context) error
+}
+
+// Reloader is an App that applies a changed config while running.
+type Reloader interface {
+	Reload(cfg *config.Config)
 }
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/chenx-dust/paracat/api"
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+// pathState is a relay as listed by the api.
+type pathState struct {
+	Name          string               `json:"name"`
+	Alive         bool                 `json:"alive"`
+	Authenticated bool                 `json:"authenticated"`
+	Backup        bool                 `json:"backup"`
+	OverQuota     bool                 `json:"over_quota"`
+	Draining      bool                 `json:"draining"`
+	RTT           string               `json:"rtt"`
+	Jitter        string               `json:"jitter"`
+	ProbeLoss     float64              `json:"probe_loss"`
+	Loss          float64              `json:"loss"`
+	DeliveryRate  float64              `json:"delivery_rate"` // bytes per second
+	PacingRate    float64              `json:"pacing_rate"`   // bytes per second, 0 for not paced
+	SentBytes     uint64               `json:"sent_bytes"`
+	ReceivedBytes uint64               `json:"received_bytes"`
+	Quota         transport.QuotaUsage `json:"quota"`
+}
+
+// connState is a connection of a service as listed by the api.
+type connState struct {
+	ConnID  uint32 `json:"conn_id"`
+	Service string `json:"service"`
+	Addr    string `json:"addr"`
+}
+
+func (client *Client) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /paths", client.handleAPIPaths)
+	mux.HandleFunc("POST /paths/drain", client.handleAPIDrain)
+	mux.HandleFunc("GET /conns", client.handleAPIConns)
+	mux.HandleFunc("POST /relays", client.handleAPIAddRelay)
+	mux.HandleFunc("DELETE /relays", client.handleAPIRemoveRelay)
+	mux.HandleFunc("GET /scatter", client.handleAPIScatter)
+	mux.HandleFunc("PUT /scatter", client.handleAPISetScatter)
+	return mux
+}
+
+func (client *Client) handleAPIPaths(w http.ResponseWriter, r *http.Request) {
+	client.relaysMutex.RLock()
+	relays := slices.Clone(client.relays)
+	client.relaysMutex.RUnlock()
+	paths := make([]pathState, 0, len(relays))
+	for _, relay := range relays {
+		conn := relay.current()
+		quality := relay.prober.Quality()
+		congestion := conn.congestion.State()
+		_, sent := relay.sent.Total()
+		_, received := relay.received.Total()
+		paths = append(paths, pathState{
+			Name:          relay.name,
+			Alive:         conn.heartbeat.Alive(),
+			Authenticated: conn.authenticated.Load(),
+			Backup:        relay.backup,
+			OverQuota:     relay.overQuota.Load(),
+			Draining:      relay.draining.Load(),
+			RTT:           quality.SRTT.String(),
+			Jitter:        quality.RTTVar.String(),
+			ProbeLoss:     quality.Loss,
+			Loss:          congestion.Loss,
+			DeliveryRate:  congestion.DeliveryRate,
+			PacingRate:    congestion.Rate,
+			SentBytes:     sent,
+			ReceivedBytes: received,
+			Quota:         relay.quota.Usage(),
+		})
+	}
+	api.WriteJSON(w, http.StatusOK, paths)
+}
+
+func (client *Client) handleAPIDrain(w http.ResponseWriter, r *http.Request) {
+	var request api.DrainRequest
+	if err := api.ReadJSON(r, &request); err != nil {
+		api.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !client.drainRelay(request.Path, request.Drain) {
+		api.WriteError(w, http.StatusNotFound, fmt.Errorf("path not found: %s", request.Path))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (client *Client) handleAPIConns(w http.ResponseWriter, r *http.Request) {
+	client.connMutex.RLock()
+	conns := make([]connState, 0, len(client.connIDMap))
+	for connID, conn := range client.connIDMap {
+		conns = append(conns, connState{
+			ConnID:  connID,
+			Service: conn.service.Name,
+			Addr:    conn.addr.String(),
+		})
+	}
+	client.connMutex.RUnlock()
+	slices.SortFunc(conns, func(a, b connState) int {
+		return cmp.Compare(a.ConnID, b.ConnID)
+	})
+	api.WriteJSON(w, http.StatusOK, conns)
+}
+
+// handleAPIAddRelay dials a relay server given as in relay_servers. It is
+// connected in the background, as a tcp relay may take long.
+func (client *Client) handleAPIAddRelay(w http.ResponseWriter, r *http.Request) {
+	body, err := api.ReadBody(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	relayServer, err := config.ParseRelayServer(body, client.cfg.Load())
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if client.hasRelay(relayServer) {
+		api.WriteError(w, http.StatusConflict, errRelayExists)
+		return
+	}
+	log.Println("adding relay:", relayServer.Address, "type:", config.ConnTypeToString(relayServer.ConnType))
+	go client.dialRelay(relayServer)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleAPIRemoveRelay closes a relay for good, given by its name as listed
+// in /paths.
+func (client *Client) handleAPIRemoveRelay(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		api.WriteError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+	if !client.removeRelay(name) {
+		api.WriteError(w, http.StatusNotFound, fmt.Errorf("relay not found: %s", name))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (client *Client) handleAPIScatter(w http.ResponseWriter, r *http.Request) {
+	api.WriteJSON(w, http.StatusOK, api.ScatterRequest{
+		ScatterType: config.ScatterTypeToString(client.scatterer.Mode()),
+	})
+}
+
+func (client *Client) handleAPISetScatter(w http.ResponseWriter, r *http.Request) {
+	var request api.ScatterRequest
+	if err := api.ReadJSON(r, &request); err != nil {
+		api.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	mode := config.ParseScatterType(request.ScatterType)
+	if mode == config.NotDefinedScatterType {
+		api.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid scatter type: %s", request.ScatterType))
+		return
+	}
+	client.scatterer.SetMode(mode)
+	w.WriteHeader(http.StatusNoContent)
+}
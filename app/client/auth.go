@@ -0,0 +1,108 @@
+package client
+
+import (
+	"log"
+	"time"
+
+	"github.com/chenx-dust/paracat/packet"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+// helloRetryInterval is how often hello is resent until the relay is
+// accepted by the server.
+const helloRetryInterval = 1 * time.Second
+
+// hello is what the client offers on every relay.
+func (client *Client) hello() packet.Hello {
+	features := packet.FECFeature | packet.FeedbackFeature | packet.SequenceFeature
+	if client.cipher != nil {
+		features |= packet.EncryptionFeature
+	}
+	return packet.Hello{
+		Version:  packet.VERSION,
+		Features: features,
+	}
+}
+
+// helloOf is the hello of the client on conn, with its heartbeat interval.
+func (client *Client) helloOf(conn *relayConn) packet.Hello {
+	hello := client.hello()
+	hello.HeartbeatInterval = conn.heartbeat.Interval()
+	return hello
+}
+
+func (client *Client) handleChallenge(relay *relayContext, conn *relayConn, p *packet.Packet) {
+	if client.authenticator == nil {
+		log.Println("unexpected challenge without psk from", relay.name)
+		return
+	}
+	challenge, err := packet.ParseChallenge(p)
+	if err != nil {
+		log.Println("error parsing challenge:", err)
+		return
+	}
+	response := client.authenticator.Respond(challenge)
+	response.Hello = client.helloOf(conn)
+	conn.sender.Send(packet.NewResponsePacket(response))
+}
+
+func (client *Client) handleAccept(relay *relayContext, conn *relayConn, p *packet.Packet) {
+	if conn.authenticated.Load() {
+		return
+	}
+	accept, err := packet.ParseAccept(p)
+	if err != nil {
+		log.Println("error parsing accept:", err)
+		return
+	}
+	features, err := packet.Negotiate(client.hello(), accept)
+	if err != nil {
+		log.Println("incompatible server of", relay.name+":", err)
+		return
+	}
+	log.Println("relay accepted:", relay.name, "features:", features)
+	if client.encoder != nil && features&packet.FECFeature == 0 {
+		log.Println("warning: fec is not supported by", relay.name)
+	}
+	conn.congestion.SetFeedback(features&packet.FeedbackFeature != 0)
+	conn.heartbeat.SetPeerInterval(accept.HeartbeatInterval)
+	client.sequenced.Store(features&packet.SequenceFeature != 0)
+	client.acceptRelay(relay, conn)
+	// announcements before acceptance may be dropped
+	conn.sender.Send(relay.announce())
+	// so may probes, which would be taken as lost
+	go transport.ProbeLoop(conn, relay.prober, conn.sender)
+}
+
+func (client *Client) handleReject(relay *relayContext, p *packet.Packet) {
+	reason, err := packet.ParseReject(p)
+	if err != nil {
+		log.Println("error parsing reject:", err)
+		return
+	}
+	log.Println("rejected by server of", relay.name+":", reason)
+}
+
+// helloLoop asks the server to accept the relay. With keepalive set it goes
+// on after being accepted, so that a udp relay forgotten by the server is
+// accepted again.
+func (client *Client) helloLoop(conn *relayConn, keepalive bool) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-conn.Done():
+			return
+		case <-timer.C:
+		}
+		if !conn.authenticated.Load() {
+			conn.sender.Send(packet.NewHelloPacket(client.helloOf(conn)))
+			timer.Reset(helloRetryInterval)
+		} else if keepalive {
+			conn.sender.Send(packet.NewHelloPacket(client.helloOf(conn)))
+			timer.Reset(announceInterval)
+		} else {
+			return
+		}
+	}
+}
@@ -1,87 +1,236 @@
 package client
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"net"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/chenx-dust/paracat/api"
 	"github.com/chenx-dust/paracat/channel"
 	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/metrics"
+	"github.com/chenx-dust/paracat/packet"
 	"github.com/chenx-dust/paracat/transport"
 )
 
 type Client struct {
-	cfg *config.Config
+	cfg       atomic.Pointer[config.Config] // swapped on reload
+	sessionID uint32
 
-	gatherer    *channel.Gatherer
-	scatterer   *channel.Scatterer
-	idIncrement atomic.Uint32
+	gatherer  *channel.Gatherer
+	scatterer *channel.Scatterer
+	encoder   *channel.FECEncoder // nil if fec is disabled
+	cipher    *packet.Cipher      // nil if encryption is disabled
 
-	udpListener *net.UDPConn
+	authenticator *transport.Authenticator // nil if authentication is disabled
+	idIncrement   atomic.Uint32
+	sequenced     atomic.Bool // conn seq is sent, as the server of the latest accepted relay understands it
+
+	services []*service
+
+	// ctx is of Run, and every relay is derived from it
+	ctx     context.Context
+	running chan struct{} // closed once ctx is set
+
+	relaysMutex sync.RWMutex
+	relays      []*relayContext
+	relaysWG    sync.WaitGroup // relays not closed for good yet
+	// quotaUsages is loaded from the quota file and keeps the traffic of
+	// removed relays, by relay name
+	quotaUsages map[string]transport.QuotaUsage
 
 	connMutex     sync.RWMutex
 	connIncrement atomic.Uint32
-	connIDAddrMap map[uint16]*net.UDPAddr
-	connAddrIDMap map[string]uint16
+	connIDMap     map[uint32]*serviceConn
 }
 
-func NewClient(cfg *config.Config) *Client {
-	return &Client{
-		cfg:           cfg,
-		gatherer:      channel.NewGatherer(cfg.ChannelSize),
-		scatterer:     channel.NewScatterer(cfg.ScatterType),
-		connIDAddrMap: make(map[uint16]*net.UDPAddr),
-		connAddrIDMap: make(map[string]uint16),
+func NewClient(cfg *config.Config) (*Client, error) {
+	client := &Client{
+		sessionID: rand.Uint32N(math.MaxUint32) + 1, // 0 is for legacy clients
+		gatherer:  channel.NewGatherer(cfg.ChannelSize, cfg.Overflow, cfg.DedupTimeout, cfg.DedupWindow, cfg.ReorderDelay),
+		scatterer: channel.NewScatterer(cfg.ScatterType, cfg.Redundancy),
+		connIDMap: make(map[uint32]*serviceConn),
+		running:   make(chan struct{}),
+
+		quotaUsages: make(map[string]transport.QuotaUsage),
+	}
+	client.cfg.Store(cfg)
+	log.Printf("session id: %08x", client.sessionID)
+	if cfg.PSK != "" {
+		cipher, err := packet.NewCipher(cfg.Cipher, cfg.PSK)
+		if err != nil {
+			return nil, fmt.Errorf("creating cipher: %w", err)
+		}
+		log.Println("encrypting with", cfg.Cipher)
+		client.cipher = cipher
+		authenticator, err := transport.NewAuthenticator(cfg.PSK)
+		if err != nil {
+			return nil, fmt.Errorf("creating authenticator: %w", err)
+		}
+		client.authenticator = authenticator
+	}
+	if cfg.QuotaFile != "" {
+		usages, err := loadQuotaUsages(cfg.QuotaFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading quota file: %w", err)
+		}
+		client.quotaUsages = usages
+	}
+	if cfg.FECDataShards > 0 {
+		client.encoder = channel.NewFECEncoder(cfg.FECDataShards, cfg.FECParityShards, client.sessionID, client.cipher, client.scatterer.Scatter)
 	}
+	return client, nil
 }
 
-func (client *Client) Run() error {
+// Run runs the client until ctx is done or it fails. Once stopped by ctx it
+// returns nil, with services and relays closed and buffers released.
+func (client *Client) Run(ctx context.Context) error {
 	log.Println("running client")
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+	client.ctx = ctx
+	close(client.running)
 
-	udpAddr, err := net.ResolveUDPAddr("udp", client.cfg.ListenAddr)
-	if err != nil {
-		return err
-	}
-	client.udpListener, err = net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return err
+	for _, cfg := range client.cfg.Load().Services {
+		svc, err := client.listenService(cfg)
+		if err != nil {
+			client.closeServices()
+			return err
+		}
+		client.services = append(client.services, svc)
 	}
 
-	if client.cfg.EnableGRO {
-		transport.EnableGRO(client.udpListener)
+	if client.cfg.Load().MetricsAddr != "" {
+		metricsServer, err := metrics.Serve(client.cfg.Load().MetricsAddr, client.collectMetrics)
+		if err != nil {
+			client.closeServices()
+			return err
+		}
+		defer metricsServer.Close()
+		log.Println("serving metrics on", client.cfg.Load().MetricsAddr)
 	}
-	if client.cfg.EnableGSO {
-		transport.EnableGSO(client.udpListener)
+	if client.cfg.Load().APIAddr != "" {
+		apiServer, err := api.Serve(client.cfg.Load().APIAddr, client.cfg.Load().APIToken, client.apiHandler())
+		if err != nil {
+			client.closeServices()
+			return err
+		}
+		defer apiServer.Close()
+		log.Println("serving api on", client.cfg.Load().APIAddr)
 	}
 
-	log.Println("listening on", client.cfg.ListenAddr)
-
-	go client.handleReverse(client.gatherer.GetOutChan())
-
-	client.dialRelays()
-
 	wg := sync.WaitGroup{}
-	wg.Add(1)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		client.handleReverse(ctx, client.gatherer.GetOutChan())
+	}()
 	go func() {
 		defer wg.Done()
-		client.handleForward()
+		client.quotaLoop(ctx)
 	}()
 
-	if client.cfg.ReportInterval > 0 {
+	if err := client.dialRelays(); err != nil {
+		cancel(err)
+	}
+
+	wg.Add(len(client.services))
+	for _, svc := range client.services {
+		go func() {
+			defer wg.Done()
+			if err := client.handleForward(svc); err != nil && ctx.Err() == nil {
+				cancel(fmt.Errorf("reading from %s: %w", svc.Addr, err))
+			}
+		}()
+	}
+
+	if client.cfg.Load().ReportInterval > 0 {
+		wg.Add(1)
 		go func() {
-			ticker := time.NewTicker(client.cfg.ReportInterval)
+			defer wg.Done()
+			ticker := time.NewTicker(client.cfg.Load().ReportInterval)
 			defer ticker.Stop()
-			for range ticker.C {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
 				pkg, band := client.scatterer.StatisticIn.GetAndReset()
-				log.Printf("scatter in: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, client.cfg.ReportInterval, float64(band)/client.cfg.ReportInterval.Seconds()/1024/1024)
+				log.Printf("scatter in: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, client.cfg.Load().ReportInterval, float64(band)/client.cfg.Load().ReportInterval.Seconds()/1024/1024)
 				pkg, band = client.scatterer.StatisticOut.GetAndReset()
-				log.Printf("scatter out: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, client.cfg.ReportInterval, float64(band)/client.cfg.ReportInterval.Seconds()/1024/1024)
+				log.Printf("scatter out: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, client.cfg.Load().ReportInterval, float64(band)/client.cfg.Load().ReportInterval.Seconds()/1024/1024)
 				pkg, band = client.gatherer.StatisticIn.GetAndReset()
-				log.Printf("gather in: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, client.cfg.ReportInterval, float64(band)/client.cfg.ReportInterval.Seconds()/1024/1024)
+				log.Printf("gather in: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, client.cfg.Load().ReportInterval, float64(band)/client.cfg.Load().ReportInterval.Seconds()/1024/1024)
 				pkg, band = client.gatherer.StatisticOut.GetAndReset()
-				log.Printf("gather out: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, client.cfg.ReportInterval, float64(band)/client.cfg.ReportInterval.Seconds()/1024/1024)
+				log.Printf("gather out: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, client.cfg.Load().ReportInterval, float64(band)/client.cfg.Load().ReportInterval.Seconds()/1024/1024)
+				pkg, band = client.gatherer.StatisticRecovered.GetAndReset()
+				if pkg > 0 {
+					log.Printf("fec recovered: %d packets, %d bytes in %s", pkg, band, client.cfg.Load().ReportInterval)
+				}
+				pkg, band = client.gatherer.StatisticDuplicate.GetAndReset()
+				if pkg > 0 {
+					log.Printf("duplicate: %d packets, %d bytes in %s", pkg, band, client.cfg.Load().ReportInterval)
+				}
+				pkg, band = client.gatherer.StatisticDedupLate.GetAndReset()
+				if pkg > 0 {
+					log.Printf("dedup late: %d packets, %d bytes in %s", pkg, band, client.cfg.Load().ReportInterval)
+				}
+				pkg, band = client.gatherer.StatisticReordered.GetAndReset()
+				if pkg > 0 {
+					log.Printf("reordered: %d packets, %d bytes in %s", pkg, band, client.cfg.Load().ReportInterval)
+				}
+				pkg, band = client.gatherer.StatisticLate.GetAndReset()
+				if pkg > 0 {
+					log.Printf("reorder late: %d packets, %d bytes in %s", pkg, band, client.cfg.Load().ReportInterval)
+				}
+				pkg, band = client.gatherer.StatisticDropped.GetAndReset()
+				if pkg > 0 {
+					log.Printf("gather dropped: %d packets, %d bytes in %s", pkg, band, client.cfg.Load().ReportInterval)
+				}
+				if client.cipher != nil {
+					pkg, band = client.cipher.StatisticRejected.GetAndReset()
+					if pkg > 0 {
+						log.Printf("rejected: %d packets, %d bytes in %s", pkg, band, client.cfg.Load().ReportInterval)
+					}
+				}
+				dropped := client.PathDropped()
+				for _, name := range slices.Sorted(maps.Keys(dropped)) {
+					pkg, band = dropped[name].GetAndReset()
+					if pkg > 0 {
+						log.Printf("path %s dropped: %d packets, %d bytes in %s", name, pkg, band, client.cfg.Load().ReportInterval)
+					}
+				}
+				qualities := client.PathQualities()
+				for _, name := range slices.Sorted(maps.Keys(qualities)) {
+					quality := qualities[name]
+					log.Printf("path %s: rtt %s, jitter %s, loss %.2f%%", name, quality.SRTT, quality.RTTVar, quality.Loss*100)
+				}
+				quotas := client.PathQuotas()
+				for _, name := range slices.Sorted(maps.Keys(quotas)) {
+					usage := quotas[name]
+					log.Printf("path %s: traffic %.3f GB today, %.3f GB this month", name, float64(usage.Daily)/1e9, float64(usage.Monthly)/1e9)
+				}
+				congestions := client.PathCongestions()
+				for _, name := range slices.Sorted(maps.Keys(congestions)) {
+					state := congestions[name]
+					if state.DeliveryRate == 0 {
+						continue
+					}
+					pacing := "not paced"
+					if state.Rate > 0 {
+						pacing = fmt.Sprintf("paced at %.2f MB/s", state.Rate/1024/1024)
+					}
+					log.Printf("path %s: delivered %.2f MB/s, loss %.2f%%, %s", name, state.DeliveryRate/1024/1024, state.Loss*100, pacing)
+				}
 
 				// buffer.BufferTraceBack.Lock()
 				// for k, v := range buffer.BufferTraceBack.TraceBack {
@@ -92,7 +241,23 @@ func (client *Client) Run() error {
 		}()
 	}
 
+	<-ctx.Done()
+	log.Println("stopping client")
+	client.closeServices()
 	wg.Wait()
+	// relays are derived from ctx, and close by themselves
+	client.relaysWG.Wait()
+	client.gatherer.Close()
+	log.Println("client stopped")
 
+	if err := context.Cause(ctx); err != context.Cause(parent) {
+		return err
+	}
 	return nil
 }
+
+func (client *Client) closeServices() {
+	for _, svc := range client.services {
+		svc.listener.Close()
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"log"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/packet"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+func (client *Client) handlePackets(relay *relayContext, conn *relayConn, packets_ buffer.WithBufferArg[[]*packet.Packet]) {
+	packets := packets_.ToOwned()
+	size := 0
+	for _, p := range packets.Thing {
+		size += p.WireSize
+	}
+	conn.congestion.Received(len(packets.Thing), size)
+	relay.received.CountPackets(uint32(len(packets.Thing)), uint64(size))
+	packets.Thing = transport.FilterControlPackets(packets.Thing, func(p *packet.Packet) {
+		client.handleControl(relay, conn, p)
+	})
+	if len(packets.Thing) == 0 {
+		packets.Release()
+		return
+	}
+	client.gatherer.Forward(packets.MoveArg())
+}
+
+func (client *Client) handleControl(relay *relayContext, conn *relayConn, p *packet.Packet) {
+	switch p.ControlType() {
+	case packet.HeartbeatControlType:
+		conn.heartbeat.Received()
+	case packet.ProbeControlType:
+		transport.Echo(conn.sender, p)
+	case packet.EchoControlType:
+		relay.prober.HandleEcho(p)
+		client.scatterer.SetOutputRTT(conn.ch, relay.prober.Quality().SRTT)
+	case packet.FeedbackControlType:
+		conn.congestion.HandleFeedback(p)
+		client.scatterer.SetOutputLossy(conn.ch, conn.congestion.Lossy(client.cfg.Load().FailoverLoss))
+	case packet.ChallengeControlType:
+		client.handleChallenge(relay, conn, p)
+	case packet.AcceptControlType:
+		client.handleAccept(relay, conn, p)
+	case packet.RejectControlType:
+		client.handleReject(relay, p)
+	default:
+		log.Println("unexpected control packet:", p.ControlType())
+	}
+}
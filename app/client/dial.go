@@ -1,46 +1,70 @@
 package client
 
 import (
+	"fmt"
 	"log"
 	"net"
 
 	"github.com/chenx-dust/paracat/config"
 )
 
-func (client *Client) dialTCPRelay(addr string) error {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+func (client *Client) dialTCPRelay(relayServer config.RelayServer) error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", relayServer.Address)
 	if err != nil {
 		log.Println("error resolving tcp addr:", err)
 		return err
 	}
-	client.newTCPRelay(tcpAddr)
-	log.Println("connected to tcp relay", addr)
+	if _, err := client.newTCPRelay(tcpAddr, relayServer); err != nil {
+		log.Println("error adding tcp relay", relayServer.Address+":", err)
+		return err
+	}
+	log.Println("connected to tcp relay", relayServer.Address)
 	return nil
 }
 
-func (client *Client) dialUDPRelay(addr string) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+func (client *Client) dialUDPRelay(relayServer config.RelayServer) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", relayServer.Address)
 	if err != nil {
 		log.Println("error resolving udp addr:", err)
 		return err
 	}
-	client.newUDPRelay(udpAddr)
-	log.Println("connected to udp relay", addr)
+	if _, err := client.newUDPRelay(udpAddr, relayServer); err != nil {
+		log.Println("error adding udp relay", relayServer.Address+":", err)
+		return err
+	}
+	log.Println("connected to udp relay", relayServer.Address)
 	return nil
 }
 
-func (client *Client) dialRelays() {
-	for _, relay := range client.cfg.RelayServers {
+// dialRelay dials a relay server on each of its connection types.
+func (client *Client) dialRelay(relay config.RelayServer) {
+	if relay.ConnType&config.TCPConnectionType != 0 {
+		client.dialTCPRelay(relay)
+	}
+	if relay.ConnType&config.UDPConnectionType != 0 {
+		client.dialUDPRelay(relay)
+	}
+}
+
+func (client *Client) dialRelays() error {
+	for _, relay := range client.cfg.Load().RelayServers {
 		if relay.ConnType == config.NotDefinedConnectionType {
-			log.Fatalln("not defined connection type")
-		}
-		enableTCP := relay.ConnType&config.TCPConnectionType != 0
-		enableUDP := relay.ConnType&config.UDPConnectionType != 0
-		if enableTCP {
-			client.dialTCPRelay(relay.Address)
+			return fmt.Errorf("connection type of relay %s not defined", relay.Address)
 		}
-		if enableUDP {
-			client.dialUDPRelay(relay.Address)
+		client.dialRelay(relay)
+	}
+	return nil
+}
+
+// hasRelay reports whether a relay of the same address and a common
+// connection type is there.
+func (client *Client) hasRelay(relayServer config.RelayServer) bool {
+	client.relaysMutex.RLock()
+	defer client.relaysMutex.RUnlock()
+	for _, relay := range client.relays {
+		if relay.relayServer.Address == relayServer.Address && relay.connType&relayServer.ConnType != 0 {
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,25 @@
+package client
+
+import "github.com/chenx-dust/paracat/transport"
+
+// QuotaUsages returns the traffic of relays as loaded from the quota file.
+func (client *Client) QuotaUsages() map[string]transport.QuotaUsage {
+	client.relaysMutex.RLock()
+	defer client.relaysMutex.RUnlock()
+	return client.quotaUsages
+}
+
+// SaveQuotaUsages writes the quota file, as done periodically and on exit.
+func (client *Client) SaveQuotaUsages() error {
+	return client.saveQuotaUsages()
+}
+
+// CountRelayTraffic counts bytes sent on a relay, as done on every packet.
+func (client *Client) CountRelayTraffic(name string, bytes uint32) {
+	client.findRelay(name).sent.CountPacket(bytes)
+}
+
+// RemoveRelay removes a relay, as done by the api and on reload.
+func (client *Client) RemoveRelay(name string) bool {
+	return client.removeRelay(name)
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/metrics"
+)
+
+// collectMetrics adds the counters and the state of the client, which are
+// cumulative and not reset by reports.
+func (client *Client) collectMetrics(m *metrics.Metrics) {
+	m.Scatterer(client.scatterer)
+	m.Gatherer(client.gatherer)
+	if client.cipher != nil {
+		m.Statistic("paracat_rejected", "failed to be opened by the cipher.", client.cipher.StatisticRejected)
+	}
+	m.Gauge("paracat_active_buffers", "Packet buffers in use.", float64(buffer.ActiveBuffers.Load()))
+
+	client.connMutex.RLock()
+	conns := len(client.connIDMap)
+	client.connMutex.RUnlock()
+	m.Gauge("paracat_connections", "Active connections of services.", float64(conns))
+
+	client.relaysMutex.RLock()
+	relays := client.relays
+	client.relaysMutex.RUnlock()
+	m.Gauge("paracat_paths", "Relays to the server.", float64(len(relays)))
+	for _, relay := range relays {
+		m.Statistic("paracat_path_sent", "sent on the path.", relay.sent, "path", relay.name)
+		m.Statistic("paracat_path_received", "received on the path.", relay.received, "path", relay.name)
+		m.Statistic("paracat_path_dropped", "dropped on a full queue of the path.", relay.dropped, "path", relay.name)
+		conn := relay.current()
+		m.Path(conn.heartbeat.Alive(), relay.prober.Quality(), conn.congestion.State(), "path", relay.name)
+		usage := relay.quota.Usage()
+		m.Gauge("paracat_path_quota_bytes", "Bytes sent and received on the path in the current period.", float64(usage.Daily), "path", relay.name, "period", "day")
+		m.Gauge("paracat_path_quota_bytes", "Bytes sent and received on the path in the current period.", float64(usage.Monthly), "path", relay.name, "period", "month")
+	}
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+// quotaCheckInterval is how often relays are checked against their quotas.
+const quotaCheckInterval = 1 * time.Second
+
+// loadQuotaUsages reads the traffic of relays by name. A missing file is
+// taken as no traffic yet.
+func loadQuotaUsages(path string) (map[string]transport.QuotaUsage, error) {
+	usages := make(map[string]transport.QuotaUsage)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return usages, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &usages); err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+// saveQuotaUsages writes the traffic of relays, keeping that of relays no
+// longer configured. The file is replaced at once so that it is never half
+// written.
+func (client *Client) saveQuotaUsages() error {
+	client.relaysMutex.RLock()
+	usages := maps.Clone(client.quotaUsages)
+	client.relaysMutex.RUnlock()
+	maps.Copy(usages, client.PathQuotas())
+	data, err := json.MarshalIndent(usages, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := client.cfg.Load().QuotaFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, client.cfg.Load().QuotaFile)
+}
+
+// countQuota counts the traffic of the relay in its quota since last
+// counted.
+func (relay *relayContext) countQuota() {
+	relay.countMutex.Lock()
+	defer relay.countMutex.Unlock()
+	_, sent := relay.sent.Total()
+	_, received := relay.received.Total()
+	relay.quota.Count(sent + received - relay.counted)
+	relay.counted = sent + received
+}
+
+// quotaLoop demotes or disables relays over their quotas, restores them in
+// a new day or month, and saves the traffic of relays if a quota file is set,
+// a last time when ctx is done.
+func (client *Client) quotaLoop(ctx context.Context) {
+	checkTicker := time.NewTicker(quotaCheckInterval)
+	defer checkTicker.Stop()
+	var saveC <-chan time.Time
+	if client.cfg.Load().QuotaFile != "" {
+		saveTicker := time.NewTicker(client.cfg.Load().QuotaSaveInterval)
+		defer saveTicker.Stop()
+		saveC = saveTicker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if saveC != nil {
+				if err := client.saveQuotaUsages(); err != nil {
+					log.Println("error saving quota file:", err)
+				}
+			}
+			return
+		case <-checkTicker.C:
+			client.relaysMutex.RLock()
+			relays := slices.Clone(client.relays)
+			client.relaysMutex.RUnlock()
+			for _, relay := range relays {
+				relay.countQuota()
+				exceeded := relay.quota.Exceeded()
+				if relay.overQuota.Swap(exceeded) == exceeded {
+					continue
+				}
+				if exceeded {
+					log.Println("relay is over quota:", relay.name, "action:", config.QuotaActionToString(relay.quota.Action()))
+				} else {
+					log.Println("relay is back within quota:", relay.name)
+				}
+				client.updateRelayOutput(relay)
+				relay.current().sender.Send(relay.announce())
+			}
+		case <-saveC:
+			if err := client.saveQuotaUsages(); err != nil {
+				log.Println("error saving quota file:", err)
+			}
+		}
+	}
+}
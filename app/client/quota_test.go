@@ -0,0 +1,105 @@
+package client_test
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/app/client"
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+func newClient(t *testing.T, quotaFile string) (*client.Client, error) {
+	t.Helper()
+	return client.NewClient(&config.Config{
+		Mode:        config.ClientMode,
+		ScatterType: config.RoundRobinScatterType,
+		QuotaFile:   quotaFile,
+	})
+}
+
+// TestQuotaFileRestart keeps the traffic of relays across restarts, that of
+// relays no longer configured too.
+func TestQuotaFileRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	first, err := newClient(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usages := first.QuotaUsages(); len(usages) != 0 {
+		t.Errorf("loaded %v from a missing file", usages)
+	}
+
+	usages := map[string]transport.QuotaUsage{
+		"a":    {Day: "2024-05-10", Month: "2024-05", Daily: 1, Monthly: 2, Total: 3},
+		"gone": {Day: "2024-04-01", Month: "2024-04", Daily: 4, Monthly: 5, Total: 1 << 40},
+	}
+	maps.Copy(first.QuotaUsages(), usages)
+	if err := first.SaveQuotaUsages(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Error("temporary file left behind")
+	}
+
+	second, err := newClient(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := second.QuotaUsages(); !maps.Equal(got, usages) {
+		t.Errorf("loaded %v, want %v", got, usages)
+	}
+}
+
+func TestQuotaFileCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newClient(t, path); err == nil {
+		t.Error("corrupt quota file loaded")
+	}
+}
+
+// TestQuotaRemoveRelay keeps the traffic of a relay removed between quota
+// checks.
+func TestQuotaRemoveRelay(t *testing.T) {
+	const name = "udp://127.0.0.1:9"
+	c, err := client.NewClient(loadConfig(t, `{"mode":"client","listen_addr":"127.0.0.1:0","scatter_type":"round-robin",
+		"relay_servers":[{"addr":"127.0.0.1:9","conn_type":"udp"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := c.PathQuotas()[name]; ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relay not dialed")
+		}
+	}
+
+	c.CountRelayTraffic(name, 1000)
+	if !c.RemoveRelay(name) {
+		t.Fatal("relay not found")
+	}
+	// and the hello sent meanwhile
+	if got := c.QuotaUsages()[name].Total; got < 1000 {
+		t.Errorf("kept %d bytes of the removed relay, want at least 1000", got)
+	}
+}
@@ -0,0 +1,319 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/packet"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+var (
+	errRelayExists   = errors.New("relay already exists")
+	errClientStopped = errors.New("client stopped")
+)
+
+// removeDelay is how long a removed relay is kept open after it is announced
+// as drained, so that the server stops scattering to it first.
+const removeDelay = 1 * time.Second
+
+// relayContext is the state shared by tcp and udp relays, kept across
+// reconnections. What is renewed on every (re)connection is in relayConn.
+type relayContext struct {
+	// root ends with the relay when it is removed, and every connection of
+	// the relay is derived from it
+	root        context.Context
+	remove      context.CancelFunc
+	latest      atomic.Pointer[relayConn] // never nil
+	prober      *transport.Prober
+	dropped     *packet.PacketStatistic // scattered packets dropped on a full queue
+	sent        *packet.PacketStatistic
+	received    *packet.PacketStatistic
+	limiter     *transport.TokenBucket // nil for unlimited
+	quota       *transport.Quota
+	overQuota   atomic.Bool
+	draining    atomic.Bool // kept connected but not scattered to
+	countMutex  sync.Mutex
+	counted     uint64 // bytes sent and received already counted in quota, by countQuota
+	name        string
+	connType    config.ConnectionType // tcp or udp
+	relayServer config.RelayServer    // as configured
+	weight      int
+	backup      bool
+	traffic     config.TrafficType
+	overflow    config.OverflowPolicy
+
+	// outputMutex serializes scatterer registration of the connection
+	outputMutex sync.Mutex
+}
+
+// relayConn is one connection of a relay. Loops of the connection are given
+// the relayConn they started with, so that a reconnection does not change
+// what they work on.
+type relayConn struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	ch        chan buffer.ArgPtr[*buffer.PackedBuffer]
+	sender    transport.ControlSender
+	heartbeat *transport.Heartbeat
+	// congestion is per connection, as the counters of both ends start over
+	congestion *transport.Congestion
+	// authenticated is set once the server accepts the path, after hello and
+	// the challenge if psk is set, and only then the path is used to scatter
+	authenticated atomic.Bool
+}
+
+func (client *Client) newRelayContext(name string, connType config.ConnectionType, relayServer config.RelayServer) *relayContext {
+	root, remove := context.WithCancel(client.ctx)
+	client.relaysMutex.RLock()
+	usage := client.quotaUsages[name]
+	client.relaysMutex.RUnlock()
+	relay := &relayContext{
+		root:        root,
+		remove:      remove,
+		prober:      transport.NewProber(client.cfg.Load().ProbeInterval),
+		dropped:     packet.NewPacketStatistic(),
+		sent:        packet.NewPacketStatistic(),
+		received:    packet.NewPacketStatistic(),
+		limiter:     transport.NewTokenBucket(relayServer.RateLimit),
+		quota:       transport.NewQuota(relayServer.Quota, usage),
+		name:        name,
+		connType:    connType,
+		relayServer: relayServer,
+		weight:      relayServer.Weight,
+		backup:      relayServer.Backup,
+		traffic:     relayServer.Traffic,
+		overflow:    relayServer.Overflow,
+	}
+	client.newRelayConn(relay)
+	return relay
+}
+
+func (conn *relayConn) Done() <-chan struct{} {
+	return conn.ctx.Done()
+}
+
+func (conn *relayConn) Cancel() {
+	conn.cancel()
+}
+
+// current returns the latest connection of the relay, which may be dialing
+// still or closed already.
+func (relay *relayContext) current() *relayConn {
+	return relay.latest.Load()
+}
+
+// removed reports whether the relay is removed, so that it is not to be
+// connected again.
+func (relay *relayContext) removed() bool {
+	return relay.root.Err() != nil
+}
+
+// newRelayConn publishes a new connection of the relay, before it is dialed.
+func (client *Client) newRelayConn(relay *relayContext) *relayConn {
+	conn := &relayConn{
+		ch: make(chan buffer.ArgPtr[*buffer.PackedBuffer], client.cfg.Load().ChannelSize),
+	}
+	conn.ctx, conn.cancel = context.WithCancel(relay.root)
+	conn.sender = transport.NewControlSender(conn.ch, client.cipher, client.sessionID)
+	conn.heartbeat = transport.NewHeartbeat(client.cfg.Load().HeartbeatInterval, client.cfg.Load().HeartbeatTimeout, func(alive bool) {
+		if alive {
+			log.Println("relay is alive:", relay.name)
+		} else {
+			log.Println("relay is dead:", relay.name)
+		}
+		client.scatterer.SetOutputAlive(conn.ch, alive)
+	})
+	conn.congestion = transport.NewCongestion(client.cfg.Load().CongestionControl, client.cfg.Load().FeedbackInterval, func() time.Duration {
+		return relay.prober.Quality().SRTT
+	}, func(rate float64) {
+		client.scatterer.SetOutputRate(conn.ch, rate)
+	})
+	relay.latest.Store(conn)
+	return conn
+}
+
+// closeRelayConn stops scattering on a closed connection and releases what
+// is queued on it.
+func (client *Client) closeRelayConn(relay *relayContext, conn *relayConn) {
+	relay.outputMutex.Lock()
+	client.scatterer.RemoveOutput(conn.ch)
+	relay.outputMutex.Unlock()
+	buffer.Drain(conn.ch)
+	conn.congestion.Drain()
+}
+
+// acceptRelay starts scattering on an accepted connection of a relay.
+func (client *Client) acceptRelay(relay *relayContext, conn *relayConn) {
+	if !conn.authenticated.CompareAndSwap(false, true) {
+		return
+	}
+	client.updateRelayOutput(relay)
+}
+
+// updateRelayOutput registers the accepted connection of a relay to scatter
+// by its traffic direction and quota, on standby if it is a backup. A closed
+// connection is left unregistered.
+func (client *Client) updateRelayOutput(relay *relayContext) {
+	relay.outputMutex.Lock()
+	defer relay.outputMutex.Unlock()
+	conn := relay.current()
+	if !conn.authenticated.Load() || conn.ctx.Err() != nil {
+		return
+	}
+	if relay.traffic == config.DownTrafficType || relay.disabled() {
+		client.scatterer.RemoveOutput(conn.ch)
+		return
+	}
+	client.scatterer.NewOutput(conn.ch, relay.weight, relay.overflow, relay.dropped, relay.limiter)
+	client.scatterer.SetOutputStandby(conn.ch, relay.backup || relay.overQuota.Load())
+}
+
+// disabled reports whether the relay is kept from carrying traffic, when
+// draining or by its quota.
+func (relay *relayContext) disabled() bool {
+	return relay.draining.Load() || (relay.overQuota.Load() && relay.quota.Action() == config.DisableQuotaAction)
+}
+
+// announce is what the server is told about the relay. A disabled relay is
+// announced as carrying no down traffic.
+func (relay *relayContext) announce() *packet.Packet {
+	announce := packet.Announce{
+		Traffic: relay.traffic,
+		Weight:  uint16(relay.weight),
+		Standby: relay.backup || relay.overQuota.Load(),
+	}
+	if relay.disabled() {
+		announce.Traffic = config.UpTrafficType
+	}
+	return packet.NewAnnouncePacket(announce)
+}
+
+// addRelay registers a relay, unless there is one of the same name or the
+// client is stopped, in which case the relay is removed at once. The relay
+// is counted in relaysWG until closed for good.
+func (client *Client) addRelay(relay *relayContext) error {
+	client.relaysMutex.Lock()
+	defer client.relaysMutex.Unlock()
+	if client.ctx.Err() != nil {
+		relay.remove()
+		return errClientStopped
+	}
+	for _, r := range client.relays {
+		if r.name == relay.name {
+			relay.remove()
+			return errRelayExists
+		}
+	}
+	client.relays = append(client.relays, relay)
+	client.relaysWG.Add(1)
+	return nil
+}
+
+// removeRelay drains a relay and closes it for good shortly after, and tells
+// whether it was found. A relay of the same name may be added meanwhile.
+func (client *Client) removeRelay(name string) bool {
+	client.relaysMutex.Lock()
+	i := slices.IndexFunc(client.relays, func(relay *relayContext) bool {
+		return relay.name == name
+	})
+	if i < 0 {
+		client.relaysMutex.Unlock()
+		return false
+	}
+	relay := client.relays[i]
+	client.relays = slices.Delete(client.relays, i, i+1)
+	// with the traffic since the last check
+	relay.countQuota()
+	client.quotaUsages[name] = relay.quota.Usage()
+	client.relaysMutex.Unlock()
+	log.Println("removing relay:", name)
+	relay.draining.Store(true)
+	client.updateRelayOutput(relay)
+	relay.current().sender.Send(relay.announce())
+	time.AfterFunc(removeDelay, relay.remove)
+	return true
+}
+
+// drainRelay stops or resumes scattering on a relay, which stays connected,
+// and tells whether it was found.
+func (client *Client) drainRelay(name string, drain bool) bool {
+	relay := client.findRelay(name)
+	if relay == nil {
+		return false
+	}
+	if relay.draining.Swap(drain) != drain {
+		if drain {
+			log.Println("draining relay:", name)
+		} else {
+			log.Println("resuming relay:", name)
+		}
+		client.updateRelayOutput(relay)
+		relay.current().sender.Send(relay.announce())
+	}
+	return true
+}
+
+func (client *Client) findRelay(name string) *relayContext {
+	client.relaysMutex.RLock()
+	defer client.relaysMutex.RUnlock()
+	for _, relay := range client.relays {
+		if relay.name == name {
+			return relay
+		}
+	}
+	return nil
+}
+
+// PathDropped returns the statistic of packets dropped on a full queue of
+// every relay by its name.
+func (client *Client) PathDropped() map[string]*packet.PacketStatistic {
+	client.relaysMutex.RLock()
+	defer client.relaysMutex.RUnlock()
+	dropped := make(map[string]*packet.PacketStatistic, len(client.relays))
+	for _, relay := range client.relays {
+		dropped[relay.name] = relay.dropped
+	}
+	return dropped
+}
+
+// PathCongestions returns what congestion control learned about every relay
+// by its name.
+func (client *Client) PathCongestions() map[string]transport.CongestionState {
+	client.relaysMutex.RLock()
+	defer client.relaysMutex.RUnlock()
+	states := make(map[string]transport.CongestionState, len(client.relays))
+	for _, relay := range client.relays {
+		states[relay.name] = relay.current().congestion.State()
+	}
+	return states
+}
+
+// PathQuotas returns the traffic of every relay by its name.
+func (client *Client) PathQuotas() map[string]transport.QuotaUsage {
+	client.relaysMutex.RLock()
+	defer client.relaysMutex.RUnlock()
+	usages := make(map[string]transport.QuotaUsage, len(client.relays))
+	for _, relay := range client.relays {
+		usages[relay.name] = relay.quota.Usage()
+	}
+	return usages
+}
+
+// PathQualities returns the measured quality of every relay by its name.
+func (client *Client) PathQualities() map[string]transport.PathQuality {
+	client.relaysMutex.RLock()
+	defer client.relaysMutex.RUnlock()
+	qualities := make(map[string]transport.PathQuality, len(client.relays))
+	for _, relay := range client.relays {
+		qualities[relay.name] = relay.prober.Quality()
+	}
+	return qualities
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"log"
+	"slices"
+
+	"github.com/chenx-dust/paracat/config"
+)
+
+// Reload applies a changed config without dropping connections of services.
+// Relays are dialed, reconnected or removed by relay_servers, so relays
+// added by the api and not configured are removed too.
+// A reload before Run waits for it, as relays are derived from its ctx.
+func (client *Client) Reload(cfg *config.Config) {
+	<-client.running
+	cfg, kept := config.Reload(client.cfg.Load(), cfg)
+	for _, name := range kept {
+		log.Println(name, "changed, restart to apply")
+	}
+	old := client.cfg.Swap(cfg)
+	if cfg.ScatterType != old.ScatterType {
+		client.scatterer.SetMode(cfg.ScatterType)
+	}
+	client.reloadRelays(cfg.RelayServers)
+	log.Println("config reloaded")
+}
+
+// reloadRelays removes relays no longer in relayServers, reconnects those
+// whose settings changed, and dials new ones in the background.
+func (client *Client) reloadRelays(relayServers []config.RelayServer) {
+	client.relaysMutex.RLock()
+	relays := slices.Clone(client.relays)
+	client.relaysMutex.RUnlock()
+
+	configured := func(relay *relayContext) bool {
+		return slices.ContainsFunc(relayServers, func(relayServer config.RelayServer) bool {
+			return relay.relayServer.Address == relayServer.Address &&
+				relay.connType&relayServer.ConnType != 0 &&
+				sameRelaySettings(relay.relayServer, relayServer)
+		})
+	}
+	var kept []*relayContext
+	for _, relay := range relays {
+		if configured(relay) {
+			kept = append(kept, relay)
+		} else {
+			client.removeRelay(relay.name)
+		}
+	}
+
+	for _, relayServer := range relayServers {
+		for _, relay := range kept {
+			if relay.relayServer.Address == relayServer.Address {
+				relayServer.ConnType &^= relay.connType
+			}
+		}
+		if relayServer.ConnType == config.NotDefinedConnectionType {
+			continue
+		}
+		log.Println("adding relay:", relayServer.Address, "type:", config.ConnTypeToString(relayServer.ConnType))
+		go client.dialRelay(relayServer)
+	}
+}
+
+// sameRelaySettings reports whether a and b differ in nothing but the
+// connection type.
+func sameRelaySettings(a config.RelayServer, b config.RelayServer) bool {
+	a.ConnType, b.ConnType = config.NotDefinedConnectionType, config.NotDefinedConnectionType
+	return a == b
+}
@@ -0,0 +1,61 @@
+package client_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/app/client"
+	"github.com/chenx-dust/paracat/config"
+)
+
+func loadConfig(t *testing.T, data string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// TestReloadBeforeRun applies a reload, e.g. on SIGHUP while starting, once
+// the client runs.
+func TestReloadBeforeRun(t *testing.T) {
+	const base = `"mode":"client","listen_addr":"127.0.0.1:0","scatter_type":"round-robin"`
+	c, err := client.NewClient(loadConfig(t, `{`+base+`,"relay_servers":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		c.Reload(loadConfig(t, `{`+base+`,"relay_servers":[{"addr":"127.0.0.1:9","conn_type":"udp"}]}`))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-reloaded:
+		t.Fatal("reloaded before run")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("not reloaded once running")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
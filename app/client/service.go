@@ -0,0 +1,52 @@
+package client
+
+import (
+	"log"
+	"net"
+
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+// service is a local udp port forwarded to the service of the same name on
+// the server.
+type service struct {
+	config.Service
+	listener *net.UDPConn
+	conns    map[string]*serviceConn // only accessed by handleForward
+}
+
+// serviceConn is a udp peer of a service.
+type serviceConn struct {
+	service *service
+	addr    *net.UDPAddr
+	id      uint32
+	seq     uint32 // conn seq of the next packet, only used by handleForward
+}
+
+func (client *Client) listenService(cfg config.Service) (*service, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if client.cfg.Load().EnableGRO {
+		transport.EnableGRO(listener)
+	}
+	if client.cfg.Load().EnableGSO {
+		transport.EnableGSO(listener)
+	}
+	if cfg.Name == "" {
+		log.Println("listening on", cfg.Addr)
+	} else {
+		log.Println("listening on", cfg.Addr, "for service", cfg.Name)
+	}
+	return &service{
+		Service:  cfg,
+		listener: listener,
+		conns:    make(map[string]*serviceConn),
+	}, nil
+}
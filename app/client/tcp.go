@@ -1,61 +1,72 @@
 package client
 
 import (
-	"context"
 	"log"
 	"net"
 	"time"
 
 	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/packet"
 	"github.com/chenx-dust/paracat/transport"
 )
 
 type tcpRelay struct {
-	ctx    context.Context
-	cancel context.CancelFunc
-	addr   *net.TCPAddr
-	conn   *net.TCPConn
-	ch     chan buffer.ArgPtr[*buffer.PackedBuffer]
+	*relayContext
+	addr *net.TCPAddr
 }
 
-func (relay *tcpRelay) Done() <-chan struct{} {
-	return relay.ctx.Done()
-}
-
-func (relay *tcpRelay) Cancel() {
-	relay.cancel()
-}
-
-func (client *Client) newTCPRelay(addr *net.TCPAddr) (relay *tcpRelay) {
-	relay = &tcpRelay{addr: addr}
-	client.connectTCPRelay(relay)
-	return
+func (client *Client) newTCPRelay(addr *net.TCPAddr, relayServer config.RelayServer) (*tcpRelay, error) {
+	relay := &tcpRelay{
+		relayContext: client.newRelayContext("tcp://"+addr.String(), config.TCPConnectionType, relayServer),
+		addr:         addr,
+	}
+	if err := client.addRelay(relay.relayContext); err != nil {
+		return nil, err
+	}
+	client.connectTCPRelay(relay, relay.current())
+	return relay, nil
 }
 
-func (client *Client) connectTCPRelay(relay *tcpRelay) {
+// connectTCPRelay dials conn, the latest connection of the relay.
+func (client *Client) connectTCPRelay(relay *tcpRelay, conn *relayConn) {
+	var tcpConn *net.TCPConn
 	var err error
 	retry := 0
 	for {
-		relay.conn, err = net.DialTCP("tcp", nil, relay.addr)
+		tcpConn, err = net.DialTCP("tcp", nil, relay.addr)
 		if err == nil {
 			break
 		}
 		log.Println("error dialing tcp:", err, "retry:", retry)
-		time.Sleep(client.cfg.ReconnectDelay)
+		select {
+		case <-relay.root.Done():
+			client.closeRelayConn(relay.relayContext, conn)
+			client.relaysWG.Done()
+			return
+		case <-time.After(client.cfg.Load().ReconnectDelay):
+		}
 		retry++
 	}
-	relay.ctx, relay.cancel = context.WithCancel(context.Background())
-	relay.ch = make(chan buffer.ArgPtr[*buffer.PackedBuffer], client.cfg.ChannelSize)
-	client.scatterer.NewOutput(relay.ch)
-	go client.handleTCPRelayCancel(relay)
-	go transport.SendTCPLoop(relay, relay.conn, relay.ch)
-	go transport.ReceiveTCPLoop(relay, relay.conn, client.gatherer)
+	go client.handleTCPRelayCancel(relay, conn, tcpConn)
+	go transport.SendTCPLoop(conn, tcpConn, conn.ch, conn.congestion, relay.limiter, relay.sent)
+	go transport.ReceiveTCPLoop(conn, tcpConn, client.cipher, func(packets buffer.WithBufferArg[[]*packet.Packet]) {
+		client.handlePackets(relay.relayContext, conn, packets)
+	})
+	go transport.HeartbeatLoop(conn, conn.heartbeat, conn.sender)
+	go transport.FeedbackLoop(conn, conn.congestion, conn.sender)
+	go client.helloLoop(conn, false)
+	conn.sender.Send(relay.announce())
 }
 
-func (client *Client) handleTCPRelayCancel(relay *tcpRelay) {
-	<-relay.ctx.Done()
+func (client *Client) handleTCPRelayCancel(relay *tcpRelay, conn *relayConn, tcpConn *net.TCPConn) {
+	<-conn.Done()
 	log.Println("closing tcp relay:", relay.addr)
-	relay.conn.Close()
-	client.scatterer.RemoveOutput(relay.ch)
-	client.connectTCPRelay(relay)
+	tcpConn.Close()
+	client.closeRelayConn(relay.relayContext, conn)
+	if relay.removed() {
+		client.relaysWG.Done()
+		return
+	}
+	client.connectTCPRelay(relay, client.newRelayConn(relay.relayContext))
 }
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"log"
 
 	"github.com/chenx-dust/paracat/buffer"
@@ -9,73 +10,95 @@ import (
 	"github.com/chenx-dust/paracat/transport"
 )
 
-func (client *Client) handleForward() {
+// handleForward scatters what the service receives, until its listener
+// fails or is closed.
+func (client *Client) handleForward(svc *service) error {
 	for {
-		rawPackets, addr, err := transport.ReceiveUDPRawPackets(client.udpListener)
+		rawPackets, addr, err := transport.ReceiveUDPRawPackets(svc.listener)
 		if err != nil {
-			log.Fatalln("error reading from udp conn:", err)
+			rawPackets.Release()
+			return err
 		}
-		if rawPackets.Ptr.SubPackets[0] > int(client.cfg.MaxUDPSize) {
-			// log.Println("error receiving udp packets: packet size too large", rawPackets.Ptr.SubPackets[0], ">", client.cfg.MaxUDPSize)
+		overhead := client.cipher.Overhead()
+		if rawPackets.Ptr.SubPackets[0] > min(int(client.cfg.Load().MaxUDPSize), buffer.BUFFER_SIZE-overhead) {
+			// log.Println("error receiving udp packets: packet size too large", rawPackets.Ptr.SubPackets[0], ">", client.cfg.Load().MaxUDPSize)
 			rawPackets.Release()
 			continue
 		}
 
-		connID, ok := client.connAddrIDMap[addr.String()]
+		conn, ok := svc.conns[addr.String()]
 		if !ok {
-			connID = uint16(client.connIncrement.Add(1) - 1)
+			conn = &serviceConn{service: svc, addr: addr, id: client.connIncrement.Add(1) - 1}
 			client.connMutex.Lock()
-			client.connIDAddrMap[connID] = addr
-			client.connAddrIDMap[addr.String()] = connID
+			client.connIDMap[conn.id] = conn
 			client.connMutex.Unlock()
+			svc.conns[addr.String()] = conn
 			log.Println("new connection from:", addr.String())
 		}
+		sequenced := client.sequenced.Load()
 		packets := buffer.NewPackedBuffer()
+		fecPackets := make([]*packet.Packet, 0, len(rawPackets.Ptr.SubPackets))
 		nowRawPtr := 0
 		for _, slice := range rawPackets.Ptr.SubPackets {
+			if packets.Ptr.TotalSize+slice+overhead > buffer.BUFFER_SIZE {
+				// packed packets are larger, so a full read takes more buffers
+				client.scatterer.Scatter(packets.MoveArg())
+				packets = buffer.NewPackedBuffer()
+			}
 			packetID := channel.NewPacketID(&client.idIncrement)
 
 			newPacket := &packet.Packet{
-				Buffer:   rawPackets.Ptr.Buffer[nowRawPtr : nowRawPtr+slice],
-				ConnID:   connID,
-				PacketID: packetID,
+				Buffer:    rawPackets.Ptr.Buffer[nowRawPtr : nowRawPtr+slice],
+				SessionID: client.sessionID,
+				ServiceID: svc.ID,
+				ConnID:    conn.id,
+				PacketID:  packetID,
+			}
+			if sequenced {
+				newPacket.Flags |= packet.SequencedFlag
+				newPacket.ConnSeq = conn.seq
+				conn.seq++
 			}
-			size := newPacket.Pack(packets.Ptr.Buffer[packets.Ptr.TotalSize:])
+			size := client.cipher.Pack(newPacket, packets.Ptr.Buffer[packets.Ptr.TotalSize:])
 			packets.Ptr.SubPackets = append(packets.Ptr.SubPackets, size)
 			packets.Ptr.TotalSize += size
+			fecPackets = append(fecPackets, newPacket)
 
 			nowRawPtr += slice
 		}
-		rawPackets.Release()
 		client.scatterer.Scatter(packets.MoveArg())
+		if client.encoder != nil {
+			client.encoder.Encode(fecPackets)
+		}
+		rawPackets.Release()
 	}
 }
 
-func (client *Client) handleReverse(ch <-chan buffer.WithBufferArg[[]*packet.Packet]) {
-	for packets_ := range ch {
+func (client *Client) handleReverse(ctx context.Context, ch <-chan buffer.WithBufferArg[[]*packet.Packet]) {
+	for {
+		var packets_ buffer.WithBufferArg[[]*packet.Packet]
+		select {
+		case <-ctx.Done():
+			return
+		case packets_ = <-ch:
+		}
 		packets := packets_.ToOwned()
-		connPacketsMap := make(map[uint16][][]byte)
+		connPacketsMap := make(map[uint32][][]byte)
+		conns := make(map[uint32]*serviceConn)
 		client.connMutex.RLock()
 		for _, newPacket := range packets.Thing {
-			_, ok := client.connIDAddrMap[newPacket.ConnID]
+			conn, ok := client.connIDMap[newPacket.ConnID]
 			if !ok {
 				log.Println("conn not found:", newPacket.ConnID)
 				continue
 			}
+			conns[newPacket.ConnID] = conn
 			connPacketsMap[newPacket.ConnID] = append(connPacketsMap[newPacket.ConnID], newPacket.Buffer)
 		}
 		client.connMutex.RUnlock()
 		for connID, packets := range connPacketsMap {
-			pBuffer := buffer.NewPackedBuffer()
-			nowPtr := 0
-			for _, packet := range packets {
-				pBuffer.Ptr.SubPackets = append(pBuffer.Ptr.SubPackets, len(packet))
-				copy(pBuffer.Ptr.Buffer[nowPtr:], packet)
-				nowPtr += len(packet)
-			}
-			pBuffer.Ptr.TotalSize = nowPtr
-			err := transport.SendUDPPackets(client.udpListener, client.connIDAddrMap[connID], pBuffer.BorrowArg(), client.cfg.EnableGSO)
-			pBuffer.Release()
+			conn := conns[connID]
+			err := transport.SendUDPPayloads(conn.service.listener, conn.addr, packets, client.cfg.Load().EnableGSO)
 			if err != nil {
 				log.Println("error writing to udp:", err)
 			}
@@ -1,81 +1,92 @@
 package client
 
 import (
-	"context"
 	"log"
 	"net"
 	"time"
 
-	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/config"
 	"github.com/chenx-dust/paracat/transport"
 )
 
-type udpRelay struct {
-	ctx    context.Context
-	cancel context.CancelFunc
-	addr   *net.UDPAddr
-	conn   *net.UDPConn
-	ch     chan buffer.ArgPtr[*buffer.PackedBuffer]
-}
-
-func (relay *udpRelay) Done() <-chan struct{} {
-	return relay.ctx.Done()
-}
+// announceInterval is how often the traffic direction is repeated on udp
+// relays, which may lose the announcement.
+const announceInterval = 5 * time.Second
 
-func (relay *udpRelay) Cancel() {
-	relay.cancel()
+type udpRelay struct {
+	*relayContext
+	addr *net.UDPAddr
 }
 
-func (client *Client) newUDPRelay(addr *net.UDPAddr) (relay *udpRelay) {
-	relay = &udpRelay{addr: addr}
-	client.connectUDPRelay(relay)
-	return
+func (client *Client) newUDPRelay(addr *net.UDPAddr, relayServer config.RelayServer) (*udpRelay, error) {
+	relay := &udpRelay{
+		relayContext: client.newRelayContext("udp://"+addr.String(), config.UDPConnectionType, relayServer),
+		addr:         addr,
+	}
+	if err := client.addRelay(relay.relayContext); err != nil {
+		return nil, err
+	}
+	client.connectUDPRelay(relay, relay.current())
+	return relay, nil
 }
 
-func (client *Client) connectUDPRelay(relay *udpRelay) {
+// connectUDPRelay dials conn, the latest connection of the relay.
+func (client *Client) connectUDPRelay(relay *udpRelay, conn *relayConn) {
+	var udpConn *net.UDPConn
 	var err error
 	retry := 0
 	for {
-		relay.conn, err = net.ListenUDP("udp", nil)
+		udpConn, err = net.ListenUDP("udp", nil)
 		if err == nil {
 			break
 		}
 		log.Println("error dialing udp:", err, "retry:", retry)
-		time.Sleep(client.cfg.ReconnectDelay)
+		select {
+		case <-relay.root.Done():
+			client.closeRelayConn(relay.relayContext, conn)
+			client.relaysWG.Done()
+			return
+		case <-time.After(client.cfg.Load().ReconnectDelay):
+		}
 		retry++
 	}
-	if client.cfg.EnableGRO {
-		transport.EnableGRO(relay.conn)
+	if client.cfg.Load().EnableGRO {
+		transport.EnableGRO(udpConn)
 	}
-	if client.cfg.EnableGSO {
-		transport.EnableGSO(relay.conn)
+	if client.cfg.Load().EnableGSO {
+		transport.EnableGSO(udpConn)
 	}
 
-	relay.ctx, relay.cancel = context.WithCancel(context.Background())
-	relay.ch = make(chan buffer.ArgPtr[*buffer.PackedBuffer], client.cfg.ChannelSize)
-	client.scatterer.NewOutput(relay.ch)
-	go client.handleUDPRelayCancel(relay)
-	go client.handleUDPRelayRecv(relay)
-	go transport.SendUDPLoop(relay, relay.conn, relay.addr, relay.ch, client.cfg.EnableGSO)
+	go client.handleUDPRelayCancel(relay, conn, udpConn)
+	go client.handleUDPRelayRecv(relay, conn, udpConn)
+	go transport.SendUDPLoop(conn, udpConn, relay.addr, conn.ch, conn.congestion, relay.limiter, relay.sent, client.cfg.Load().EnableGSO)
+	go transport.HeartbeatLoop(conn, conn.heartbeat, conn.sender)
+	go transport.FeedbackLoop(conn, conn.congestion, conn.sender)
+	go client.helloLoop(conn, true)
+	go transport.AnnounceLoop(conn, conn.sender, relay.announce, announceInterval)
 }
 
-func (client *Client) handleUDPRelayCancel(relay *udpRelay) {
-	<-relay.ctx.Done()
+func (client *Client) handleUDPRelayCancel(relay *udpRelay, conn *relayConn, udpConn *net.UDPConn) {
+	<-conn.Done()
 	log.Println("closing udp relay:", relay.addr)
-	relay.conn.Close()
-	client.scatterer.RemoveOutput(relay.ch)
-	client.connectUDPRelay(relay)
+	udpConn.Close()
+	client.closeRelayConn(relay.relayContext, conn)
+	if relay.removed() {
+		client.relaysWG.Done()
+		return
+	}
+	client.connectUDPRelay(relay, client.newRelayConn(relay.relayContext))
 }
 
-func (client *Client) handleUDPRelayRecv(relay *udpRelay) {
-	defer relay.cancel()
+func (client *Client) handleUDPRelayRecv(relay *udpRelay, conn *relayConn, udpConn *net.UDPConn) {
+	defer conn.cancel()
 	for {
 		select {
-		case <-relay.ctx.Done():
+		case <-conn.Done():
 			return
 		default:
 		}
-		packets, addr, err := transport.ReceiveUDPPackets(relay.conn)
+		packets, addr, err := transport.ReceiveUDPPackets(udpConn, client.cipher)
 		if err != nil {
 			packets.Release()
 			continue
@@ -85,6 +96,6 @@ func (client *Client) handleUDPRelayRecv(relay *udpRelay) {
 			log.Println("error receiving udp packets: addr mismatch", addr, relay.addr)
 			continue
 		}
-		client.gatherer.Forward(packets.MoveArg())
+		client.handlePackets(relay.relayContext, conn, packets.MoveArg())
 	}
 }
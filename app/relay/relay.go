@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net"
@@ -12,6 +13,7 @@ import (
 
 type Relay struct {
 	cfg *config.Config
+	ctx context.Context // of Run
 
 	listenTCP bool
 	listenUDP bool
@@ -30,8 +32,12 @@ func NewRelay(cfg *config.Config) *Relay {
 	return &Relay{cfg: cfg}
 }
 
-func (relay *Relay) Run() error {
+// Run forwards until ctx is done, and returns nil once stopped by ctx with
+// its listeners and dialers closed.
+func (relay *Relay) Run(ctx context.Context) error {
 	log.Println("running relay")
+	relay.ctx = ctx
+	defer relay.close()
 
 	if relay.cfg.RelayType.ListenType == config.NotDefinedConnectionType {
 		return errors.New("listen type not defined")
@@ -103,6 +109,12 @@ func (relay *Relay) Run() error {
 		log.Println("forwarding udp to", relay.cfg.RemoteAddr)
 	}
 
+	stop := context.AfterFunc(ctx, func() {
+		log.Println("stopping relay")
+		relay.close()
+	})
+	defer stop()
+
 	wg := sync.WaitGroup{}
 	if relay.listenTCP {
 		wg.Add(1)
@@ -122,3 +134,20 @@ func (relay *Relay) Run() error {
 
 	return nil
 }
+
+// close closes the listeners and dialers opened so far, which ends the
+// forwarding on them.
+func (relay *Relay) close() {
+	if relay.tcpListener != nil {
+		relay.tcpListener.Close()
+	}
+	if relay.udpListener != nil {
+		relay.udpListener.Close()
+	}
+	if relay.tcpDialer != nil {
+		relay.tcpDialer.Close()
+	}
+	if relay.udpDialer != nil {
+		relay.udpDialer.Close()
+	}
+}
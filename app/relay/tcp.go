@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"context"
 	"io"
 	"log"
 	"net"
@@ -10,6 +11,9 @@ func (relay *Relay) handleTCPForward() {
 	for {
 		conn, err := relay.tcpListener.AcceptTCP()
 		if err != nil {
+			if relay.ctx.Err() != nil {
+				return
+			}
 			log.Println("accept tcp error:", err)
 			continue
 		}
@@ -18,6 +22,9 @@ func (relay *Relay) handleTCPForward() {
 }
 
 func (relay *Relay) handleTCPConnection(conn *net.TCPConn) {
+	context.AfterFunc(relay.ctx, func() {
+		conn.Close()
+	})
 	if relay.forwardTCP {
 		go io.Copy(conn, relay.tcpDialer)
 		go io.Copy(relay.tcpDialer, conn)
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/chenx-dust/paracat/api"
+	"github.com/chenx-dust/paracat/config"
+)
+
+// pathState is a connection as listed by the api.
+type pathState struct {
+	Peer          string  `json:"peer"`
+	Session       string  `json:"session"` // empty until joined
+	Alive         bool    `json:"alive"`
+	Authenticated bool    `json:"authenticated"`
+	Traffic       string  `json:"traffic"`
+	Standby       bool    `json:"standby"`
+	Draining      bool    `json:"draining"`
+	RTT           string  `json:"rtt"`
+	Jitter        string  `json:"jitter"`
+	ProbeLoss     float64 `json:"probe_loss"`
+	Loss          float64 `json:"loss"`
+	DeliveryRate  float64 `json:"delivery_rate"` // bytes per second
+	PacingRate    float64 `json:"pacing_rate"`   // bytes per second, 0 for not paced
+	SentBytes     uint64  `json:"sent_bytes"`
+	ReceivedBytes uint64  `json:"received_bytes"`
+}
+
+// connState is a connection to a service as listed by the api.
+type connState struct {
+	Session    string `json:"session"`
+	ConnID     uint32 `json:"conn_id"`
+	Service    string `json:"service"`
+	RemoteAddr string `json:"remote_addr"`
+	LocalAddr  string `json:"local_addr"`
+}
+
+func (server *Server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /paths", server.handleAPIPaths)
+	mux.HandleFunc("POST /paths/drain", server.handleAPIDrain)
+	mux.HandleFunc("GET /conns", server.handleAPIConns)
+	mux.HandleFunc("GET /scatter", server.handleAPIScatter)
+	mux.HandleFunc("PUT /scatter", server.handleAPISetScatter)
+	return mux
+}
+
+func (server *Server) handleAPIPaths(w http.ResponseWriter, r *http.Request) {
+	server.connsMutex.RLock()
+	conns := slices.Collect(maps.Keys(server.conns))
+	server.connsMutex.RUnlock()
+	paths := make([]pathState, 0, len(conns))
+	for _, ctx := range conns {
+		quality := ctx.prober.Quality()
+		congestion := ctx.congestion.State()
+		_, sent := ctx.sent.Total()
+		_, received := ctx.received.Total()
+		path := pathState{
+			Peer:          ctx.peer,
+			Alive:         ctx.heartbeat.Alive(),
+			Authenticated: ctx.authenticated.Load(),
+			RTT:           quality.SRTT.String(),
+			Jitter:        quality.RTTVar.String(),
+			ProbeLoss:     quality.Loss,
+			Loss:          congestion.Loss,
+			DeliveryRate:  congestion.DeliveryRate,
+			PacingRate:    congestion.Rate,
+			SentBytes:     sent,
+			ReceivedBytes: received,
+		}
+		if s := ctx.session.Load(); s != nil {
+			path.Session = fmt.Sprintf("%08x", s.id)
+		}
+		ctx.outputMutex.Lock()
+		path.Traffic = config.TrafficTypeToString(ctx.traffic)
+		path.Standby = ctx.standby
+		path.Draining = ctx.draining
+		ctx.outputMutex.Unlock()
+		paths = append(paths, path)
+	}
+	slices.SortFunc(paths, func(a, b pathState) int {
+		return strings.Compare(a.Peer, b.Peer)
+	})
+	api.WriteJSON(w, http.StatusOK, paths)
+}
+
+// handleAPIDrain drains the connections of a peer as listed in /paths.
+func (server *Server) handleAPIDrain(w http.ResponseWriter, r *http.Request) {
+	var request api.DrainRequest
+	if err := api.ReadJSON(r, &request); err != nil {
+		api.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !server.drainConn(request.Path, request.Drain) {
+		api.WriteError(w, http.StatusNotFound, fmt.Errorf("path not found: %s", request.Path))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleAPIConns(w http.ResponseWriter, r *http.Request) {
+	server.sessionsMutex.Lock()
+	sessions := slices.Collect(maps.Values(server.sessions))
+	server.sessionsMutex.Unlock()
+	conns := make([]connState, 0)
+	for _, s := range sessions {
+		id := fmt.Sprintf("%08x", s.id)
+		s.forwardMutex.Lock()
+		for connID, fc := range s.forwardConns {
+			conns = append(conns, connState{
+				Session:    id,
+				ConnID:     connID,
+				Service:    server.services[fc.serviceID].Name,
+				RemoteAddr: fc.remoteAddr.String(),
+				LocalAddr:  fc.conn.LocalAddr().String(),
+			})
+		}
+		s.forwardMutex.Unlock()
+	}
+	slices.SortFunc(conns, func(a, b connState) int {
+		if c := strings.Compare(a.Session, b.Session); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ConnID, b.ConnID)
+	})
+	api.WriteJSON(w, http.StatusOK, conns)
+}
+
+func (server *Server) handleAPIScatter(w http.ResponseWriter, r *http.Request) {
+	server.sessionsMutex.Lock()
+	mode := server.scatterType
+	server.sessionsMutex.Unlock()
+	api.WriteJSON(w, http.StatusOK, api.ScatterRequest{
+		ScatterType: config.ScatterTypeToString(mode),
+	})
+}
+
+func (server *Server) handleAPISetScatter(w http.ResponseWriter, r *http.Request) {
+	var request api.ScatterRequest
+	if err := api.ReadJSON(r, &request); err != nil {
+		api.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	mode := config.ParseScatterType(request.ScatterType)
+	if mode == config.NotDefinedScatterType {
+		api.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid scatter type: %s", request.ScatterType))
+		return
+	}
+	server.setScatterType(mode)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+// handshakeTimeout is how long a tcp connection may stay unauthenticated.
+const handshakeTimeout = 10 * time.Second
+
+// hello is what the server offers to clients.
+func (server *Server) hello() packet.Hello {
+	features := packet.FECFeature | packet.FeedbackFeature | packet.SequenceFeature
+	if server.cipher != nil {
+		features |= packet.EncryptionFeature
+	}
+	return packet.Hello{
+		Version:  packet.VERSION,
+		Features: features,
+	}
+}
+
+// negotiate agrees on the features with the hello of a client. The reject
+// packet tells the client why if they are incompatible.
+func (server *Server) negotiate(peer string, hello packet.Hello) (*packet.Hello, *packet.Packet) {
+	features, err := packet.Negotiate(server.hello(), hello)
+	if err != nil {
+		log.Println("incompatible client of", peer+":", err)
+		return nil, packet.NewRejectPacket(err.Error())
+	}
+	return &packet.Hello{
+		Version:  hello.Version,
+		Features: features,
+	}, nil
+}
+
+// agree keeps the features agreed with the client and the heartbeat
+// interval of its hello, which the accept answers with that of ctx. It
+// reports whether the features are the first ones.
+func (ctx *connContext) agree(agreed *packet.Hello, hello packet.Hello) bool {
+	ctx.congestion.SetFeedback(agreed.Features&packet.FeedbackFeature != 0)
+	ctx.heartbeat.SetPeerInterval(hello.HeartbeatInterval)
+	agreed.HeartbeatInterval = ctx.heartbeat.Interval()
+	return ctx.hello.Swap(agreed) == nil
+}
+
+func (server *Server) handleHello(ctx *connContext, p *packet.Packet) {
+	hello, err := packet.ParseHello(p)
+	if err != nil {
+		log.Println("error parsing hello:", err)
+		return
+	}
+	agreed, reject := server.negotiate(ctx.peer, hello)
+	if reject != nil {
+		ctx.sender.Send(reject)
+		return
+	}
+	if ctx.agree(agreed, hello) {
+		log.Println("features of", ctx.peer+":", agreed.Features)
+	}
+	if ctx.authenticated.Load() {
+		// also when the client missed the accept
+		ctx.sender.Send(packet.NewAcceptPacket(*agreed))
+		return
+	}
+	ctx.sender.Send(packet.NewChallengePacket(server.authenticator.Challenge(ctx.peer)))
+}
+
+func (server *Server) handleResponse(ctx *connContext, p *packet.Packet) {
+	if ctx.authenticated.Load() {
+		return
+	}
+	response, err := packet.ParseResponse(p)
+	if err != nil || !server.authenticator.Verify(ctx.peer, response) {
+		log.Println("authentication failed:", ctx.peer)
+		server.statisticUnauthenticated.CountPacket(uint32(len(p.Buffer)))
+		return
+	}
+	agreed, reject := server.negotiate(ctx.peer, response.Hello)
+	if reject != nil {
+		ctx.sender.Send(reject)
+		return
+	}
+	log.Println("authenticated:", ctx.peer)
+	ctx.agree(agreed, response.Hello)
+	server.registerConn(ctx)
+	ctx.sender.Send(packet.NewAcceptPacket(*agreed))
+}
+
+// handleHandshakeTimeout closes a connection not authenticated in time.
+func (server *Server) handleHandshakeTimeout(ctx *connContext) {
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		if !ctx.authenticated.Load() {
+			log.Println("authentication timeout:", ctx.peer)
+			ctx.cancel()
+		}
+	case <-ctx.Done():
+	}
+}
+
+// handleUDPHandshake authenticates an unknown udp source. No state is kept
+// for it until it answers a challenge, which is sent back directly.
+func (server *Server) handleUDPHandshake(addr *net.UDPAddr, packets_ buffer.WithBufferArg[[]*packet.Packet]) {
+	packets := packets_.ToOwned()
+	defer packets.Release()
+	peer := "udp://" + addr.String()
+	for _, p := range packets.Thing {
+		switch p.ControlType() {
+		case packet.HelloControlType:
+			hello, err := packet.ParseHello(p)
+			if err != nil {
+				log.Println("error parsing hello:", err)
+				break
+			}
+			if _, reject := server.negotiate(peer, hello); reject != nil {
+				server.sendUDPControl(addr, reject)
+			} else {
+				server.sendUDPControl(addr, packet.NewChallengePacket(server.authenticator.Challenge(peer)))
+			}
+			continue
+		case packet.ResponseControlType:
+			response, err := packet.ParseResponse(p)
+			if err != nil || !server.authenticator.Verify(peer, response) {
+				log.Println("authentication failed:", peer)
+				break
+			}
+			agreed, reject := server.negotiate(peer, response.Hello)
+			if reject != nil {
+				server.sendUDPControl(addr, reject)
+				continue
+			}
+			log.Println("new udp connection from", addr.String())
+			log.Println("authenticated:", peer)
+			ctx := server.newUDPConnContext(addr)
+			ctx.agree(agreed, response.Hello)
+			server.registerConn(&ctx.connContext)
+			server.bindSession(&ctx.connContext, p.SessionID, p.Version)
+			ctx.sender.Send(packet.NewAcceptPacket(*agreed))
+			return
+		}
+		server.statisticUnauthenticated.CountPacket(uint32(len(p.Buffer)))
+	}
+}
+
+func (server *Server) sendUDPControl(addr *net.UDPAddr, p *packet.Packet) {
+	data := make([]byte, packet.HEADER_SIZE+len(p.Buffer)+packet.SEAL_OVERHEAD)
+	size := server.cipher.Pack(p, data)
+	if _, err := server.udpListener.WriteToUDP(data[:size], addr); err != nil {
+		log.Println("error writing to udp:", err)
+	}
+}
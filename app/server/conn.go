@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/packet"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+// connContext is the state shared by tcp and udp connections from clients.
+type connContext struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	ch         chan buffer.ArgPtr[*buffer.PackedBuffer]
+	sender     transport.ControlSender
+	peer       string
+	heartbeat  *transport.Heartbeat
+	prober     *transport.Prober
+	congestion *transport.Congestion
+	dropped    *packet.PacketStatistic // scattered packets dropped on a full queue
+	sent       *packet.PacketStatistic
+	received   *packet.PacketStatistic
+	limiter    *transport.TokenBucket // nil for unlimited
+
+	authenticated atomic.Bool
+	hello         atomic.Pointer[packet.Hello] // agreed with the client, nil until hello or for legacy clients
+	session       atomic.Pointer[session]      // nil until the first authenticated packet after hello
+
+	// outputMutex serializes scatterer registration of ch and session binding
+	outputMutex sync.Mutex
+	traffic     config.TrafficType
+	weight      int
+	standby     bool
+	draining    bool // kept connected but not scattered to
+}
+
+func (server *Server) initConnContext(ctx *connContext, peer string) {
+	server.connsWG.Add(1)
+	ctx.ctx, ctx.cancel = context.WithCancel(server.ctx)
+	ctx.ch = make(chan buffer.ArgPtr[*buffer.PackedBuffer], server.cfg.Load().ChannelSize)
+	ctx.sender = transport.NewControlSender(ctx.ch, server.cipher, 0)
+	ctx.peer = peer
+	ctx.heartbeat = transport.NewHeartbeat(server.cfg.Load().HeartbeatInterval, server.cfg.Load().HeartbeatTimeout, func(alive bool) {
+		if alive {
+			log.Println("connection is alive:", peer)
+		} else {
+			log.Println("connection is dead:", peer)
+		}
+		if s := ctx.session.Load(); s != nil {
+			s.scatterer.SetOutputAlive(ctx.ch, alive)
+		}
+	})
+	ctx.prober = transport.NewProber(server.cfg.Load().ProbeInterval)
+	ctx.congestion = transport.NewCongestion(server.cfg.Load().CongestionControl, server.cfg.Load().FeedbackInterval, func() time.Duration {
+		return ctx.prober.Quality().SRTT
+	}, func(rate float64) {
+		if s := ctx.session.Load(); s != nil {
+			s.scatterer.SetOutputRate(ctx.ch, rate)
+		}
+	})
+	ctx.dropped = packet.NewPacketStatistic()
+	ctx.sent = packet.NewPacketStatistic()
+	ctx.received = packet.NewPacketStatistic()
+	ctx.limiter = transport.NewTokenBucket(server.cfg.Load().RateLimit)
+	ctx.traffic = config.BothTrafficType
+	ctx.weight = 1
+}
+
+func (ctx *connContext) Done() <-chan struct{} {
+	return ctx.ctx.Done()
+}
+
+func (ctx *connContext) Cancel() {
+	ctx.cancel()
+}
+
+// registerConn starts forwarding traffic of an authenticated connection.
+// It joins a session by its next packet.
+func (server *Server) registerConn(ctx *connContext) {
+	ctx.authenticated.Store(true)
+	server.connsMutex.Lock()
+	server.conns[ctx] = struct{}{}
+	server.connsMutex.Unlock()
+}
+
+// unregisterConn stops forwarding traffic of a closed connection, and
+// releases what is left to send on it.
+func (server *Server) unregisterConn(ctx *connContext) {
+	server.connsMutex.Lock()
+	delete(server.conns, ctx)
+	server.connsMutex.Unlock()
+	defer func() {
+		buffer.Drain(ctx.ch)
+		ctx.congestion.Drain()
+	}()
+	ctx.outputMutex.Lock()
+	defer ctx.outputMutex.Unlock()
+	if s := ctx.session.Swap(nil); s != nil {
+		s.scatterer.RemoveOutput(ctx.ch)
+		server.releaseSession(s)
+	}
+}
+
+// PathDropped returns the statistic of packets dropped on a full queue of
+// every connection by its peer.
+func (server *Server) PathDropped() map[string]*packet.PacketStatistic {
+	server.connsMutex.RLock()
+	defer server.connsMutex.RUnlock()
+	dropped := make(map[string]*packet.PacketStatistic, len(server.conns))
+	for ctx := range server.conns {
+		dropped[ctx.peer] = ctx.dropped
+	}
+	return dropped
+}
+
+// PathCongestions returns what congestion control learned about every
+// connection by its peer.
+func (server *Server) PathCongestions() map[string]transport.CongestionState {
+	server.connsMutex.RLock()
+	defer server.connsMutex.RUnlock()
+	states := make(map[string]transport.CongestionState, len(server.conns))
+	for ctx := range server.conns {
+		states[ctx.peer] = ctx.congestion.State()
+	}
+	return states
+}
+
+// PathQualities returns the measured quality of every connection by its peer.
+func (server *Server) PathQualities() map[string]transport.PathQuality {
+	server.connsMutex.RLock()
+	defer server.connsMutex.RUnlock()
+	qualities := make(map[string]transport.PathQuality, len(server.conns))
+	for ctx := range server.conns {
+		qualities[ctx.peer] = ctx.prober.Quality()
+	}
+	return qualities
+}
+
+func (server *Server) handlePackets(ctx *connContext, packets_ buffer.WithBufferArg[[]*packet.Packet]) {
+	packets := packets_.ToOwned()
+	size := 0
+	for _, p := range packets.Thing {
+		size += p.WireSize
+	}
+	ctx.congestion.Received(len(packets.Thing), size)
+	ctx.received.CountPackets(uint32(len(packets.Thing)), uint64(size))
+	sessionID, version := packets.Thing[0].SessionID, packets.Thing[0].Version
+	packets.Thing = transport.FilterControlPackets(packets.Thing, func(p *packet.Packet) {
+		server.handleControl(ctx, p)
+	})
+	if ctx.authenticated.Load() && (ctx.hello.Load() != nil || version == packet.LEGACY_VERSION) {
+		server.bindSession(ctx, sessionID, version)
+	}
+	if len(packets.Thing) == 0 {
+		packets.Release()
+		return
+	}
+	s := ctx.session.Load()
+	if !ctx.authenticated.Load() || s == nil {
+		for _, p := range packets.Thing {
+			server.statisticUnauthenticated.CountPacket(uint32(len(p.Buffer)))
+		}
+		packets.Release()
+		return
+	}
+	s.gatherer.Forward(packets.MoveArg())
+}
+
+func (server *Server) handleControl(ctx *connContext, p *packet.Packet) {
+	// path maintenance is allowed before authentication, as it does not
+	// touch the forwarded traffic, and announce is applied once accepted
+	switch p.ControlType() {
+	case packet.HelloControlType:
+		server.handleHello(ctx, p)
+	case packet.ResponseControlType:
+		server.handleResponse(ctx, p)
+	case packet.AnnounceControlType:
+		announce, err := packet.ParseAnnounce(p)
+		if err != nil {
+			log.Println("error parsing announce:", err)
+			return
+		}
+		server.handleAnnounce(ctx, announce)
+	case packet.HeartbeatControlType:
+		ctx.heartbeat.Received()
+	case packet.FeedbackControlType:
+		ctx.congestion.HandleFeedback(p)
+		if s := ctx.session.Load(); s != nil {
+			s.scatterer.SetOutputLossy(ctx.ch, ctx.congestion.Lossy(server.cfg.Load().FailoverLoss))
+		}
+	case packet.ProbeControlType:
+		transport.Echo(ctx.sender, p)
+	case packet.EchoControlType:
+		ctx.prober.HandleEcho(p)
+		if s := ctx.session.Load(); s != nil {
+			s.scatterer.SetOutputRTT(ctx.ch, ctx.prober.Quality().SRTT)
+		}
+	default:
+		log.Println("unexpected control packet:", p.ControlType())
+	}
+}
+
+// handleAnnounce applies the traffic direction and standby announced by the
+// client. Directions are from the client's point of view, so only paths
+// carrying down traffic are used to scatter back.
+func (server *Server) handleAnnounce(ctx *connContext, announce packet.Announce) {
+	ctx.outputMutex.Lock()
+	defer ctx.outputMutex.Unlock()
+	if ctx.traffic != announce.Traffic {
+		log.Println("traffic of", ctx.peer, "changed to:", config.TrafficTypeToString(announce.Traffic))
+		ctx.traffic = announce.Traffic
+	}
+	if ctx.standby != announce.Standby {
+		if announce.Standby {
+			log.Println("connection is on standby:", ctx.peer)
+		} else {
+			log.Println("connection is back from standby:", ctx.peer)
+		}
+		ctx.standby = announce.Standby
+	}
+	ctx.weight = int(announce.Weight)
+	server.updateOutputLocked(ctx)
+}
+
+// drainConn stops or resumes scattering on the connections of a peer, which
+// stay connected, and tells whether any was found.
+func (server *Server) drainConn(peer string, drain bool) bool {
+	server.connsMutex.RLock()
+	var conns []*connContext
+	for ctx := range server.conns {
+		if ctx.peer == peer {
+			conns = append(conns, ctx)
+		}
+	}
+	server.connsMutex.RUnlock()
+	for _, ctx := range conns {
+		ctx.outputMutex.Lock()
+		if ctx.draining != drain {
+			if drain {
+				log.Println("draining connection:", peer)
+			} else {
+				log.Println("resuming connection:", peer)
+			}
+			ctx.draining = drain
+			server.updateOutputLocked(ctx)
+		}
+		ctx.outputMutex.Unlock()
+	}
+	return len(conns) > 0
+}
+
+func (server *Server) updateOutputLocked(ctx *connContext) {
+	select {
+	case <-ctx.Done():
+		return
+	default:
+	}
+	s := ctx.session.Load()
+	if s == nil {
+		return
+	}
+	if ctx.traffic == config.UpTrafficType || ctx.draining {
+		s.scatterer.RemoveOutput(ctx.ch)
+	} else {
+		s.scatterer.NewOutput(ctx.ch, ctx.weight, server.cfg.Load().Overflow, ctx.dropped, ctx.limiter)
+		s.scatterer.SetOutputRate(ctx.ch, ctx.congestion.State().Rate)
+		s.scatterer.SetOutputStandby(ctx.ch, ctx.standby)
+	}
+}
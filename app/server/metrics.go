@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/metrics"
+)
+
+// collectMetrics adds the counters and the state of the server by session
+// and path, which are cumulative and not reset by reports.
+func (server *Server) collectMetrics(m *metrics.Metrics) {
+	if server.cipher != nil {
+		m.Statistic("paracat_rejected", "failed to be opened by the cipher.", server.cipher.StatisticRejected)
+	}
+	m.Statistic("paracat_unauthenticated", "dropped from unauthenticated paths.", server.statisticUnauthenticated)
+	m.Gauge("paracat_active_buffers", "Packet buffers in use.", float64(buffer.ActiveBuffers.Load()))
+
+	server.sessionsMutex.Lock()
+	sessions := slices.Collect(maps.Values(server.sessions))
+	server.sessionsMutex.Unlock()
+	m.Gauge("paracat_sessions", "Active sessions of clients.", float64(len(sessions)))
+	for _, s := range sessions {
+		id := fmt.Sprintf("%08x", s.id)
+		m.Scatterer(s.scatterer, "session", id)
+		m.Gatherer(s.gatherer, "session", id)
+		s.forwardMutex.Lock()
+		conns := len(s.forwardConns)
+		s.forwardMutex.Unlock()
+		m.Gauge("paracat_connections", "Active connections to services.", float64(conns), "session", id)
+	}
+
+	server.connsMutex.RLock()
+	defer server.connsMutex.RUnlock()
+	m.Gauge("paracat_paths", "Authenticated paths from clients.", float64(len(server.conns)))
+	for ctx := range server.conns {
+		m.Statistic("paracat_path_sent", "sent on the path.", ctx.sent, "path", ctx.peer)
+		m.Statistic("paracat_path_received", "received on the path.", ctx.received, "path", ctx.peer)
+		m.Statistic("paracat_path_dropped", "dropped on a full queue of the path.", ctx.dropped, "path", ctx.peer)
+		m.Path(ctx.heartbeat.Alive(), ctx.prober.Quality(), ctx.congestion.State(), "path", ctx.peer)
+	}
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"log"
+
+	"github.com/chenx-dust/paracat/config"
+)
+
+// Reload applies a changed config without dropping sessions. The scatter
+// type changes on every session, other settings apply to paths and sessions
+// from then on.
+func (server *Server) Reload(cfg *config.Config) {
+	cfg, kept := config.Reload(server.cfg.Load(), cfg)
+	for _, name := range kept {
+		log.Println(name, "changed, restart to apply")
+	}
+	old := server.cfg.Swap(cfg)
+	if cfg.ScatterType != old.ScatterType {
+		server.setScatterType(cfg.ScatterType)
+	}
+	log.Println("config reloaded")
+}
@@ -1,46 +1,90 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"maps"
 	"net"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/chenx-dust/paracat/channel"
+	"github.com/chenx-dust/paracat/api"
 	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/metrics"
+	"github.com/chenx-dust/paracat/packet"
 	"github.com/chenx-dust/paracat/transport"
 )
 
 type Server struct {
-	cfg         *config.Config
+	cfg         atomic.Pointer[config.Config] // swapped on reload
 	tcpListener *net.TCPListener
 	udpListener *net.UDPConn
 
-	gatherer    *channel.Gatherer
-	scatterer   *channel.Scatterer
-	idIncrement atomic.Uint32
+	services map[uint16]config.Service
+	cipher   *packet.Cipher // nil if encryption is disabled
+
+	authenticator            *transport.Authenticator // nil if authentication is disabled
+	statisticUnauthenticated *packet.PacketStatistic
 
 	sourceMutex    sync.RWMutex
 	sourceUDPAddrs map[string]*udpConnContext
 
-	forwardConns map[uint16]*net.UDPConn
+	sessionsMutex sync.Mutex
+	sessions      map[uint32]*session
+	scatterType   config.ScatterType // of new sessions, changed by the api
+
+	connsMutex sync.RWMutex
+	conns      map[*connContext]struct{}
+
+	// ctx is of Run, and every connection and session is derived from it
+	ctx     context.Context
+	connsWG sync.WaitGroup // connections not closed yet
 }
 
-func NewServer(cfg *config.Config) *Server {
-	return &Server{
-		cfg:            cfg,
-		gatherer:       channel.NewGatherer(cfg.ChannelSize),
-		scatterer:      channel.NewScatterer(cfg.ScatterType),
-		forwardConns:   make(map[uint16]*net.UDPConn),
+func NewServer(cfg *config.Config) (*Server, error) {
+	server := &Server{
 		sourceUDPAddrs: make(map[string]*udpConnContext),
+		sessions:       make(map[uint32]*session),
+		services:       make(map[uint16]config.Service),
+		conns:          make(map[*connContext]struct{}),
+		scatterType:    cfg.ScatterType,
+
+		statisticUnauthenticated: packet.NewPacketStatistic(),
 	}
+	server.cfg.Store(cfg)
+	for _, svc := range cfg.Services {
+		server.services[svc.ID] = svc
+	}
+	if cfg.PSK != "" {
+		cipher, err := packet.NewCipher(cfg.Cipher, cfg.PSK)
+		if err != nil {
+			return nil, fmt.Errorf("creating cipher: %w", err)
+		}
+		log.Println("encrypting with", cfg.Cipher)
+		server.cipher = cipher
+		authenticator, err := transport.NewAuthenticator(cfg.PSK)
+		if err != nil {
+			return nil, fmt.Errorf("creating authenticator: %w", err)
+		}
+		server.authenticator = authenticator
+	}
+	return server, nil
 }
 
-func (server *Server) Run() error {
+// Run runs the server until ctx is done or it fails. Once stopped by ctx it
+// returns nil, with listeners, connections and sessions closed and buffers
+// released.
+func (server *Server) Run(ctx context.Context) error {
 	log.Println("running server")
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+	server.ctx = ctx
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", server.cfg.ListenAddr)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", server.cfg.Load().ListenAddr)
 	if err != nil {
 		return err
 	}
@@ -49,49 +93,142 @@ func (server *Server) Run() error {
 		return err
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", server.cfg.ListenAddr)
+	udpAddr, err := net.ResolveUDPAddr("udp", server.cfg.Load().ListenAddr)
 	if err != nil {
+		server.tcpListener.Close()
 		return err
 	}
 	server.udpListener, err = net.ListenUDP("udp", udpAddr)
 	if err != nil {
+		server.tcpListener.Close()
 		return err
 	}
-	log.Println("listening on", server.cfg.ListenAddr)
-	log.Println("dialing to", server.cfg.RemoteAddr)
+	log.Println("listening on", server.cfg.Load().ListenAddr)
+	for _, svc := range server.cfg.Load().Services {
+		if svc.Name == "" {
+			log.Println("dialing to", svc.Addr)
+		} else {
+			log.Println("dialing to", svc.Addr, "for service", svc.Name)
+		}
+	}
+
+	if server.cfg.Load().MetricsAddr != "" {
+		metricsServer, err := metrics.Serve(server.cfg.Load().MetricsAddr, server.collectMetrics)
+		if err != nil {
+			server.closeListeners()
+			return err
+		}
+		defer metricsServer.Close()
+		log.Println("serving metrics on", server.cfg.Load().MetricsAddr)
+	}
+	if server.cfg.Load().APIAddr != "" {
+		apiServer, err := api.Serve(server.cfg.Load().APIAddr, server.cfg.Load().APIToken, server.apiHandler())
+		if err != nil {
+			server.closeListeners()
+			return err
+		}
+		defer apiServer.Close()
+		log.Println("serving api on", server.cfg.Load().APIAddr)
+	}
 
-	if server.cfg.EnableGRO {
+	if server.cfg.Load().EnableGRO {
 		transport.EnableGRO(server.udpListener)
 	}
-	if server.cfg.EnableGSO {
+	if server.cfg.Load().EnableGSO {
 		transport.EnableGSO(server.udpListener)
 	}
 
-	go server.handleForward(server.gatherer.GetOutChan())
-
 	wg := sync.WaitGroup{}
-	wg.Add(3)
+	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		server.handleTCP()
+		if err := server.handleTCP(); err != nil {
+			cancel(fmt.Errorf("accepting tcp connection: %w", err))
+		}
 	}()
 	go func() {
 		defer wg.Done()
 		server.handleUDPListener()
 	}()
-	if server.cfg.ReportInterval > 0 {
+	if server.cfg.Load().ReportInterval > 0 {
+		wg.Add(1)
 		go func() {
-			ticker := time.NewTicker(server.cfg.ReportInterval)
+			defer wg.Done()
+			ticker := time.NewTicker(server.cfg.Load().ReportInterval)
 			defer ticker.Stop()
-			for range ticker.C {
-				pkg, band := server.scatterer.StatisticIn.GetAndReset()
-				log.Printf("scatter in: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, server.cfg.ReportInterval, float64(band)/server.cfg.ReportInterval.Seconds()/1024/1024)
-				pkg, band = server.scatterer.StatisticOut.GetAndReset()
-				log.Printf("scatter out: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, server.cfg.ReportInterval, float64(band)/server.cfg.ReportInterval.Seconds()/1024/1024)
-				pkg, band = server.gatherer.StatisticIn.GetAndReset()
-				log.Printf("gather in: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, server.cfg.ReportInterval, float64(band)/server.cfg.ReportInterval.Seconds()/1024/1024)
-				pkg, band = server.gatherer.StatisticOut.GetAndReset()
-				log.Printf("gather out: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, server.cfg.ReportInterval, float64(band)/server.cfg.ReportInterval.Seconds()/1024/1024)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				log.Printf("sessions: %d", server.sessionCount())
+				pkg, band := server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.scatterer.StatisticIn })
+				log.Printf("scatter in: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, server.cfg.Load().ReportInterval, float64(band)/server.cfg.Load().ReportInterval.Seconds()/1024/1024)
+				pkg, band = server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.scatterer.StatisticOut })
+				log.Printf("scatter out: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, server.cfg.Load().ReportInterval, float64(band)/server.cfg.Load().ReportInterval.Seconds()/1024/1024)
+				pkg, band = server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.gatherer.StatisticIn })
+				log.Printf("gather in: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, server.cfg.Load().ReportInterval, float64(band)/server.cfg.Load().ReportInterval.Seconds()/1024/1024)
+				pkg, band = server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.gatherer.StatisticOut })
+				log.Printf("gather out: %d packets, %d bytes in %s, %.2f MB/s", pkg, band, server.cfg.Load().ReportInterval, float64(band)/server.cfg.Load().ReportInterval.Seconds()/1024/1024)
+				pkg, band = server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.gatherer.StatisticRecovered })
+				if pkg > 0 {
+					log.Printf("fec recovered: %d packets, %d bytes in %s", pkg, band, server.cfg.Load().ReportInterval)
+				}
+				pkg, band = server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.gatherer.StatisticDuplicate })
+				if pkg > 0 {
+					log.Printf("duplicate: %d packets, %d bytes in %s", pkg, band, server.cfg.Load().ReportInterval)
+				}
+				pkg, band = server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.gatherer.StatisticDedupLate })
+				if pkg > 0 {
+					log.Printf("dedup late: %d packets, %d bytes in %s", pkg, band, server.cfg.Load().ReportInterval)
+				}
+				pkg, band = server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.gatherer.StatisticReordered })
+				if pkg > 0 {
+					log.Printf("reordered: %d packets, %d bytes in %s", pkg, band, server.cfg.Load().ReportInterval)
+				}
+				pkg, band = server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.gatherer.StatisticLate })
+				if pkg > 0 {
+					log.Printf("reorder late: %d packets, %d bytes in %s", pkg, band, server.cfg.Load().ReportInterval)
+				}
+				pkg, band = server.sessionsStatistic(func(s *session) *packet.PacketStatistic { return s.gatherer.StatisticDropped })
+				if pkg > 0 {
+					log.Printf("gather dropped: %d packets, %d bytes in %s", pkg, band, server.cfg.Load().ReportInterval)
+				}
+				if server.cipher != nil {
+					pkg, band = server.cipher.StatisticRejected.GetAndReset()
+					if pkg > 0 {
+						log.Printf("rejected: %d packets, %d bytes in %s", pkg, band, server.cfg.Load().ReportInterval)
+					}
+				}
+				pkg, band = server.statisticUnauthenticated.GetAndReset()
+				if pkg > 0 {
+					log.Printf("unauthenticated: %d packets, %d bytes in %s", pkg, band, server.cfg.Load().ReportInterval)
+				}
+				dropped := server.PathDropped()
+				for _, name := range slices.Sorted(maps.Keys(dropped)) {
+					pkg, band = dropped[name].GetAndReset()
+					if pkg > 0 {
+						log.Printf("path %s dropped: %d packets, %d bytes in %s", name, pkg, band, server.cfg.Load().ReportInterval)
+					}
+				}
+				qualities := server.PathQualities()
+				for _, name := range slices.Sorted(maps.Keys(qualities)) {
+					quality := qualities[name]
+					log.Printf("path %s: rtt %s, jitter %s, loss %.2f%%", name, quality.SRTT, quality.RTTVar, quality.Loss*100)
+				}
+				congestions := server.PathCongestions()
+				for _, name := range slices.Sorted(maps.Keys(congestions)) {
+					state := congestions[name]
+					if state.DeliveryRate == 0 {
+						continue
+					}
+					pacing := "not paced"
+					if state.Rate > 0 {
+						pacing = fmt.Sprintf("paced at %.2f MB/s", state.Rate/1024/1024)
+					}
+					log.Printf("path %s: delivered %.2f MB/s, loss %.2f%%, %s", name, state.DeliveryRate/1024/1024, state.Loss*100, pacing)
+				}
 
 				// buffer.BufferTraceBack.Lock()
 				// for k, v := range buffer.BufferTraceBack.TraceBack {
@@ -101,7 +238,23 @@ func (server *Server) Run() error {
 			}
 		}()
 	}
+
+	<-ctx.Done()
+	log.Println("stopping server")
+	server.closeListeners()
 	wg.Wait()
+	// connections are derived from ctx, and close by themselves, and so do
+	// sessions once their connections are gone
+	server.connsWG.Wait()
+	log.Println("server stopped")
 
+	if err := context.Cause(ctx); err != context.Cause(parent) {
+		return err
+	}
 	return nil
 }
+
+func (server *Server) closeListeners() {
+	server.tcpListener.Close()
+	server.udpListener.Close()
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chenx-dust/paracat/channel"
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+// session is the state of one client, identified by the session id it
+// chooses. Sessions do not share packet ids, connection ids or paths, and
+// live as long as any path is bound to them.
+type session struct {
+	id        uint32
+	version   uint8 // wire format of the client
+	sequenced bool  // conn seq is sent to the client
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	gatherer    *channel.Gatherer
+	scatterer   *channel.Scatterer
+	encoder     *channel.FECEncoder // nil if fec is disabled
+	idIncrement atomic.Uint32
+
+	forwardMutex sync.Mutex
+	forwardConns map[uint32]*forwardConn
+
+	connCount int // guarded by server.sessionsMutex
+}
+
+// forwardConn is the socket of a connection to a remote service.
+type forwardConn struct {
+	conn       *net.UDPConn
+	remoteAddr *net.UDPAddr
+	serviceID  uint16
+	seq        uint32 // conn seq of the next packet, only used by handleReverse
+}
+
+func (server *Server) newSession(id uint32, version uint8, features packet.Features) *session {
+	if version == packet.LEGACY_VERSION {
+		log.Println("new session of legacy client")
+	} else {
+		log.Printf("new session: %08x", id)
+	}
+	ctx, cancel := context.WithCancel(server.ctx)
+	s := &session{
+		id:           id,
+		version:      version,
+		sequenced:    version != packet.LEGACY_VERSION && features&packet.SequenceFeature != 0,
+		ctx:          ctx,
+		cancel:       cancel,
+		gatherer:     channel.NewGatherer(server.cfg.Load().ChannelSize, server.cfg.Load().Overflow, server.cfg.Load().DedupTimeout, server.cfg.Load().DedupWindow, server.cfg.Load().ReorderDelay),
+		scatterer:    channel.NewScatterer(server.scatterType, server.cfg.Load().Redundancy),
+		forwardConns: make(map[uint32]*forwardConn),
+	}
+	// packet ids start at random, so that a client does not take packets of a
+	// renewed session as duplicates of the former one
+	s.idIncrement.Store(rand.Uint32())
+	if server.cfg.Load().FECDataShards > 0 && features&packet.FECFeature != 0 {
+		s.encoder = channel.NewFECEncoder(server.cfg.Load().FECDataShards, server.cfg.Load().FECParityShards, id, server.cipher, s.scatterer.Scatter)
+	}
+	go server.handleForward(s)
+	return s
+}
+
+func (s *session) close() {
+	log.Printf("closing session: %08x", s.id)
+	s.cancel()
+	s.gatherer.Close()
+	s.forwardMutex.Lock()
+	defer s.forwardMutex.Unlock()
+	for _, fc := range s.forwardConns {
+		fc.conn.Close()
+	}
+}
+
+// bindSession moves a path to the session of id, creating the session if
+// needed. A path belongs to one session at a time, so a client restarting
+// behind the same path takes it over. Legacy clients share session 0.
+func (server *Server) bindSession(ctx *connContext, id uint32, version uint8) {
+	if s := ctx.session.Load(); s != nil && s.id == id {
+		return
+	}
+	ctx.outputMutex.Lock()
+	defer ctx.outputMutex.Unlock()
+	select {
+	case <-ctx.Done():
+		return
+	default:
+	}
+	old := ctx.session.Load()
+	if old != nil && old.id == id {
+		return
+	}
+	server.sessionsMutex.Lock()
+	s, ok := server.sessions[id]
+	if !ok {
+		var features packet.Features
+		if hello := ctx.hello.Load(); hello != nil {
+			features = hello.Features
+		}
+		s = server.newSession(id, version, features)
+		server.sessions[id] = s
+	}
+	s.connCount++
+	server.sessionsMutex.Unlock()
+
+	if old != nil {
+		old.scatterer.RemoveOutput(ctx.ch)
+		server.releaseSession(old)
+	}
+	log.Printf("%s joined session: %08x", ctx.peer, id)
+	ctx.session.Store(s)
+	server.updateOutputLocked(ctx)
+}
+
+func (server *Server) releaseSession(s *session) {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+	s.connCount--
+	if s.connCount > 0 {
+		return
+	}
+	delete(server.sessions, s.id)
+	s.close()
+}
+
+// setScatterType changes the scatter type of every session and of new ones.
+func (server *Server) setScatterType(mode config.ScatterType) {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+	server.scatterType = mode
+	for _, s := range server.sessions {
+		s.scatterer.SetMode(mode)
+	}
+}
+
+// sessionsStatistic sums up and resets a statistic of every session.
+func (server *Server) sessionsStatistic(get func(s *session) *packet.PacketStatistic) (count uint32, bandwidth uint64) {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+	for _, s := range server.sessions {
+		c, b := get(s).GetAndReset()
+		count += c
+		bandwidth += b
+	}
+	return
+}
+
+func (server *Server) sessionCount() int {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+	return len(server.sessions)
+}
@@ -1,37 +1,35 @@
 package server
 
 import (
-	"context"
 	"log"
 	"net"
 
 	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/packet"
 	"github.com/chenx-dust/paracat/transport"
 )
 
 type tcpConnContext struct {
-	ctx    context.Context
-	cancel context.CancelFunc
-	conn   *net.TCPConn
-	ch     chan<- buffer.ArgPtr[*buffer.PackedBuffer]
-}
-
-func (ctx *tcpConnContext) Done() <-chan struct{} {
-	return ctx.ctx.Done()
-}
-
-func (ctx *tcpConnContext) Cancel() {
-	ctx.cancel()
+	connContext
+	conn *net.TCPConn
 }
 
 func (server *Server) newTCPConnContext(conn *net.TCPConn) *tcpConnContext {
-	ctx, cancel := context.WithCancel(context.Background())
-	ch := make(chan buffer.ArgPtr[*buffer.PackedBuffer], server.cfg.ChannelSize)
-	server.scatterer.NewOutput(ch)
-	newCtx := &tcpConnContext{ctx, cancel, conn, ch}
+	newCtx := &tcpConnContext{conn: conn}
+	server.initConnContext(&newCtx.connContext, "tcp://"+conn.RemoteAddr().String())
+	if server.authenticator == nil {
+		server.registerConn(&newCtx.connContext)
+	} else {
+		go server.handleHandshakeTimeout(&newCtx.connContext)
+	}
 	go server.handleTCPConnContextCancel(newCtx)
-	go transport.ReceiveTCPLoop(newCtx, conn, server.gatherer)
-	go transport.SendTCPLoop(newCtx, conn, ch)
+	go transport.ReceiveTCPLoop(newCtx, conn, server.cipher, func(packets buffer.WithBufferArg[[]*packet.Packet]) {
+		server.handlePackets(&newCtx.connContext, packets)
+	})
+	go transport.SendTCPLoop(newCtx, conn, newCtx.ch, newCtx.congestion, newCtx.limiter, newCtx.sent)
+	go transport.HeartbeatLoop(newCtx, newCtx.heartbeat, newCtx.sender)
+	go transport.ProbeLoop(newCtx, newCtx.prober, newCtx.sender)
+	go transport.FeedbackLoop(newCtx, newCtx.congestion, newCtx.sender)
 	return newCtx
 }
 
@@ -39,14 +37,20 @@ func (server *Server) handleTCPConnContextCancel(ctx *tcpConnContext) {
 	<-ctx.ctx.Done()
 	log.Println("closing tcp connection:", ctx.conn.RemoteAddr().String())
 	ctx.conn.Close()
-	server.scatterer.RemoveOutput(ctx.ch)
+	server.unregisterConn(&ctx.connContext)
+	server.connsWG.Done()
 }
 
-func (server *Server) handleTCP() {
+// handleTCP accepts connections until the listener fails, or is closed on
+// stop, which is not an error.
+func (server *Server) handleTCP() error {
 	for {
 		conn, err := server.tcpListener.AcceptTCP()
 		if err != nil {
-			log.Fatalln("error accepting tcp connection:", err)
+			if server.ctx.Err() != nil {
+				return nil
+			}
+			return err
 		}
 		log.Println("new tcp connection from", conn.RemoteAddr().String())
 		server.newTCPConnContext(conn)
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"log"
 	"net"
 
@@ -10,45 +11,43 @@ import (
 	"github.com/chenx-dust/paracat/transport"
 )
 
-func (server *Server) handleForward(ch <-chan buffer.WithBufferArg[[]*packet.Packet]) {
-	for packets_ := range ch {
+func (server *Server) handleForward(s *session) {
+	ch := s.gatherer.GetOutChan()
+	for {
+		var packets_ buffer.WithBufferArg[[]*packet.Packet]
+		select {
+		case <-s.ctx.Done():
+			return
+		case packets_ = <-ch:
+		}
 		packets := packets_.ToOwned()
-		connPacketsMap := make(map[uint16][][]byte)
+		connPacketsMap := make(map[uint32][][]byte)
 		for _, newPacket := range packets.Thing {
-			_, ok := server.forwardConns[newPacket.ConnID]
+			s.forwardMutex.Lock()
+			_, ok := s.forwardConns[newPacket.ConnID]
+			if !ok && s.ctx.Err() != nil {
+				// closed session
+				s.forwardMutex.Unlock()
+				continue
+			}
 			if !ok {
-				conn, err := net.ListenUDP("udp", nil)
+				fc, err := server.newForwardConn(newPacket.ServiceID)
 				if err != nil {
-					log.Println("error dialing relay:", err)
+					s.forwardMutex.Unlock()
+					log.Println("error dialing service:", err)
 					continue
 				}
-				log.Println("new forward conn:", conn.LocalAddr())
-				if server.cfg.EnableGRO {
-					transport.EnableGRO(conn)
-				}
-				if server.cfg.EnableGSO {
-					transport.EnableGSO(conn)
-				}
-				server.forwardConns[newPacket.ConnID] = conn
-				go server.handleReverse(conn, newPacket.ConnID)
+				s.forwardConns[newPacket.ConnID] = fc
+				go server.handleReverse(s, fc, newPacket.ConnID)
 			}
+			s.forwardMutex.Unlock()
 			connPacketsMap[newPacket.ConnID] = append(connPacketsMap[newPacket.ConnID], newPacket.Buffer)
 		}
-		remoteAddr, err := net.ResolveUDPAddr("udp", server.cfg.RemoteAddr)
-		if err != nil {
-			log.Fatalln("error resolving remote addr:", err)
-		}
 		for connID, packets := range connPacketsMap {
-			pBuffer := buffer.NewPackedBuffer()
-			nowPtr := 0
-			for _, packet := range packets {
-				pBuffer.Ptr.SubPackets = append(pBuffer.Ptr.SubPackets, len(packet))
-				copy(pBuffer.Ptr.Buffer[nowPtr:], packet)
-				nowPtr += len(packet)
-			}
-			pBuffer.Ptr.TotalSize = nowPtr
-			err := transport.SendUDPPackets(server.forwardConns[connID], remoteAddr, pBuffer.BorrowArg(), server.cfg.EnableGSO)
-			pBuffer.Release()
+			s.forwardMutex.Lock()
+			fc := s.forwardConns[connID]
+			s.forwardMutex.Unlock()
+			err := transport.SendUDPPayloads(fc.conn, fc.remoteAddr, packets, server.cfg.Load().EnableGSO)
 			if err != nil {
 				log.Println("error writing to udp:", err)
 			}
@@ -57,45 +56,92 @@ func (server *Server) handleForward(ch <-chan buffer.WithBufferArg[[]*packet.Pac
 	}
 }
 
-func (server *Server) handleReverse(conn *net.UDPConn, connID uint16) {
-	remoteAddr, err := net.ResolveUDPAddr("udp", server.cfg.RemoteAddr)
+func (server *Server) newForwardConn(serviceID uint16) (*forwardConn, error) {
+	svc, ok := server.services[serviceID]
+	if !ok {
+		return nil, fmt.Errorf("unknown service: %d", serviceID)
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp", svc.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
 	if err != nil {
-		log.Fatalln("error resolving remote addr:", err)
+		return nil, err
 	}
+	log.Println("new forward conn:", conn.LocalAddr())
+	if server.cfg.Load().EnableGRO {
+		transport.EnableGRO(conn)
+	}
+	if server.cfg.Load().EnableGSO {
+		transport.EnableGSO(conn)
+	}
+	return &forwardConn{
+		conn:       conn,
+		remoteAddr: remoteAddr,
+		serviceID:  serviceID,
+	}, nil
+}
+
+func (server *Server) handleReverse(s *session, fc *forwardConn, connID uint32) {
 	for {
-		rawPackets, addr, err := transport.ReceiveUDPRawPackets(conn)
+		rawPackets, addr, err := transport.ReceiveUDPRawPackets(fc.conn)
 		if err != nil {
-			log.Println("error receiving udp packets:", err)
 			rawPackets.Release()
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+			}
+			log.Println("error receiving udp packets:", err)
 			continue
 		}
-		if addr.String() != remoteAddr.String() {
-			log.Println("error receiving udp packets: addr mismatch", addr, remoteAddr)
+		if addr.String() != fc.remoteAddr.String() {
+			log.Println("error receiving udp packets: addr mismatch", addr, fc.remoteAddr)
 			rawPackets.Release()
 			continue
 		}
-		if rawPackets.Ptr.SubPackets[0] > int(server.cfg.MaxUDPSize) {
-			// log.Println("error receiving udp packets: packet size too large", rawPackets.Ptr.SubPackets[0], ">", server.cfg.MaxUDPSize)
+		overhead := server.cipher.Overhead()
+		if rawPackets.Ptr.SubPackets[0] > min(int(server.cfg.Load().MaxUDPSize), buffer.BUFFER_SIZE-overhead) {
+			// log.Println("error receiving udp packets: packet size too large", rawPackets.Ptr.SubPackets[0], ">", server.cfg.Load().MaxUDPSize)
 			rawPackets.Release()
 			continue
 		}
 
 		packets := buffer.NewPackedBuffer()
+		fecPackets := make([]*packet.Packet, 0, len(rawPackets.Ptr.SubPackets))
 		nowPtr := 0
 		for _, slice := range rawPackets.Ptr.SubPackets {
-			packetID := channel.NewPacketID(&server.idIncrement)
+			if packets.Ptr.TotalSize+slice+overhead > buffer.BUFFER_SIZE {
+				// packed packets are larger, so a full read takes more buffers
+				s.scatterer.Scatter(packets.MoveArg())
+				packets = buffer.NewPackedBuffer()
+			}
+			packetID := channel.NewPacketID(&s.idIncrement)
 			newPacket := &packet.Packet{
-				Buffer:   rawPackets.Ptr.Buffer[nowPtr : nowPtr+slice],
-				ConnID:   connID,
-				PacketID: packetID,
+				Buffer:    rawPackets.Ptr.Buffer[nowPtr : nowPtr+slice],
+				SessionID: s.id,
+				ServiceID: fc.serviceID,
+				ConnID:    connID,
+				PacketID:  packetID,
+				Version:   s.version,
 			}
-			size := newPacket.Pack(packets.Ptr.Buffer[packets.Ptr.TotalSize:])
+			if s.sequenced {
+				newPacket.Flags |= packet.SequencedFlag
+				newPacket.ConnSeq = fc.seq
+				fc.seq++
+			}
+			size := server.cipher.Pack(newPacket, packets.Ptr.Buffer[packets.Ptr.TotalSize:])
 			packets.Ptr.SubPackets = append(packets.Ptr.SubPackets, size)
 			packets.Ptr.TotalSize += size
+			fecPackets = append(fecPackets, newPacket)
 
 			nowPtr += slice
 		}
+		s.scatterer.Scatter(packets.MoveArg())
+		if s.encoder != nil {
+			s.encoder.Encode(fecPackets)
+		}
 		rawPackets.Release()
-		server.scatterer.Scatter(packets.MoveArg())
 	}
 }
@@ -1,47 +1,33 @@
 package server
 
 import (
-	"context"
 	"log"
 	"net"
 	"time"
 
-	"github.com/chenx-dust/paracat/buffer"
 	"github.com/chenx-dust/paracat/transport"
 )
 
 type udpConnContext struct {
-	ctx    context.Context
-	cancel context.CancelFunc
-	addr   *net.UDPAddr
-	timer  *time.Timer
-	conn   *net.UDPConn
-	ch     chan buffer.ArgPtr[*buffer.PackedBuffer]
-}
-
-func (ctx *udpConnContext) Done() <-chan struct{} {
-	return ctx.ctx.Done()
-}
-
-func (ctx *udpConnContext) Cancel() {
-	ctx.cancel()
+	connContext
+	addr  *net.UDPAddr
+	timer *time.Timer
+	conn  *net.UDPConn
 }
 
 func (server *Server) newUDPConnContext(addr *net.UDPAddr) *udpConnContext {
-	ctx, cancel := context.WithCancel(context.Background())
 	newCtx := &udpConnContext{
-		ctx:    ctx,
-		cancel: cancel,
-		addr:   addr,
-		timer:  time.NewTimer(server.cfg.UDPTimeout),
-		conn:   server.udpListener,
-		ch:     make(chan buffer.ArgPtr[*buffer.PackedBuffer], server.cfg.ChannelSize),
+		addr:  addr,
+		timer: time.NewTimer(server.cfg.Load().UDPTimeout),
+		conn:  server.udpListener,
 	}
-	server.scatterer.NewOutput(newCtx.ch)
-	newCtx.conn = server.udpListener
+	server.initConnContext(&newCtx.connContext, "udp://"+addr.String())
 	go server.handleUDPConnContextCancel(newCtx)
 	go server.handleUDPConnTimeout(newCtx)
-	go transport.SendUDPLoop(newCtx, newCtx.conn, newCtx.addr, newCtx.ch, server.cfg.EnableGSO)
+	go transport.SendUDPLoop(newCtx, newCtx.conn, newCtx.addr, newCtx.ch, newCtx.congestion, newCtx.limiter, newCtx.sent, server.cfg.Load().EnableGSO)
+	go transport.HeartbeatLoop(newCtx, newCtx.heartbeat, newCtx.sender)
+	go transport.ProbeLoop(newCtx, newCtx.prober, newCtx.sender)
+	go transport.FeedbackLoop(newCtx, newCtx.congestion, newCtx.sender)
 	server.sourceMutex.Lock()
 	server.sourceUDPAddrs[addr.String()] = newCtx
 	server.sourceMutex.Unlock()
@@ -52,35 +38,51 @@ func (server *Server) handleUDPConnContextCancel(ctx *udpConnContext) {
 	<-ctx.ctx.Done()
 	log.Println("closing udp connection:", ctx.addr.String())
 	ctx.timer.Stop()
-	server.scatterer.RemoveOutput(ctx.ch)
+	server.unregisterConn(&ctx.connContext)
 	server.sourceMutex.Lock()
 	delete(server.sourceUDPAddrs, ctx.addr.String())
 	server.sourceMutex.Unlock()
+	server.connsWG.Done()
 }
 
 func (server *Server) handleUDPListener() {
 	for {
-		packets, udpAddr, err := transport.ReceiveUDPPackets(server.udpListener)
+		packets, udpAddr, err := transport.ReceiveUDPPackets(server.udpListener, server.cipher)
 		if err != nil {
+			packets.Release()
+			if server.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		if len(packets.Thing) == 0 {
+			// nothing valid, e.g. forged packets, do not track the source
 			packets.Release()
 			continue
 		}
 
-		server.handleUDPAddr(udpAddr)
-		server.gatherer.Forward(packets.MoveArg())
+		ctx, ok := server.lookupUDPAddr(udpAddr)
+		if !ok {
+			if server.authenticator != nil {
+				server.handleUDPHandshake(udpAddr, packets.MoveArg())
+				continue
+			}
+			log.Println("new udp connection from", udpAddr.String())
+			ctx = server.newUDPConnContext(udpAddr)
+			server.registerConn(&ctx.connContext)
+		}
+		server.handlePackets(&ctx.connContext, packets.MoveArg())
 	}
 }
 
-func (server *Server) handleUDPAddr(addr *net.UDPAddr) {
+func (server *Server) lookupUDPAddr(addr *net.UDPAddr) (*udpConnContext, bool) {
 	server.sourceMutex.RLock()
 	ctx, ok := server.sourceUDPAddrs[addr.String()]
 	server.sourceMutex.RUnlock()
 	if ok {
-		ctx.timer.Reset(server.cfg.UDPTimeout)
-	} else {
-		log.Println("new udp connection from", addr.String())
-		server.newUDPConnContext(addr)
+		ctx.timer.Reset(server.cfg.Load().UDPTimeout)
 	}
+	return ctx, ok
 }
 
 func (server *Server) handleUDPConnTimeout(ctx *udpConnContext) {
@@ -65,6 +65,8 @@ var packedBufferPool = sync.Pool{
 	},
 }
 
+// ActiveBuffers is the number of buffers taken from the pool and not
+// released yet.
 var ActiveBuffers atomic.Int64
 
 // var BufferTraceBack = struct {
@@ -80,6 +82,7 @@ func NewPackedBuffer() OwnedPtr[*PackedBuffer] {
 	buffer.SubPackets = make([]int, 0)
 	buffer.TotalSize = 0
 	buffer.RefCnt.Store(1)
+	ActiveBuffers.Add(1)
 	// buffer.TraceBack = string(debug.Stack())
 	// BufferTraceBack.Lock()
 	// BufferTraceBack.TraceBack[buffer.TraceBack]++
@@ -99,6 +102,7 @@ func (p *PackedBuffer) Release() {
 	if refCnt == 0 {
 		// it's safe because refCnt is atomic
 		packedBufferPool.Put(p)
+		ActiveBuffers.Add(-1)
 		// BufferTraceBack.Lock()
 		// BufferTraceBack.TraceBack[p.TraceBack]--
 		// BufferTraceBack.Unlock()
@@ -108,3 +112,30 @@ func (p *PackedBuffer) Release() {
 		log.Println("buffer reference count is negative:", refCnt)
 	}
 }
+
+// Drain releases the buffers left in ch, without waiting for more.
+func Drain(ch <-chan ArgPtr[*PackedBuffer]) {
+	for {
+		select {
+		case p := <-ch:
+			owned := p.ToOwned()
+			owned.Release()
+		default:
+			return
+		}
+	}
+}
+
+// DrainWith releases the buffers of things left in ch, without waiting for
+// more.
+func DrainWith[T any](ch <-chan WithBufferArg[T]) {
+	for {
+		select {
+		case wb := <-ch:
+			owned := wb.ToOwned()
+			owned.Release()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package channel_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/channel"
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+// Run with -cpu to see the scaling across GOMAXPROCS, e.g.
+//
+//	go test ./channel -run ^$ -bench . -cpu 1,2,4,8,16
+
+// batchSize is the number of packets a receiver gets at once.
+const batchSize = 16
+
+// nextBatch takes the ids of a batch, each repeated by copies as if it came
+// from that many paths.
+func nextBatch(idIncrement *atomic.Uint32, copies uint32) uint32 {
+	return (idIncrement.Add(batchSize) - batchSize) / copies
+}
+
+func benchmarkPacketFilter(b *testing.B, copies uint32) {
+	pf := channel.NewPacketFilter(time.Second, 1<<20)
+	var idIncrement atomic.Uint32
+	b.RunParallel(func(pb *testing.PB) {
+		for {
+			first := nextBatch(&idIncrement, copies)
+			now := time.Now()
+			for i := uint32(0); i < batchSize; i++ {
+				if !pb.Next() {
+					return
+				}
+				pf.Filter(first+i/copies, now)
+			}
+		}
+	})
+}
+
+// BenchmarkPacketFilter filters new packet ids from concurrent receivers.
+func BenchmarkPacketFilter(b *testing.B) {
+	benchmarkPacketFilter(b, 1)
+}
+
+// BenchmarkPacketFilterDuplicate filters every packet id twice, as it comes
+// from two paths.
+func BenchmarkPacketFilterDuplicate(b *testing.B) {
+	benchmarkPacketFilter(b, 2)
+}
+
+// BenchmarkGathererForward forwards batches of packets from concurrent
+// receivers, with half of them duplicated.
+func BenchmarkGathererForward(b *testing.B) {
+	ch := channel.NewGatherer(1024, config.OverflowPolicy{}, time.Second, 1<<20, 0)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case packets_ := <-ch.GetOutChan():
+				packets := packets_.ToOwned()
+				packets.Release()
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	var idIncrement atomic.Uint32
+	payload := make([]byte, 1200)
+	b.SetBytes(batchSize * int64(len(payload)))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			first := nextBatch(&idIncrement, 2)
+			packets := make([]*packet.Packet, batchSize)
+			for i := range packets {
+				packets[i] = &packet.Packet{
+					Buffer:   payload,
+					PacketID: first + uint32(i)/2,
+				}
+			}
+			data := buffer.WithBuffer[[]*packet.Packet]{
+				Thing:  packets,
+				Buffer: buffer.NewPackedBuffer(),
+			}
+			ch.Forward(data.MoveArg())
+		}
+	})
+}
@@ -0,0 +1,8 @@
+package channel
+
+// SetGroupID sets the id of the next group, e.g. to see it wrap around.
+func (e *FECEncoder) SetGroupID(id uint32) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.groupID = id
+}
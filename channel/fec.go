@@ -0,0 +1,375 @@
+/* FEC encoder and decoder protecting data packets with parity shards. */
+package channel
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/fec"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+const (
+	// fecFlushDelay bounds how long an incomplete group waits for more
+	// packets before its parity is sent anyway.
+	fecFlushDelay = 5 * time.Millisecond
+	// fecWindow is the number of recent data packets kept for reconstruction.
+	fecWindow = 4096
+	// fecMaxGroups is the number of groups waiting for their shards.
+	fecMaxGroups    = 256
+	shardHeaderSize = 8
+)
+
+// a shard is the data packet with its service id, conn id and length, and
+// its conn seq if the group is sequenced, zero padded
+func appendShard(shard []byte, sequenced bool, serviceID uint16, connID uint32, connSeq uint32, payload []byte) []byte {
+	shard = append(shard,
+		byte(serviceID), byte(serviceID>>8),
+		byte(connID), byte(connID>>8), byte(connID>>16), byte(connID>>24),
+		byte(len(payload)), byte(len(payload)>>8))
+	if sequenced {
+		shard = append(shard, byte(connSeq), byte(connSeq>>8), byte(connSeq>>16), byte(connSeq>>24))
+	}
+	return append(shard, payload...)
+}
+
+func parseShard(shard []byte, sequenced bool) (serviceID uint16, connID uint32, connSeq uint32, payload []byte, ok bool) {
+	headerSize := shardHeaderSize
+	if sequenced {
+		headerSize += packet.SEQUENCE_SIZE
+	}
+	if len(shard) < headerSize {
+		return
+	}
+	serviceID = uint16(shard[0]) | uint16(shard[1])<<8
+	connID = uint32(shard[2]) | uint32(shard[3])<<8 | uint32(shard[4])<<16 | uint32(shard[5])<<24
+	length := int(shard[6]) | int(shard[7])<<8
+	if sequenced {
+		connSeq = uint32(shard[8]) | uint32(shard[9])<<8 | uint32(shard[10])<<16 | uint32(shard[11])<<24
+	}
+	if length > len(shard)-headerSize {
+		return
+	}
+	return serviceID, connID, connSeq, shard[headerSize : headerSize+length], true
+}
+
+type FECEncoder struct {
+	dataShards   int
+	parityShards int
+	sessionID    uint32
+	cipher       *packet.Cipher
+	output       func(buffer.ArgPtr[*buffer.PackedBuffer])
+
+	mutex     sync.Mutex
+	groupID   uint32
+	shards    [][]byte
+	packetIDs []uint32
+	sequenced bool // the packets of the group are sequenced
+	timer     *time.Timer
+}
+
+// NewFECEncoder creates an encoder which sends parity packets to output,
+// usually Scatterer.Scatter, after every dataShards data packets.
+func NewFECEncoder(dataShards int, parityShards int, sessionID uint32, cipher *packet.Cipher, output func(buffer.ArgPtr[*buffer.PackedBuffer])) *FECEncoder {
+	log.Println("new fec encoder with", dataShards, "data shards and", parityShards, "parity shards")
+	return &FECEncoder{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		sessionID:    sessionID,
+		cipher:       cipher,
+		output:       output,
+		shards:       make([][]byte, dataShards),
+		packetIDs:    make([]uint32, 0, dataShards),
+	}
+}
+
+// Encode adds data packets to the current group. Packets are copied, so
+// they can be released after return.
+func (e *FECEncoder) Encode(packets []*packet.Packet) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, p := range packets {
+		sequenced := p.Flags&packet.SequencedFlag != 0
+		if len(e.packetIDs) > 0 && sequenced != e.sequenced {
+			e.flushLocked()
+		}
+		e.sequenced = sequenced
+		idx := len(e.packetIDs)
+		e.shards[idx] = appendShard(e.shards[idx][:0], sequenced, p.ServiceID, p.ConnID, p.ConnSeq, p.Buffer)
+		e.packetIDs = append(e.packetIDs, p.PacketID)
+		if len(e.packetIDs) == e.dataShards {
+			e.flushLocked()
+		}
+	}
+	if len(e.packetIDs) > 0 && e.timer == nil {
+		e.timer = time.AfterFunc(fecFlushDelay, e.flush)
+	}
+}
+
+func (e *FECEncoder) flush() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.timer = nil
+	if len(e.packetIDs) > 0 {
+		e.flushLocked()
+	}
+}
+
+func (e *FECEncoder) flushLocked() {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	data := e.shards[:len(e.packetIDs)]
+	shardSize := 0
+	for _, shard := range data {
+		shardSize = max(shardSize, len(shard))
+	}
+	for i, shard := range data {
+		for len(shard) < shardSize {
+			shard = append(shard, 0)
+		}
+		data[i] = shard
+	}
+	parity := make([][]byte, e.parityShards)
+	for i := range parity {
+		parity[i] = make([]byte, shardSize)
+	}
+	if err := fec.Encode(data, parity); err != nil {
+		log.Println("error encoding fec:", err)
+		return
+	}
+
+	pBuffer := buffer.NewPackedBuffer()
+	for i, shard := range parity {
+		newPacket := packet.NewParityPacket(packet.Parity{
+			GroupID:   e.groupID,
+			Index:     uint8(i),
+			PacketIDs: e.packetIDs,
+			Shard:     shard,
+		})
+		newPacket.SessionID = e.sessionID
+		if e.sequenced {
+			newPacket.Flags |= packet.SequencedFlag
+		}
+		if pBuffer.Ptr.TotalSize+len(newPacket.Buffer)+e.cipher.Overhead() > buffer.BUFFER_SIZE {
+			// large shards take more buffers
+			e.output(pBuffer.MoveArg())
+			pBuffer = buffer.NewPackedBuffer()
+		}
+		size := e.cipher.Pack(newPacket, pBuffer.Ptr.Buffer[pBuffer.Ptr.TotalSize:])
+		pBuffer.Ptr.SubPackets = append(pBuffer.Ptr.SubPackets, size)
+		pBuffer.Ptr.TotalSize += size
+	}
+	e.groupID++
+	e.packetIDs = e.packetIDs[:0]
+	e.output(pBuffer.MoveArg())
+}
+
+type fecEntry struct {
+	valid     bool
+	packetID  uint32
+	serviceID uint16
+	connID    uint32
+	connSeq   uint32
+	payload   []byte
+}
+
+type fecGroup struct {
+	id        uint32
+	packetIDs []uint32
+	shardSize int
+	sequenced bool
+	parity    [][]byte
+	done      bool
+}
+
+// FECDecoder keeps recent data packets and parity shards, and reconstructs
+// lost data packets once a group has enough of them. It stays inactive until
+// the first parity packet arrives, so that peers without FEC cost nothing.
+type FECDecoder struct {
+	mutex      sync.Mutex
+	active     atomic.Bool // read before locking, so that data packets skip the lock while inactive
+	entries    [fecWindow]fecEntry
+	groups     map[uint32]*fecGroup
+	groupOrder []uint32
+	pendingIDs map[uint32]uint32
+}
+
+func NewFECDecoder() *FECDecoder {
+	return &FECDecoder{
+		groups:     make(map[uint32]*fecGroup),
+		groupOrder: make([]uint32, 0, fecMaxGroups),
+		pendingIDs: make(map[uint32]uint32),
+	}
+}
+
+// AddData records a data packet, returning packets recovered with its help.
+func (d *FECDecoder) AddData(p *packet.Packet) []*packet.Packet {
+	if !d.active.Load() {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.store(p)
+	groupID, ok := d.pendingIDs[p.PacketID]
+	if !ok {
+		return nil
+	}
+	return d.tryRecover(d.groups[groupID])
+}
+
+// AddParity records a parity packet, returning recovered packets.
+func (d *FECDecoder) AddParity(p *packet.Packet) []*packet.Packet {
+	parity, err := packet.ParseParity(p)
+	if err != nil {
+		log.Println("error parsing parity:", err)
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.active.Store(true)
+	group, ok := d.groups[parity.GroupID]
+	sequenced := p.Flags&packet.SequencedFlag != 0
+	if ok && (group.shardSize != len(parity.Shard) || !slices.Equal(group.packetIDs, parity.PacketIDs) || group.sequenced != sequenced) {
+		// group id wrapped around, or the encoder restarted
+		d.removeGroup(group)
+		ok = false
+	}
+	if !ok {
+		group = d.newGroup(parity, sequenced)
+	}
+	if group.done {
+		return nil
+	}
+	for int(parity.Index) >= len(group.parity) {
+		group.parity = append(group.parity, nil)
+	}
+	if group.parity[parity.Index] == nil {
+		group.parity[parity.Index] = append([]byte(nil), parity.Shard...)
+	}
+	return d.tryRecover(group)
+}
+
+func (d *FECDecoder) store(p *packet.Packet) {
+	entry := &d.entries[p.PacketID%fecWindow]
+	entry.valid = true
+	entry.packetID = p.PacketID
+	entry.serviceID = p.ServiceID
+	entry.connID = p.ConnID
+	entry.connSeq = p.ConnSeq
+	entry.payload = append(entry.payload[:0], p.Buffer...)
+}
+
+func (d *FECDecoder) newGroup(parity packet.Parity, sequenced bool) *fecGroup {
+	if len(d.groupOrder) >= fecMaxGroups {
+		if oldest, ok := d.groups[d.groupOrder[0]]; ok {
+			d.removeGroup(oldest)
+		} else {
+			d.groupOrder = d.groupOrder[1:]
+		}
+	}
+	group := &fecGroup{
+		id:        parity.GroupID,
+		packetIDs: parity.PacketIDs,
+		shardSize: len(parity.Shard),
+		sequenced: sequenced,
+	}
+	d.groups[group.id] = group
+	d.groupOrder = append(d.groupOrder, group.id)
+	for _, id := range group.packetIDs {
+		d.pendingIDs[id] = group.id
+	}
+	return group
+}
+
+func (d *FECDecoder) removeGroup(group *fecGroup) {
+	delete(d.groups, group.id)
+	for i, id := range d.groupOrder {
+		if id == group.id {
+			d.groupOrder = append(d.groupOrder[:i], d.groupOrder[i+1:]...)
+			break
+		}
+	}
+	d.finishGroup(group)
+}
+
+func (d *FECDecoder) finishGroup(group *fecGroup) {
+	group.done = true
+	group.parity = nil
+	for _, id := range group.packetIDs {
+		if d.pendingIDs[id] == group.id {
+			delete(d.pendingIDs, id)
+		}
+	}
+}
+
+func (d *FECDecoder) tryRecover(group *fecGroup) []*packet.Packet {
+	if group == nil || group.done {
+		return nil
+	}
+	data := make([][]byte, len(group.packetIDs))
+	missing := 0
+	for j, id := range group.packetIDs {
+		entry := &d.entries[id%fecWindow]
+		if !entry.valid || entry.packetID != id {
+			missing++
+			continue
+		}
+		shard := make([]byte, 0, group.shardSize)
+		shard = appendShard(shard, group.sequenced, entry.serviceID, entry.connID, entry.connSeq, entry.payload)
+		if len(shard) > group.shardSize {
+			log.Println("error recovering fec: shard larger than group")
+			d.finishGroup(group)
+			return nil
+		}
+		data[j] = shard[:group.shardSize]
+	}
+	if missing == 0 {
+		d.finishGroup(group)
+		return nil
+	}
+	received := 0
+	for _, shard := range group.parity {
+		if shard != nil {
+			received++
+		}
+	}
+	if received < missing {
+		return nil
+	}
+	if err := fec.Reconstruct(data, group.parity, group.shardSize); err != nil {
+		log.Println("error recovering fec:", err)
+		d.finishGroup(group)
+		return nil
+	}
+	recovered := make([]*packet.Packet, 0, missing)
+	for j, id := range group.packetIDs {
+		entry := &d.entries[id%fecWindow]
+		if entry.valid && entry.packetID == id {
+			continue
+		}
+		serviceID, connID, connSeq, payload, ok := parseShard(data[j], group.sequenced)
+		if !ok {
+			continue
+		}
+		recoveredPacket := &packet.Packet{
+			Buffer:    payload,
+			ServiceID: serviceID,
+			ConnID:    connID,
+			PacketID:  id,
+			ConnSeq:   connSeq,
+		}
+		if group.sequenced {
+			recoveredPacket.Flags |= packet.SequencedFlag
+		}
+		d.store(recoveredPacket)
+		recovered = append(recovered, recoveredPacket)
+	}
+	d.finishGroup(group)
+	return recovered
+}
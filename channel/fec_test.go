@@ -0,0 +1,304 @@
+package channel_test
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/channel"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+const (
+	dataShards   = 4
+	parityShards = 2
+)
+
+// parityCollector unpacks the parity packets an encoder outputs.
+type parityCollector struct {
+	mutex  sync.Mutex
+	groups [][]*packet.Packet
+}
+
+func (c *parityCollector) output(pBuffer_ buffer.ArgPtr[*buffer.PackedBuffer]) {
+	pBuffer := pBuffer_.ToOwned()
+	defer pBuffer.Release()
+	var group []*packet.Packet
+	ptr := 0
+	for _, size := range pBuffer.Ptr.SubPackets {
+		raw := append([]byte(nil), pBuffer.Ptr.Buffer[ptr:ptr+size]...)
+		ptr += size
+		p, _, err := packet.Unpack(raw)
+		if err != nil {
+			panic(err)
+		}
+		group = append(group, p)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.groups = append(c.groups, group)
+}
+
+func (c *parityCollector) take() [][]*packet.Packet {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	groups := c.groups
+	c.groups = nil
+	return groups
+}
+
+// dataPackets makes n data packets from packet id first, of different sizes
+// within a group but alike between groups.
+func dataPackets(first uint32, n int, sequenced bool) []*packet.Packet {
+	packets := make([]*packet.Packet, n)
+	for i := range packets {
+		id := first + uint32(i)
+		packets[i] = &packet.Packet{
+			Buffer:    bytes.Repeat([]byte{byte(id)}, 10+i*13),
+			ServiceID: uint16(id % 3),
+			ConnID:    id % 5,
+			PacketID:  id,
+		}
+		if sequenced {
+			packets[i].Flags |= packet.SequencedFlag
+			packets[i].ConnSeq = id * 3
+		}
+	}
+	return packets
+}
+
+// erasures calls f with every set of up to max of n packets, as a mask.
+func erasures(n int, max int, f func(lost []bool)) {
+	lost := make([]bool, n)
+	var walk func(from int, left int)
+	walk = func(from int, left int) {
+		f(lost)
+		if left == 0 {
+			return
+		}
+		for i := from; i < n; i++ {
+			lost[i] = true
+			walk(i+1, left-1)
+			lost[i] = false
+		}
+	}
+	walk(0, max)
+}
+
+// newActiveDecoder makes a decoder which has seen parity already, as
+// decoders ignore data packets before.
+func newActiveDecoder(t *testing.T) *channel.FECDecoder {
+	t.Helper()
+	var parity parityCollector
+	e := channel.NewFECEncoder(1, 1, 0, nil, parity.output)
+	e.Encode(dataPackets(1<<31, 1, false))
+	d := channel.NewFECDecoder()
+	for _, group := range parity.take() {
+		for _, p := range group {
+			d.AddParity(p)
+		}
+	}
+	return d
+}
+
+// checkRecovered checks that the lost packets of data are recovered, and
+// that what is recovered is correct. Packets not lost may be recovered too,
+// before they arrive.
+func checkRecovered(t *testing.T, recovered []*packet.Packet, data []*packet.Packet, lost []*packet.Packet) {
+	t.Helper()
+	for _, got := range recovered {
+		i := slices.IndexFunc(data, func(p *packet.Packet) bool { return p.PacketID == got.PacketID })
+		if i == -1 {
+			t.Errorf("packet %d recovered, not in group", got.PacketID)
+			continue
+		}
+		want := data[i]
+		if !bytes.Equal(got.Buffer, want.Buffer) || got.ServiceID != want.ServiceID || got.ConnID != want.ConnID ||
+			got.ConnSeq != want.ConnSeq || got.Flags&packet.SequencedFlag != want.Flags&packet.SequencedFlag {
+			t.Errorf("packet %d recovered as %+v, want %+v", want.PacketID, got, want)
+		}
+	}
+	for _, want := range lost {
+		if !slices.ContainsFunc(recovered, func(p *packet.Packet) bool { return p.PacketID == want.PacketID }) {
+			t.Errorf("packet %d not recovered", want.PacketID)
+		}
+	}
+}
+
+// deliver passes the packets not lost to d, parity first if parityFirst,
+// and returns the recovered ones.
+func deliver(d *channel.FECDecoder, data []*packet.Packet, parity []*packet.Packet, lost map[int]bool, parityFirst bool) []*packet.Packet {
+	var recovered []*packet.Packet
+	addData := func() {
+		for j, p := range data {
+			if !lost[j] {
+				recovered = append(recovered, d.AddData(p)...)
+			}
+		}
+	}
+	if !parityFirst {
+		addData()
+	}
+	for i, p := range parity {
+		if !lost[len(data)+i] {
+			recovered = append(recovered, d.AddParity(p)...)
+		}
+	}
+	if parityFirst {
+		addData()
+	}
+	return recovered
+}
+
+// TestFECRecover recovers lost data packets from every pattern of up to
+// parityShards losses among data and parity packets.
+func TestFECRecover(t *testing.T) {
+	for _, sequenced := range []bool{false, true} {
+		for _, parityFirst := range []bool{false, true} {
+			t.Run(fmt.Sprintf("sequenced=%v,parity first=%v", sequenced, parityFirst), func(t *testing.T) {
+				var parity parityCollector
+				e := channel.NewFECEncoder(dataShards, parityShards, 0, nil, parity.output)
+				d := newActiveDecoder(t)
+				first := uint32(0)
+				erasures(dataShards+parityShards, parityShards, func(mask []bool) {
+					data := dataPackets(first, dataShards, sequenced)
+					first += dataShards
+					e.Encode(data)
+					groups := parity.take()
+					if len(groups) != 1 || len(groups[0]) != parityShards {
+						t.Fatalf("got %d groups, want 1 group of %d parity packets", len(groups), parityShards)
+					}
+					lost := make(map[int]bool)
+					var lostData []*packet.Packet
+					for i, l := range mask {
+						if l {
+							lost[i] = true
+							if i < dataShards {
+								lostData = append(lostData, data[i])
+							}
+						}
+					}
+					checkRecovered(t, deliver(d, data, groups[0], lost, parityFirst), data, lostData)
+				})
+			})
+		}
+	}
+}
+
+// TestFECTooManyLost recovers nothing, rather than anything corrupt, when
+// more data packets are lost than parity packets arrive.
+func TestFECTooManyLost(t *testing.T) {
+	for _, lost := range []map[int]bool{
+		{0: true, 1: true, 2: true},
+		{0: true, 3: true, dataShards: true},
+		{0: true, 1: true, 2: true, 3: true},
+	} {
+		var parity parityCollector
+		e := channel.NewFECEncoder(dataShards, parityShards, 0, nil, parity.output)
+		d := newActiveDecoder(t)
+		data := dataPackets(0, dataShards, false)
+		e.Encode(data)
+		if recovered := deliver(d, data, parity.take()[0], lost, false); len(recovered) != 0 {
+			t.Errorf("lost %v, recovered %d packets", lost, len(recovered))
+		}
+	}
+}
+
+// TestFECShortGroup sends the parity of a group not filled up after a
+// while, which protects the packets it has.
+func TestFECShortGroup(t *testing.T) {
+	var parity parityCollector
+	e := channel.NewFECEncoder(dataShards, parityShards, 0, nil, parity.output)
+	d := newActiveDecoder(t)
+	data := dataPackets(0, dataShards-1, false)
+	e.Encode(data)
+	if groups := parity.take(); len(groups) != 0 {
+		t.Fatalf("short group flushed at once")
+	}
+	time.Sleep(50 * time.Millisecond)
+	groups := parity.take()
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups, want 1", len(groups))
+	}
+	lost := map[int]bool{0: true, 2: true}
+	checkRecovered(t, deliver(d, data, groups[0], lost, false), data, []*packet.Packet{data[0], data[2]})
+}
+
+// TestFECGroupIDReused recovers packets of groups with ids seen before, as
+// group ids wrap around and restart with the encoder.
+func TestFECGroupIDReused(t *testing.T) {
+	var parity parityCollector
+	e := channel.NewFECEncoder(dataShards, parityShards, 0, nil, parity.output)
+	e.SetGroupID(math.MaxUint32)
+	d := newActiveDecoder(t)
+	lost := map[int]bool{1: true}
+	first := uint32(0)
+	step := func(name string) {
+		t.Run(name, func(t *testing.T) {
+			data := dataPackets(first, dataShards, false)
+			first += dataShards
+			e.Encode(data)
+			groups := parity.take()
+			if len(groups) != 1 {
+				t.Fatalf("got %d groups, want 1", len(groups))
+			}
+			checkRecovered(t, deliver(d, data, groups[0], lost, false), data, data[1:2])
+		})
+	}
+	step("last group id")
+	step("wrapped around")
+	e = channel.NewFECEncoder(dataShards, parityShards, 0, nil, parity.output)
+	step("encoder restarted")
+}
+
+// TestFECMixedSequence starts a new group when packets switch between
+// sequenced and not, as their shards differ.
+func TestFECMixedSequence(t *testing.T) {
+	var parity parityCollector
+	e := channel.NewFECEncoder(dataShards, parityShards, 0, nil, parity.output)
+	data := append(dataPackets(0, 2, false), dataPackets(2, dataShards, true)...)
+	e.Encode(data)
+	groups := parity.take()
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(groups))
+	}
+	if groups[0][0].Flags&packet.SequencedFlag != 0 || groups[1][0].Flags&packet.SequencedFlag == 0 {
+		t.Errorf("sequenced and unsequenced packets grouped together")
+	}
+	d := newActiveDecoder(t)
+	lost := map[int]bool{0: true}
+	checkRecovered(t, deliver(d, data[:2], groups[0], lost, false), data[:2], data[:1])
+	checkRecovered(t, deliver(d, data[2:], groups[1], lost, false), data[2:], data[2:3])
+}
+
+// TestFECLargeShards sends parity packets of large shards in as many
+// buffers as they take.
+func TestFECLargeShards(t *testing.T) {
+	const parityShards = 16
+	var parity parityCollector
+	e := channel.NewFECEncoder(dataShards, parityShards, 0, nil, parity.output)
+	d := newActiveDecoder(t)
+	data := dataPackets(0, dataShards, true)
+	for i, p := range data {
+		p.Buffer = bytes.Repeat([]byte{byte(i)}, 40000+i)
+	}
+	e.Encode(data)
+	groups := parity.take()
+	if len(groups) != parityShards {
+		t.Errorf("sent parity in %d buffers, want one per packet", len(groups))
+	}
+	var packets []*packet.Packet
+	for _, group := range groups {
+		packets = append(packets, group...)
+	}
+	if len(packets) != parityShards {
+		t.Fatalf("got %d parity packets, want %d", len(packets), parityShards)
+	}
+	lost := map[int]bool{0: true, 1: true, 2: true, 3: true}
+	checkRecovered(t, deliver(d, data, packets, lost, false), data, data)
+}
@@ -0,0 +1,131 @@
+package channel
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// filterShardBits is the number of low bits of packet ids choosing the
+	// shard of a PacketFilter. Packet ids are sequential, so packets coming
+	// at the same time from different paths seldom share a shard.
+	filterShardBits = 5
+	filterShards    = 1 << filterShardBits
+	// filterInitialSize is the number of entries a PacketFilter starts with.
+	filterInitialSize = 1024
+)
+
+type FilterResult int
+
+const (
+	FilterAccepted  FilterResult = iota
+	FilterDuplicate              // seen within the timeout
+	FilterLate                   // accepted, but its record is gone, so it may be a duplicate
+)
+
+type filterEntry struct {
+	id    uint32
+	valid bool
+	seen  time.Duration // since the start of the filter
+}
+
+type filterShard struct {
+	mutex   sync.Mutex
+	entries []filterEntry // power of two
+	highest uint32
+	started bool
+	_       [64]byte // keeps shards off each other's cache line
+}
+
+// PacketFilter remembers packet ids for a period of time. It is sharded by
+// packet id, so that receivers of different paths rarely wait for each
+// other. Entries are indexed by the remaining bits of ids, and the table of
+// a shard grows whenever an entry still in time would be overwritten, so
+// that duplicates are caught for the whole timeout whatever the packet
+// rate, up to maxSize entries in total.
+type PacketFilter struct {
+	timeout      time.Duration
+	maxShardSize int
+	start        time.Time
+	shards       [filterShards]filterShard
+}
+
+// NewPacketFilter creates a filter remembering packet ids for timeout,
+// with at most maxSize entries rounded up to a power of two.
+func NewPacketFilter(timeout time.Duration, maxSize int) *PacketFilter {
+	pf := &PacketFilter{
+		timeout:      timeout,
+		maxShardSize: max(maxSize/filterShards, 1),
+		start:        time.Now(),
+	}
+	size := filterInitialSize / filterShards
+	for size > pf.maxShardSize && size > 1 {
+		size >>= 1
+	}
+	for i := range pf.shards {
+		pf.shards[i].entries = make([]filterEntry, size)
+	}
+	return pf
+}
+
+func (s *filterShard) entry(id uint32) *filterEntry {
+	return &s.entries[(id>>filterShardBits)&uint32(len(s.entries)-1)]
+}
+
+// grow doubles the table. Entries keep distinct places, as they differ in
+// the low bits already.
+func (s *filterShard) grow(maxSize int) bool {
+	if len(s.entries) >= maxSize {
+		return false
+	}
+	entries := s.entries
+	s.entries = make([]filterEntry, len(entries)*2)
+	for _, e := range entries {
+		if e.valid {
+			*s.entry(e.id) = e
+		}
+	}
+	return true
+}
+
+// Filter tells if id is a duplicate at now, and marks it as seen otherwise.
+// Now is given by the caller so that a batch of packets reads the clock once.
+func (pf *PacketFilter) Filter(id uint32, now time.Time) FilterResult {
+	seen := now.Sub(pf.start)
+	s := &pf.shards[id&(filterShards-1)]
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.started || int32(id-s.highest) > 0 {
+		s.highest = id
+		s.started = true
+	}
+	for {
+		e := s.entry(id)
+		inTime := e.valid && seen-e.seen < pf.timeout
+		switch {
+		case e.valid && e.id == id:
+			if inTime {
+				return FilterDuplicate
+			}
+			e.seen = seen
+			return FilterLate
+		case inTime && s.grow(pf.maxShardSize):
+			continue
+		case inTime && int32(id-e.id) < 0:
+			// full and taken by a later id, cannot tell
+			return FilterLate
+		}
+		*e = filterEntry{id: id, valid: true, seen: seen}
+		return FilterAccepted
+	}
+}
+
+// ExtendLegacyPacketID extends a 16-bit packet id of the legacy header to
+// the 32-bit one closest to the latest seen id. The shard is chosen by the
+// low bits, which are known.
+func (pf *PacketFilter) ExtendLegacyPacketID(id uint16) uint32 {
+	s := &pf.shards[id&(filterShards-1)]
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.highest + uint32(int32(int16(id-uint16(s.highest))))
+}
@@ -0,0 +1,143 @@
+package channel_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/channel"
+)
+
+type filterStep struct {
+	id    uint32
+	after time.Duration // since the first step
+	want  channel.FilterResult
+}
+
+func runFilter(t *testing.T, pf *channel.PacketFilter, steps []filterStep) {
+	t.Helper()
+	start := time.Now()
+	for i, step := range steps {
+		if got := pf.Filter(step.id, start.Add(step.after)); got != step.want {
+			t.Errorf("step %d: id %d after %v got %v, want %v", i, step.id, step.after, got, step.want)
+		}
+	}
+}
+
+func TestPacketFilter(t *testing.T) {
+	const timeout = time.Second
+	// a shard holds 2 entries: ids 0, 32 and 64 share a shard, and 0 and 64
+	// share an entry in it
+	const small = 64
+	tests := []struct {
+		name    string
+		maxSize int
+		steps   []filterStep
+	}{
+		{
+			name:    "duplicate within timeout",
+			maxSize: 1 << 20,
+			steps: []filterStep{
+				{1, 0, channel.FilterAccepted},
+				{2, 0, channel.FilterAccepted},
+				{1, 500 * time.Millisecond, channel.FilterDuplicate},
+				{2, 999 * time.Millisecond, channel.FilterDuplicate},
+			},
+		},
+		{
+			name:    "expired",
+			maxSize: 1 << 20,
+			steps: []filterStep{
+				{1, 0, channel.FilterAccepted},
+				{1, 1500 * time.Millisecond, channel.FilterLate},
+				{1, 2 * time.Second, channel.FilterDuplicate}, // seen again
+			},
+		},
+		{
+			name:    "evicted by a later id",
+			maxSize: small,
+			steps: []filterStep{
+				{0, 0, channel.FilterAccepted},
+				{32, 0, channel.FilterAccepted},
+				{64, 0, channel.FilterAccepted},
+				{64, 0, channel.FilterDuplicate},
+				{0, 0, channel.FilterLate}, // cannot tell
+				{32, 0, channel.FilterDuplicate},
+			},
+		},
+		{
+			name:    "evicted out of time",
+			maxSize: small,
+			steps: []filterStep{
+				{0, 0, channel.FilterAccepted},
+				{64, 1500 * time.Millisecond, channel.FilterAccepted},
+				{0, 1500 * time.Millisecond, channel.FilterLate},
+			},
+		},
+		{
+			name:    "earlier id when full",
+			maxSize: small,
+			steps: []filterStep{
+				{64, 0, channel.FilterAccepted},
+				{0, 0, channel.FilterLate},
+			},
+		},
+		{
+			name:    "wraparound",
+			maxSize: 1 << 20,
+			steps: []filterStep{
+				{0xffffffe0, 0, channel.FilterAccepted},
+				{0, 0, channel.FilterAccepted},
+				{0xffffffe0, 0, channel.FilterDuplicate},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runFilter(t, channel.NewPacketFilter(timeout, tt.maxSize), tt.steps)
+		})
+	}
+}
+
+// TestPacketFilterGrow catches every duplicate within the timeout, however
+// many packets arrive meanwhile, up to the max size.
+func TestPacketFilterGrow(t *testing.T) {
+	const n = 100000
+	pf := channel.NewPacketFilter(time.Second, 1<<20)
+	now := time.Now()
+	for id := uint32(0); id < n; id++ {
+		if got := pf.Filter(id, now); got != channel.FilterAccepted {
+			t.Fatalf("id %d got %v on first arrival", id, got)
+		}
+	}
+	for id := uint32(0); id < n; id++ {
+		if got := pf.Filter(id, now); got != channel.FilterDuplicate {
+			t.Fatalf("id %d got %v on second arrival", id, got)
+		}
+	}
+}
+
+func TestExtendLegacyPacketID(t *testing.T) {
+	tests := []struct {
+		latest uint32 // filtered before in the same shard, 0 for none
+		id     uint16
+		want   uint32
+	}{
+		{0, 5, 5},
+		{0, 0xffff, 0xffffffff}, // closest to 0 is behind it
+		{0x1fff0, 0xfff0, 0x1fff0},
+		{0x1fff0, 0x0010, 0x20010}, // after the latest, wrapped
+		{0x1fff0, 0xffd0, 0x1ffd0}, // before the latest
+		{0x1fff0, 0x7ff0, 0x17ff0}, // half way, taken as behind
+		{0x1fff0, 0x8010, 0x18010}, // closer behind than ahead
+		{0xfffffff0, 0x0010, 0x10}, // 32-bit wraparound
+	}
+	for _, tt := range tests {
+		pf := channel.NewPacketFilter(time.Second, 1<<20)
+		if tt.latest != 0 {
+			pf.Filter(tt.latest, time.Now())
+		}
+		if got := pf.ExtendLegacyPacketID(tt.id); got != tt.want {
+			t.Errorf("extended %#x after %#x to %#x, want %#x", tt.id, tt.latest, got, tt.want)
+		}
+	}
+}
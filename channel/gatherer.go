@@ -2,113 +2,149 @@
 package channel
 
 import (
-	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/config"
 	"github.com/chenx-dust/paracat/packet"
 )
 
 type Gatherer struct {
 	// outCallback func(packet *packet.Packet) (int, error)
-	gather  *PacketFilter
-	chanOut chan buffer.WithBufferArg[[]*packet.Packet]
+	gather    *PacketFilter
+	decoder   *FECDecoder
+	reorderer *Reorderer // nil if reordering is disabled
+	chanOut   chan buffer.WithBufferArg[[]*packet.Packet]
+	overflow  config.OverflowPolicy
 
-	StatisticIn  *packet.PacketStatistic
-	StatisticOut *packet.PacketStatistic
+	StatisticIn        *packet.PacketStatistic
+	StatisticOut       *packet.PacketStatistic
+	StatisticRecovered *packet.PacketStatistic
+	StatisticDropped   *packet.PacketStatistic
+	StatisticDuplicate *packet.PacketStatistic
+	StatisticDedupLate *packet.PacketStatistic // accepted after their dedup record is gone
+	StatisticReordered *packet.PacketStatistic
+	StatisticLate      *packet.PacketStatistic
 }
 
-func NewGatherer(chanSize int) *Gatherer {
-	return &Gatherer{
-		gather:       NewPacketGather(),
-		chanOut:      make(chan buffer.WithBufferArg[[]*packet.Packet], chanSize),
-		StatisticIn:  packet.NewPacketStatistic(),
-		StatisticOut: packet.NewPacketStatistic(),
+// NewGatherer creates a gatherer dropping duplicates within dedupTimeout,
+// remembering at most dedupWindow packet ids. With reorderDelay above 0,
+// packets are put back in order, waiting up to reorderDelay for the missing
+// ones. When the output is full, packets are dropped by overflow.
+func NewGatherer(chanSize int, overflow config.OverflowPolicy, dedupTimeout time.Duration, dedupWindow int, reorderDelay time.Duration) *Gatherer {
+	ch := &Gatherer{
+		gather:             NewPacketFilter(dedupTimeout, dedupWindow),
+		decoder:            NewFECDecoder(),
+		chanOut:            make(chan buffer.WithBufferArg[[]*packet.Packet], chanSize),
+		overflow:           overflow,
+		StatisticIn:        packet.NewPacketStatistic(),
+		StatisticOut:       packet.NewPacketStatistic(),
+		StatisticRecovered: packet.NewPacketStatistic(),
+		StatisticDropped:   packet.NewPacketStatistic(),
+		StatisticDuplicate: packet.NewPacketStatistic(),
+		StatisticDedupLate: packet.NewPacketStatistic(),
+		StatisticReordered: packet.NewPacketStatistic(),
+		StatisticLate:      packet.NewPacketStatistic(),
 	}
+	if reorderDelay > 0 {
+		ch.reorderer = NewReorderer(reorderDelay, func(packets []*packet.Packet) {
+			// released packets are copies, the buffer is only to be released
+			pBuffer := buffer.NewPackedBuffer()
+			ch.send(packets, pBuffer.MoveArg())
+		})
+		ch.StatisticReordered = ch.reorderer.StatisticReordered
+		ch.StatisticLate = ch.reorderer.StatisticLate
+	}
+	return ch
 }
 
 func (ch *Gatherer) GetOutChan() <-chan buffer.WithBufferArg[[]*packet.Packet] {
 	return ch.chanOut
 }
 
+// Close stops releasing reordered packets and releases the packets not taken
+// out yet. Nothing is to be forwarded afterwards.
+func (ch *Gatherer) Close() {
+	if ch.reorderer != nil {
+		ch.reorderer.Stop()
+	}
+	buffer.DrainWith(ch.chanOut)
+}
+
 func (ch *Gatherer) Forward(newPackets_ buffer.WithBufferArg[[]*packet.Packet]) {
 	newPackets := newPackets_.ToOwned()
 	inSize := 0
 	outSize := 0
 	fwdPackets := make([]*packet.Packet, 0, len(newPackets.Thing))
+	now := time.Now()
 	for _, newPacket := range newPackets.Thing {
 		inSize += len(newPacket.Buffer)
-		if ch.gather.CheckDuplicatePacketID(newPacket.PacketID) {
-			continue
+		var recovered []*packet.Packet
+		if newPacket.Type == packet.ParityPacketType {
+			recovered = ch.decoder.AddParity(newPacket)
+		} else {
+			if newPacket.Version == packet.LEGACY_VERSION {
+				newPacket.PacketID = ch.gather.ExtendLegacyPacketID(uint16(newPacket.PacketID))
+			}
+			if ch.isDuplicate(newPacket, now) {
+				continue
+			}
+			outSize += len(newPacket.Buffer)
+			fwdPackets = append(fwdPackets, newPacket)
+			recovered = ch.decoder.AddData(newPacket)
+		}
+		for _, recoveredPacket := range recovered {
+			if ch.isDuplicate(recoveredPacket, now) {
+				continue
+			}
+			ch.StatisticRecovered.CountPacket(uint32(len(recoveredPacket.Buffer)))
+			outSize += len(recoveredPacket.Buffer)
+			fwdPackets = append(fwdPackets, recoveredPacket)
 		}
-		outSize += len(newPacket.Buffer)
-		fwdPackets = append(fwdPackets, newPacket)
 	}
 	ch.StatisticIn.CountPacket(uint32(inSize))
 	ch.StatisticOut.CountPacket(uint32(outSize))
-	data := buffer.WithBuffer[[]*packet.Packet]{
-		Thing:  fwdPackets,
-		Buffer: newPackets.Buffer.Move(),
+	if ch.reorderer == nil {
+		ch.send(fwdPackets, newPackets.Buffer.MoveArg())
+		return
 	}
-	select {
-	case ch.chanOut <- data.MoveArg():
-	default:
-		data.Release()
+	if !ch.reorderer.Reorder(fwdPackets, func(packets []*packet.Packet) {
+		ch.send(packets, newPackets.Buffer.MoveArg())
+	}) {
+		newPackets.Release()
 	}
 }
 
-type PacketFilter struct {
-	packetMutex     sync.Mutex
-	packetLowMap    [0x8000]bool
-	packetLowClear  bool
-	packetHighMap   [0x8000]bool
-	packetHighClear bool
+func (ch *Gatherer) isDuplicate(p *packet.Packet, now time.Time) bool {
+	switch ch.gather.Filter(p.PacketID, now) {
+	case FilterDuplicate:
+		ch.StatisticDuplicate.CountPacket(uint32(len(p.Buffer)))
+		return true
+	case FilterLate:
+		ch.StatisticDedupLate.CountPacket(uint32(len(p.Buffer)))
+	}
+	return false
 }
 
-func NewPacketGather() *PacketFilter {
-	return &PacketFilter{
-		packetLowMap:    [0x8000]bool{},
-		packetLowClear:  true,
-		packetHighMap:   [0x8000]bool{},
-		packetHighClear: true,
+func (ch *Gatherer) send(packets []*packet.Packet, pBuffer buffer.ArgPtr[*buffer.PackedBuffer]) {
+	data := buffer.WithBuffer[[]*packet.Packet]{
+		Thing:  packets,
+		Buffer: pBuffer.ToOwned(),
 	}
+	push(ch.chanOut, data.MoveArg(), ch.overflow, ch.drop)
 }
 
-func (pf *PacketFilter) CheckDuplicatePacketID(id uint16) bool {
-	/*
-		divide packet id into four partitions:
-		0x0000 ~ 0x3FFF: low map, allowing high map packet input
-		0x4000 ~ 0x7FFF: low map, clearing high map
-		0x8000 ~ 0xBFFF: high map, allowing low map packet input
-		0xC000 ~ 0xFFFF: high map, clearing low map
-	*/
-	var ok bool
-	pf.packetMutex.Lock()
-	defer pf.packetMutex.Unlock()
-	if id < 0x8000 {
-		ok = pf.packetLowMap[id]
-		if !ok {
-			pf.packetLowMap[id] = true
-		}
-		pf.packetLowClear = false
-		if id > 0x3FFF && !pf.packetHighClear {
-			pf.packetHighMap = [0x8000]bool{}
-			pf.packetHighClear = true
-		}
-	} else {
-		ok = pf.packetHighMap[id-0x8000]
-		if !ok {
-			pf.packetHighMap[id-0x8000] = true
-		}
-		pf.packetHighClear = false
-		if id < 0xC000 && !pf.packetLowClear {
-			pf.packetLowMap = [0x8000]bool{}
-			pf.packetLowClear = true
-		}
+func (ch *Gatherer) drop(data_ buffer.WithBufferArg[[]*packet.Packet]) {
+	data := data_.ToOwned()
+	size := 0
+	for _, p := range data.Thing {
+		size += len(p.Buffer)
 	}
-	return ok
+	ch.StatisticDropped.CountPacket(uint32(size))
+	data.Release()
 }
 
-func NewPacketID(idIncrement *atomic.Uint32) uint16 {
-	return uint16(idIncrement.Add(1) - 1)
+func NewPacketID(idIncrement *atomic.Uint32) uint32 {
+	return idIncrement.Add(1) - 1
 }
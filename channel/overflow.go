@@ -0,0 +1,41 @@
+package channel
+
+import (
+	"time"
+
+	"github.com/chenx-dust/paracat/config"
+)
+
+// push queues data to ch, handling a full queue by policy. Whatever is
+// dropped, data or the head of the queue, is passed to drop. It reports
+// whether data is queued.
+func push[T any](ch chan T, data T, policy config.OverflowPolicy, drop func(T)) bool {
+	select {
+	case ch <- data:
+		return true
+	default:
+	}
+	switch policy.Type {
+	case config.DropOldestOverflowType:
+		select {
+		case oldest := <-ch:
+			drop(oldest)
+		default:
+		}
+		select {
+		case ch <- data:
+			return true
+		default:
+		}
+	case config.BlockOverflowType:
+		timer := time.NewTimer(policy.Timeout)
+		defer timer.Stop()
+		select {
+		case ch <- data:
+			return true
+		case <-timer.C:
+		}
+	}
+	drop(data)
+	return false
+}
@@ -0,0 +1,271 @@
+/* Reorderer puts packets of every connection back in order. */
+package channel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chenx-dust/paracat/packet"
+)
+
+const (
+	// reorderWindow is the number of sequences a stream can hold ahead of the
+	// next expected one. Packets further ahead make it give up on the
+	// missing ones.
+	reorderWindow = 1 << 15
+	// reorderIdleTimeout is how long a stream without held packets is kept
+	// after its last packet, and reorderSweepInterval how often such streams
+	// are looked for.
+	reorderIdleTimeout   = 1 * time.Minute
+	reorderSweepInterval = 10 * time.Second
+	// sharedStream is the stream of packets without conn seq, from peers not
+	// sequencing them. They are ordered by their packet ids, which are shared
+	// by all connections.
+	sharedStream = 1 << 32
+)
+
+type reorderEntry struct {
+	packet  *packet.Packet
+	arrival time.Time
+}
+
+// reorderStream is the packets of one connection, in the order of their
+// conn seqs.
+type reorderStream struct {
+	next     uint32 // sequence expected next
+	held     map[uint32]reorderEntry
+	lastSeen time.Time
+}
+
+type reorderArrival struct {
+	stream uint64
+	seq    uint32
+}
+
+// Reorderer holds packets arriving ahead of a missing one of the same
+// connection for up to maxDelay, then releases them in sequence. A missing
+// packet holds back its connection only.
+type Reorderer struct {
+	mutex     sync.Mutex
+	maxDelay  time.Duration
+	output    func([]*packet.Packet)
+	streams   map[uint64]*reorderStream
+	arrivals  []reorderArrival // held packets in arrival order
+	timer     *time.Timer
+	lastSweep time.Time
+	released  uint64 // batches released so far, numbering their turns
+
+	// batches are output in turn without mutex held, so that an output
+	// blocking keeps back the outputs after it but not reordering
+	turnMutex sync.Mutex
+	turnCond  *sync.Cond
+	turn      uint64 // of the batch to be output next
+
+	StatisticReordered *packet.PacketStatistic // held until the missing ones came or timed out
+	StatisticLate      *packet.PacketStatistic // came after being given up, out of order
+}
+
+// NewReorderer creates a reorderer sending packets released on timeout to
+// output.
+func NewReorderer(maxDelay time.Duration, output func([]*packet.Packet)) *Reorderer {
+	r := &Reorderer{
+		maxDelay:           maxDelay,
+		output:             output,
+		streams:            make(map[uint64]*reorderStream),
+		lastSweep:          time.Now(),
+		StatisticReordered: packet.NewPacketStatistic(),
+		StatisticLate:      packet.NewPacketStatistic(),
+	}
+	r.turnCond = sync.NewCond(&r.turnMutex)
+	return r
+}
+
+// streamOf tells the stream of p and its sequence in it.
+func streamOf(p *packet.Packet) (uint64, uint32) {
+	if p.Flags&packet.SequencedFlag == 0 {
+		return sharedStream, p.PacketID
+	}
+	return uint64(p.ConnID), p.ConnSeq
+}
+
+// Reorder passes packets in sequence to output, holding those out of order,
+// and reports whether output is called, which it is not if nothing is ready.
+// Output is called before return, and in turn with releases on timeout, so
+// that they keep their order. Held packets are copied, so the buffer of
+// packets can be released after output, or at once if it is not called.
+func (r *Reorderer) Reorder(packets []*packet.Packet, output func([]*packet.Packet)) bool {
+	r.mutex.Lock()
+	ready := make([]*packet.Packet, 0, len(packets))
+	now := time.Now()
+	for _, p := range packets {
+		key, seq := streamOf(p)
+		stream, ok := r.streams[key]
+		if !ok {
+			stream = &reorderStream{
+				next: seq,
+				held: make(map[uint32]reorderEntry),
+			}
+			r.streams[key] = stream
+		}
+		stream.lastSeen = now
+		diff := int32(seq - stream.next)
+		switch {
+		case diff == 0:
+			ready = append(ready, p)
+			stream.next++
+			ready = stream.drain(ready)
+		case diff < 0 && -diff < reorderWindow:
+			r.StatisticLate.CountPacket(uint32(len(p.Buffer)))
+			ready = append(ready, p)
+		case diff < 0 || diff >= reorderWindow:
+			// too far away, the sender has restarted or many are lost
+			ready = stream.skip(ready, stream.next+reorderWindow-1)
+			stream.next = seq + 1
+			ready = append(ready, p)
+		default:
+			if _, ok := stream.held[seq]; ok {
+				// a duplicate the filter let through, e.g. recovered
+				continue
+			}
+			r.StatisticReordered.CountPacket(uint32(len(p.Buffer)))
+			p.Buffer = append([]byte(nil), p.Buffer...)
+			stream.held[seq] = reorderEntry{packet: p, arrival: now}
+			r.arrivals = append(r.arrivals, reorderArrival{stream: key, seq: seq})
+		}
+	}
+	if now.Sub(r.lastSweep) > reorderSweepInterval {
+		r.sweep(now)
+	}
+	r.resetTimer(now)
+	if len(ready) == 0 {
+		r.mutex.Unlock()
+		return false
+	}
+	r.release(ready, output)
+	return true
+}
+
+// release outputs ready in its turn. Should be called with mutex held, which
+// it unlocks.
+func (r *Reorderer) release(ready []*packet.Packet, output func([]*packet.Packet)) {
+	turn := r.released
+	r.released++
+	r.mutex.Unlock()
+
+	r.turnMutex.Lock()
+	for r.turn != turn {
+		r.turnCond.Wait()
+	}
+	r.turnMutex.Unlock()
+	defer func() {
+		r.turnMutex.Lock()
+		r.turn++
+		r.turnCond.Broadcast()
+		r.turnMutex.Unlock()
+	}()
+	output(ready)
+}
+
+// drain appends held packets following the next expected sequence.
+func (stream *reorderStream) drain(ready []*packet.Packet) []*packet.Packet {
+	for len(stream.held) > 0 {
+		entry, ok := stream.held[stream.next]
+		if !ok {
+			break
+		}
+		ready = append(ready, entry.packet)
+		delete(stream.held, stream.next)
+		stream.next++
+	}
+	return ready
+}
+
+// skip gives up on missing sequences up to last, appending held packets
+// among them and those following.
+func (stream *reorderStream) skip(ready []*packet.Packet, last uint32) []*packet.Packet {
+	for ; int32(last-stream.next) >= 0 && len(stream.held) > 0; stream.next++ {
+		if entry, ok := stream.held[stream.next]; ok {
+			ready = append(ready, entry.packet)
+			delete(stream.held, stream.next)
+		}
+	}
+	if int32(last-stream.next) >= 0 {
+		// nothing held is left among them
+		stream.next = last + 1
+	}
+	return stream.drain(ready)
+}
+
+// oldest returns the stream and the sequence of the earliest arrived packet
+// still held.
+func (r *Reorderer) oldest() (*reorderStream, uint32, *reorderEntry) {
+	for len(r.arrivals) > 0 {
+		arrival := r.arrivals[0]
+		if stream, ok := r.streams[arrival.stream]; ok {
+			if entry, ok := stream.held[arrival.seq]; ok {
+				return stream, arrival.seq, &entry
+			}
+		}
+		r.arrivals = r.arrivals[1:]
+	}
+	r.arrivals = nil
+	return nil, 0, nil
+}
+
+// sweep forgets streams holding nothing and idle for long, e.g. of closed
+// connections.
+func (r *Reorderer) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, stream := range r.streams {
+		if len(stream.held) == 0 && now.Sub(stream.lastSeen) > reorderIdleTimeout {
+			delete(r.streams, key)
+		}
+	}
+}
+
+// Stop discards the held packets, so that nothing is released on timeout
+// anymore.
+func (r *Reorderer) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	clear(r.streams)
+	r.arrivals = nil
+}
+
+func (r *Reorderer) resetTimer(now time.Time) {
+	_, _, entry := r.oldest()
+	if entry == nil {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		return
+	}
+	delay := entry.arrival.Add(r.maxDelay).Sub(now)
+	if r.timer == nil {
+		r.timer = time.AfterFunc(delay, r.expire)
+	} else {
+		r.timer.Reset(delay)
+	}
+}
+
+func (r *Reorderer) expire() {
+	r.mutex.Lock()
+	var ready []*packet.Packet
+	now := time.Now()
+	for {
+		stream, seq, entry := r.oldest()
+		if entry == nil || now.Sub(entry.arrival) < r.maxDelay {
+			break
+		}
+		ready = stream.skip(ready, seq)
+	}
+	r.resetTimer(now)
+	if len(ready) == 0 {
+		r.mutex.Unlock()
+		return
+	}
+	r.release(ready, r.output)
+}
@@ -0,0 +1,240 @@
+package channel_test
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/channel"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+// window is the reorder window of the reorderer.
+const window = 1 << 15
+
+// released collects what a reorderer outputs, on return and on timeout.
+type released struct {
+	mutex   sync.Mutex
+	packets []*packet.Packet
+}
+
+func (r *released) output(packets []*packet.Packet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.packets = append(r.packets, packets...)
+}
+
+// take returns and forgets what is output so far, as conn id and packet id
+// pairs.
+func (r *released) take() [][2]uint32 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	taken := make([][2]uint32, len(r.packets))
+	for i, p := range r.packets {
+		taken[i] = [2]uint32{p.ConnID, p.PacketID}
+	}
+	r.packets = nil
+	return taken
+}
+
+func sequenced(connID uint32, seqs ...uint32) []*packet.Packet {
+	packets := make([]*packet.Packet, len(seqs))
+	for i, seq := range seqs {
+		packets[i] = &packet.Packet{
+			Buffer:   []byte{byte(seq)},
+			ConnID:   connID,
+			PacketID: seq, // as if the connection was the only one
+			ConnSeq:  seq,
+			Flags:    packet.SequencedFlag,
+		}
+	}
+	return packets
+}
+
+func pairs(connID uint32, seqs ...uint32) [][2]uint32 {
+	taken := make([][2]uint32, len(seqs))
+	for i, seq := range seqs {
+		taken[i] = [2]uint32{connID, seq}
+	}
+	return taken
+}
+
+func TestReorderer(t *testing.T) {
+	const maxDelay = 50 * time.Millisecond
+	tests := []struct {
+		name     string
+		arrivals [][]*packet.Packet
+		want     [][2]uint32 // before timeout
+		expired  [][2]uint32 // after timeout
+	}{
+		{
+			name:     "in order",
+			arrivals: [][]*packet.Packet{sequenced(1, 10, 11), sequenced(1, 12, 13)},
+			want:     pairs(1, 10, 11, 12, 13),
+		},
+		{
+			name:     "gap filled",
+			arrivals: [][]*packet.Packet{sequenced(1, 10, 12, 13), sequenced(1, 11), sequenced(1, 14)},
+			want:     pairs(1, 10, 11, 12, 13, 14),
+		},
+		{
+			name:     "gap skipped on timeout",
+			arrivals: [][]*packet.Packet{sequenced(1, 10, 12, 13)},
+			want:     pairs(1, 10),
+			expired:  pairs(1, 12, 13),
+		},
+		{
+			name:     "late after timeout",
+			arrivals: [][]*packet.Packet{sequenced(1, 10, 12), nil, sequenced(1, 11, 13)},
+			want:     pairs(1, 10, 12, 11, 13),
+		},
+		{
+			name:     "duplicate held",
+			arrivals: [][]*packet.Packet{sequenced(1, 10, 12, 12), sequenced(1, 11)},
+			want:     pairs(1, 10, 11, 12),
+		},
+		{
+			name:     "window overflow",
+			arrivals: [][]*packet.Packet{sequenced(1, 10, 12), sequenced(1, 10+window+5)},
+			want:     pairs(1, 10, 12, 10+window+5),
+		},
+		{
+			name:     "sender restarted",
+			arrivals: [][]*packet.Packet{sequenced(1, window+10, window+12), sequenced(1, 0, 1)},
+			want:     pairs(1, window+10, window+12, 0, 1),
+		},
+		{
+			name:     "wraparound",
+			arrivals: [][]*packet.Packet{sequenced(1, 1<<32-2, 0), sequenced(1, 1<<32-1)},
+			want:     pairs(1, 1<<32-2, 1<<32-1, 0),
+		},
+		{
+			name: "gap of another conn",
+			arrivals: [][]*packet.Packet{
+				append(sequenced(1, 10, 12), sequenced(2, 20)...),
+				sequenced(2, 21, 22),
+			},
+			want:    append(append(pairs(1, 10), pairs(2, 20)...), pairs(2, 21, 22)...),
+			expired: pairs(1, 12),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out released
+			r := channel.NewReorderer(maxDelay, out.output)
+			defer r.Stop()
+			for _, packets := range tt.arrivals {
+				if packets == nil {
+					time.Sleep(2 * maxDelay)
+					continue
+				}
+				r.Reorder(packets, out.output)
+			}
+			if got := out.take(); !slices.Equal(got, tt.want) {
+				t.Fatalf("released %v, want %v", got, tt.want)
+			}
+			time.Sleep(2 * maxDelay)
+			if got := out.take(); !slices.Equal(got, tt.expired) {
+				t.Errorf("released on timeout %v, want %v", got, tt.expired)
+			}
+		})
+	}
+}
+
+// TestReordererUnsequenced orders packets of peers not sending conn seqs by
+// their packet ids, across connections.
+func TestReordererUnsequenced(t *testing.T) {
+	var out released
+	r := channel.NewReorderer(time.Second, out.output)
+	defer r.Stop()
+	r.Reorder([]*packet.Packet{
+		{ConnID: 1, PacketID: 5},
+		{ConnID: 2, PacketID: 7},
+	}, out.output)
+	r.Reorder([]*packet.Packet{{ConnID: 1, PacketID: 6}}, out.output)
+	want := [][2]uint32{{1, 5}, {1, 6}, {2, 7}}
+	if got := out.take(); !slices.Equal(got, want) {
+		t.Errorf("released %v, want %v", got, want)
+	}
+}
+
+// TestReordererStop drops held packets, so that nothing is released after.
+func TestReordererStop(t *testing.T) {
+	const maxDelay = 20 * time.Millisecond
+	var out released
+	r := channel.NewReorderer(maxDelay, out.output)
+	r.Reorder(sequenced(1, 10, 12), out.output)
+	r.Stop()
+	time.Sleep(2 * maxDelay)
+	if got, want := out.take(), pairs(1, 10); !slices.Equal(got, want) {
+		t.Errorf("released %v, want %v", got, want)
+	}
+}
+
+// TestReordererNothingReady does not output empty batches, and tells so.
+func TestReordererNothingReady(t *testing.T) {
+	r := channel.NewReorderer(time.Second, func([]*packet.Packet) {})
+	defer r.Stop()
+	calls := 0
+	output := func([]*packet.Packet) { calls++ }
+	if !r.Reorder(sequenced(1, 10), output) {
+		t.Error("ready packet not output")
+	}
+	if r.Reorder(sequenced(1, 12), output) || r.Reorder(nil, output) {
+		t.Error("reported output of nothing ready")
+	}
+	if calls != 1 {
+		t.Errorf("output %d times, want 1", calls)
+	}
+}
+
+// TestReordererBlockedOutput goes on reordering while an output blocks, and
+// keeps the outputs after it back in order.
+func TestReordererBlockedOutput(t *testing.T) {
+	const maxDelay = 50 * time.Millisecond
+	var out released
+	r := channel.NewReorderer(maxDelay, out.output)
+	defer r.Stop()
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	go r.Reorder(sequenced(1, 10), func(packets []*packet.Packet) {
+		close(entered)
+		<-unblock
+		out.output(packets)
+	})
+	<-entered
+
+	held := make(chan bool)
+	go func() {
+		held <- r.Reorder(sequenced(1, 12), out.output)
+	}()
+	select {
+	case ready := <-held:
+		if ready {
+			t.Error("packet ahead of a missing one output")
+		}
+	case <-time.After(maxDelay / 2):
+		t.Fatal("reordering blocked by an output")
+	}
+
+	after := make(chan struct{})
+	go func() {
+		defer close(after)
+		r.Reorder(sequenced(2, 5), out.output)
+	}()
+	time.Sleep(maxDelay / 5)
+	if got := out.take(); len(got) != 0 {
+		t.Fatalf("released %v before the blocked output", got)
+	}
+	close(unblock)
+	<-after
+	if got, want := out.take(), append(pairs(1, 10), pairs(2, 5)...); !slices.Equal(got, want) {
+		t.Errorf("released %v, want %v", got, want)
+	}
+	time.Sleep(2 * maxDelay)
+	if got, want := out.take(), pairs(1, 12); !slices.Equal(got, want) {
+		t.Errorf("released %v on timeout, want %v", got, want)
+	}
+}
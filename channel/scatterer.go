@@ -4,51 +4,208 @@ package channel
 import (
 	"errors"
 	"log"
+	"math"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/chenx-dust/paracat/buffer"
 	"github.com/chenx-dust/paracat/config"
 	"github.com/chenx-dust/paracat/packet"
 )
 
+type scatterOutput struct {
+	ch            chan buffer.ArgPtr[*buffer.PackedBuffer]
+	weight        int
+	currentWeight int
+	alive         bool
+	standby       bool          // used only when no output off standby is alive and fine
+	lossy         bool          // used only when no other output is fine
+	rtt           time.Duration // 0 for unknown
+	rate          float64       // pacing rate in bytes per second, 0 for not paced
+	overflow      config.OverflowPolicy
+	dropped       *packet.PacketStatistic
+	limiter       Limiter // nil for unlimited
+}
+
+// Limiter tells whether an output has used up its rate limit for now.
+type Limiter interface {
+	Exhausted() bool
+}
+
+// fastestHysteresis is the advantage given to the currently selected paths in
+// fastest modes, so that similar paths do not flap on every measurement.
+const fastestHysteresis = 0.1
+
 type Scatterer struct {
 	connMutex     sync.RWMutex
-	outChans      []chan<- buffer.ArgPtr[*buffer.PackedBuffer]
+	outputs       []*scatterOutput
+	bestTier      int // tier of the best output, which every usable one is in
 	roundRobinIdx int
+	weightMutex   sync.Mutex
+	fastest       []*scatterOutput
+	primary       *scatterOutput   // the only output used in failover mode
+	ranked        []*scatterOutput // usable outputs by RTT, fastest first
+	redundantIdx  atomic.Uint32
 	mode          config.ScatterType
+	redundancy    int
 
 	StatisticIn  *packet.PacketStatistic
 	StatisticOut *packet.PacketStatistic
 }
 
-func NewScatterer(mode config.ScatterType) *Scatterer {
+func NewScatterer(mode config.ScatterType, redundancy int) *Scatterer {
 	if mode == config.NotDefinedScatterType {
 		log.Fatal("scatterer mode not defined")
 	}
 	log.Println("new scatterer with mode:", config.ScatterTypeToString(mode))
 	return &Scatterer{
-		outChans:      make([]chan<- buffer.ArgPtr[*buffer.PackedBuffer], 0),
+		outputs:       make([]*scatterOutput, 0),
 		roundRobinIdx: 0,
 		mode:          mode,
+		redundancy:    redundancy,
 		StatisticIn:   packet.NewPacketStatistic(),
 		StatisticOut:  packet.NewPacketStatistic(),
 	}
 }
 
-func (d *Scatterer) NewOutput(ch chan<- buffer.ArgPtr[*buffer.PackedBuffer]) {
+func (d *Scatterer) Mode() config.ScatterType {
+	d.connMutex.RLock()
+	defer d.connMutex.RUnlock()
+	return d.mode
+}
+
+// SetMode changes the mode on the fly, keeping the outputs.
+func (d *Scatterer) SetMode(mode config.ScatterType) {
 	d.connMutex.Lock()
 	defer d.connMutex.Unlock()
-	d.outChans = append(d.outChans, ch)
+	if d.mode == mode {
+		return
+	}
+	log.Println("scatterer mode changed to:", config.ScatterTypeToString(mode))
+	d.mode = mode
+	d.fastest, d.ranked, d.primary = nil, nil, nil
+	d.outputsChanged()
 }
 
+// NewOutput registers ch as an output, or updates its weight if it is
+// already registered. weight is only used in weighted mode. When ch is full,
+// packets are dropped by overflow and counted in dropped. Outputs exhausted
+// by limiter are skipped while others are not.
+func (d *Scatterer) NewOutput(ch chan buffer.ArgPtr[*buffer.PackedBuffer], weight int, overflow config.OverflowPolicy, dropped *packet.PacketStatistic, limiter Limiter) {
+	if weight < 1 {
+		weight = 1
+	}
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+	for _, output := range d.outputs {
+		if output.ch == ch {
+			output.weight = weight
+			return
+		}
+	}
+	d.outputs = append(d.outputs, &scatterOutput{
+		ch:       ch,
+		weight:   weight,
+		alive:    true,
+		overflow: overflow,
+		dropped:  dropped,
+		limiter:  limiter,
+	})
+	d.outputsChanged()
+}
+
+// RemoveOutput unregisters ch. The channel is left open since its sender
+// loop may still be in use for control packets, or it may be added back.
 func (d *Scatterer) RemoveOutput(ch chan<- buffer.ArgPtr[*buffer.PackedBuffer]) error {
 	d.connMutex.Lock()
 	defer d.connMutex.Unlock()
-	for i := 0; i < len(d.outChans); i++ {
-		if d.outChans[i] == ch {
-			d.outChans[i] = d.outChans[len(d.outChans)-1]
-			d.outChans = d.outChans[:len(d.outChans)-1]
-			close(ch)
+	for i := 0; i < len(d.outputs); i++ {
+		if d.outputs[i].ch == ch {
+			d.outputs[i] = d.outputs[len(d.outputs)-1]
+			d.outputs = d.outputs[:len(d.outputs)-1]
+			d.outputsChanged()
+			return nil
+		}
+	}
+	return errors.New("channel not found")
+}
+
+// SetOutputAlive suspends or resumes an output without unregistering it.
+// Suspended outputs are skipped unless every output is suspended.
+func (d *Scatterer) SetOutputAlive(ch chan<- buffer.ArgPtr[*buffer.PackedBuffer], alive bool) error {
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+	for _, output := range d.outputs {
+		if output.ch == ch {
+			if output.alive != alive {
+				output.alive = alive
+				d.outputsChanged()
+			}
+			return nil
+		}
+	}
+	return errors.New("channel not found")
+}
+
+// SetOutputStandby puts an output on standby or back. Outputs on standby are
+// skipped unless no output off standby is alive and fine.
+func (d *Scatterer) SetOutputStandby(ch chan<- buffer.ArgPtr[*buffer.PackedBuffer], standby bool) error {
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+	for _, output := range d.outputs {
+		if output.ch == ch {
+			if output.standby != standby {
+				output.standby = standby
+				d.outputsChanged()
+			}
+			return nil
+		}
+	}
+	return errors.New("channel not found")
+}
+
+// SetOutputLossy marks an output losing too many packets, which is skipped
+// unless every other one is lossy or suspended.
+func (d *Scatterer) SetOutputLossy(ch chan<- buffer.ArgPtr[*buffer.PackedBuffer], lossy bool) error {
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+	for _, output := range d.outputs {
+		if output.ch == ch {
+			if output.lossy != lossy {
+				output.lossy = lossy
+				d.outputsChanged()
+			}
+			return nil
+		}
+	}
+	return errors.New("channel not found")
+}
+
+// SetOutputRTT updates the measured round-trip time of an output, which is
+// used by fastest modes.
+func (d *Scatterer) SetOutputRTT(ch chan<- buffer.ArgPtr[*buffer.PackedBuffer], rtt time.Duration) error {
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+	for _, output := range d.outputs {
+		if output.ch == ch {
+			output.rtt = rtt
+			d.updateFastest()
+			return nil
+		}
+	}
+	return errors.New("channel not found")
+}
+
+// SetOutputRate updates the pacing rate of an output learned by congestion
+// control, which is used by weighted mode in place of the weights.
+func (d *Scatterer) SetOutputRate(ch chan<- buffer.ArgPtr[*buffer.PackedBuffer], rate float64) error {
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+	for _, output := range d.outputs {
+		if output.ch == ch {
+			output.rate = rate
 			return nil
 		}
 	}
@@ -59,30 +216,255 @@ func (d *Scatterer) Scatter(data_ buffer.ArgPtr[*buffer.PackedBuffer]) {
 	data := data_.ToOwned()
 	defer data.Release()
 	d.StatisticIn.CountPacket(uint32(data.Ptr.TotalSize))
+	// sent after unlocking, as pushing may block by overflow policy
+	var targetsBuf [16]*scatterOutput
+	targets := d.targets(targetsBuf[:0], &data)
+	for _, output := range targets {
+		d.send(output, &data)
+	}
+}
+
+// targets appends the outputs data should be sent to.
+func (d *Scatterer) targets(targets []*scatterOutput, data *buffer.OwnedPtr[*buffer.PackedBuffer]) []*scatterOutput {
 	d.connMutex.RLock()
 	defer d.connMutex.RUnlock()
+	if len(d.outputs) == 0 {
+		return targets
+	}
 	switch d.mode {
 	case config.RoundRobinScatterType:
-		d.roundRobinIdx = (d.roundRobinIdx + 1) % len(d.outChans)
-		sharingData := data.ShareArg()
-		select {
-		case d.outChans[d.roundRobinIdx] <- sharingData:
-			d.StatisticOut.CountPacket(uint32(data.Ptr.TotalSize))
-		default:
-			sd := sharingData.ToOwned()
-			sd.Release()
-		}
+		targets = append(targets, d.nextRoundRobin())
 	case config.ConcurrentScatterType:
 		d.StatisticIn.CountPacket(uint32(data.Ptr.TotalSize))
-		for _, outChan := range d.outChans {
-			sharingData := data.ShareArg()
-			select {
-			case outChan <- sharingData:
-				d.StatisticOut.CountPacket(uint32(data.Ptr.TotalSize))
-			default:
-				sd := sharingData.ToOwned()
-				sd.Release()
+		targets = d.spread(targets, 0, len(d.outputs))
+	case config.WeightedScatterType:
+		targets = append(targets, d.nextWeighted())
+	case config.FastestScatterType, config.FastestNScatterType:
+		sent := 0
+		for _, output := range d.ranked {
+			if sent == len(d.fastest) {
+				break
 			}
+			if d.ready(output) {
+				targets = append(targets, output)
+				sent++
+			}
+		}
+		if sent == 0 {
+			targets = append(targets, d.fastest...)
+		}
+	case config.FailoverScatterType:
+		targets = append(targets, d.primary)
+	case config.RedundantScatterType:
+		// start from a different output every time to spread the load
+		start := int(d.redundantIdx.Add(1) % uint32(len(d.outputs)))
+		targets = d.spread(targets, start, d.redundancy)
+	}
+	return targets
+}
+
+// spread appends up to n usable outputs in turn from start, skipping those
+// out of their rate limit unless all of them are.
+// Should be called with connMutex held.
+func (d *Scatterer) spread(targets []*scatterOutput, start int, n int) []*scatterOutput {
+	sent := 0
+	for i := 0; i < len(d.outputs) && sent < n; i++ {
+		output := d.outputs[(start+i)%len(d.outputs)]
+		if d.usable(output) && d.ready(output) {
+			targets = append(targets, output)
+			sent++
+		}
+	}
+	for i := 0; i < len(d.outputs) && sent == 0; i++ {
+		output := d.outputs[(start+i)%len(d.outputs)]
+		if d.usable(output) {
+			targets = append(targets, output)
+		}
+	}
+	return targets
+}
+
+// tier ranks how well an output should be scattered to, lower is better.
+func (output *scatterOutput) tier() int {
+	switch {
+	case !output.alive:
+		return 3
+	case output.lossy:
+		return 2
+	case output.standby:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// usable reports whether output should be scattered to, which is when no
+// other output is in a better tier. When every output is suspended, all of
+// them are used since there is nothing better to do.
+// Should be called with connMutex held.
+func (d *Scatterer) usable(output *scatterOutput) bool {
+	return output.tier() == d.bestTier
+}
+
+// ready reports whether output is within its rate limit.
+func (d *Scatterer) ready(output *scatterOutput) bool {
+	return output.limiter == nil || !output.limiter.Exhausted()
+}
+
+// send pushes data to output, without connMutex held. The output may be
+// removed meanwhile, in which case data is left in its channel, which is
+// drained by the remover or dropped with it.
+func (d *Scatterer) send(output *scatterOutput, data *buffer.OwnedPtr[*buffer.PackedBuffer]) {
+	if push(output.ch, data.ShareArg(), output.overflow, output.drop) {
+		d.StatisticOut.CountPacket(uint32(data.Ptr.TotalSize))
+	}
+}
+
+func (output *scatterOutput) drop(data_ buffer.ArgPtr[*buffer.PackedBuffer]) {
+	data := data_.ToOwned()
+	output.dropped.CountPacket(uint32(data.Ptr.TotalSize))
+	data.Release()
+}
+
+// nextRoundRobin picks the next usable output, skipping those with a full
+// queue, e.g. paced by congestion control, or out of their rate limit if
+// another one is not. Should be called with connMutex held.
+func (d *Scatterer) nextRoundRobin() *scatterOutput {
+	var full *scatterOutput
+	for range d.outputs {
+		d.roundRobinIdx = (d.roundRobinIdx + 1) % len(d.outputs)
+		output := d.outputs[d.roundRobinIdx]
+		if !d.usable(output) {
+			continue
+		}
+		if len(output.ch) < cap(output.ch) && d.ready(output) {
+			return output
+		}
+		if full == nil {
+			full = output
 		}
 	}
+	if full == nil {
+		return d.outputs[d.roundRobinIdx]
+	}
+	return full
+}
+
+// nextWeighted picks an output by smooth weighted round-robin, which spreads
+// the picks of a heavy output evenly instead of sending them in a burst.
+// Should be called with connMutex held.
+func (d *Scatterer) nextWeighted() *scatterOutput {
+	d.weightMutex.Lock()
+	defer d.weightMutex.Unlock()
+	// pacing rates tell the capacity better, once every path has one
+	byRate := true
+	var candidatesBuf, exhaustedBuf [16]*scatterOutput
+	candidates, exhausted := candidatesBuf[:0], exhaustedBuf[:0]
+	for _, output := range d.outputs {
+		if !d.usable(output) {
+			continue
+		}
+		byRate = byRate && output.rate > 0
+		if d.ready(output) {
+			candidates = append(candidates, output)
+		} else {
+			exhausted = append(exhausted, output)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = exhausted
+	}
+	var best *scatterOutput
+	totalWeight := 0
+	for _, output := range candidates {
+		weight := output.weight
+		if byRate {
+			weight = max(int(output.rate/1024), 1)
+		}
+		output.currentWeight += weight
+		totalWeight += weight
+		if best == nil || output.currentWeight > best.currentWeight {
+			best = output
+		}
+	}
+	best.currentWeight -= totalWeight
+	return best
+}
+
+// outputsChanged finds the best tier of outputs and re-ranks them. Should
+// be called with connMutex locked.
+func (d *Scatterer) outputsChanged() {
+	d.bestTier = math.MaxInt
+	for _, output := range d.outputs {
+		d.bestTier = min(d.bestTier, output.tier())
+	}
+	d.updateFastest()
+	d.updateFailover()
+}
+
+// updateFailover keeps the primary output of failover mode while it is
+// usable, and fails over to the first usable one otherwise. Should be called
+// with connMutex locked.
+func (d *Scatterer) updateFailover() {
+	if d.mode != config.FailoverScatterType {
+		return
+	}
+	if d.primary != nil && slices.Contains(d.outputs, d.primary) && d.usable(d.primary) {
+		return
+	}
+	d.primary = nil
+	for _, output := range d.outputs {
+		if d.usable(output) {
+			d.primary = output
+			return
+		}
+	}
+}
+
+// updateFastest re-ranks usable outputs by RTT for fastest modes. Outputs
+// without RTT go last. Should be called with connMutex locked.
+func (d *Scatterer) updateFastest() {
+	if d.mode != config.FastestScatterType && d.mode != config.FastestNScatterType {
+		return
+	}
+	n := 1
+	if d.mode == config.FastestNScatterType {
+		n = d.redundancy
+	}
+	selected := make(map[*scatterOutput]bool, len(d.fastest))
+	for _, output := range d.fastest {
+		selected[output] = true
+	}
+	effectiveRTT := func(output *scatterOutput) float64 {
+		if output.rtt == 0 {
+			return math.Inf(1)
+		}
+		if selected[output] {
+			return float64(output.rtt) * (1 - fastestHysteresis)
+		}
+		return float64(output.rtt)
+	}
+	candidates := make([]*scatterOutput, 0, len(d.outputs))
+	for _, output := range d.outputs {
+		if d.usable(output) {
+			candidates = append(candidates, output)
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b *scatterOutput) int {
+		ra, rb := effectiveRTT(a), effectiveRTT(b)
+		switch {
+		case ra < rb:
+			return -1
+		case ra > rb:
+			return 1
+		case selected[a] && !selected[b]:
+			return -1
+		case !selected[a] && selected[b]:
+			return 1
+		default:
+			return 0
+		}
+	})
+	d.ranked = candidates
+	d.fastest = candidates[:min(n, len(candidates))]
 }
@@ -0,0 +1,214 @@
+package channel_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/channel"
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+// newPacked makes a buffer of size bytes to scatter.
+func newPacked(size int) buffer.ArgPtr[*buffer.PackedBuffer] {
+	pBuffer := buffer.NewPackedBuffer()
+	pBuffer.Ptr.SubPackets = append(pBuffer.Ptr.SubPackets, size)
+	pBuffer.Ptr.TotalSize = size
+	return pBuffer.MoveArg()
+}
+
+// TestScattererBlockUnlocked keeps the outputs changeable while a push waits
+// on a full output by the block policy.
+func TestScattererBlockUnlocked(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	d := channel.NewScatterer(config.RoundRobinScatterType, 0)
+	ch := make(chan buffer.ArgPtr[*buffer.PackedBuffer], 1)
+	dropped := packet.NewPacketStatistic()
+	d.NewOutput(ch, 1, config.OverflowPolicy{Type: config.BlockOverflowType, Timeout: timeout}, dropped, nil)
+	defer buffer.Drain(ch)
+
+	d.Scatter(newPacked(100))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Scatter(newPacked(100)) // blocks, as ch is full
+	}()
+	time.Sleep(timeout / 4)
+	start := time.Now()
+	if err := d.SetOutputAlive(ch, false); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > timeout/2 {
+		t.Errorf("output changed after %v, waiting for the blocked push", elapsed)
+	}
+	<-done
+}
+
+type testOutputs []chan buffer.ArgPtr[*buffer.PackedBuffer]
+
+// newOutputs registers outputs of weights, or of weight 1 if none given.
+func newOutputs(d *channel.Scatterer, n int, weights ...int) testOutputs {
+	outputs := make(testOutputs, n)
+	for i := range outputs {
+		outputs[i] = make(chan buffer.ArgPtr[*buffer.PackedBuffer], 1024)
+		weight := 1
+		if i < len(weights) {
+			weight = weights[i]
+		}
+		d.NewOutput(outputs[i], weight, config.OverflowPolicy{}, packet.NewPacketStatistic(), nil)
+	}
+	return outputs
+}
+
+// scatter scatters n buffers and returns how many each output got.
+func (outputs testOutputs) scatter(d *channel.Scatterer, n int) []int {
+	for range n {
+		d.Scatter(newPacked(100))
+	}
+	counts := make([]int, len(outputs))
+	for i, ch := range outputs {
+		counts[i] = len(ch)
+		buffer.Drain(ch)
+	}
+	return counts
+}
+
+func TestScattererModes(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       config.ScatterType
+		redundancy int
+		weights    []int
+		rtts       []time.Duration
+		want       []int // of 6 buffers scattered
+	}{
+		{name: "round-robin", mode: config.RoundRobinScatterType, want: []int{2, 2, 2}},
+		{name: "concurrent", mode: config.ConcurrentScatterType, want: []int{6, 6, 6}},
+		{name: "weighted", mode: config.WeightedScatterType, weights: []int{1, 2, 3}, want: []int{1, 2, 3}},
+		{name: "redundant", mode: config.RedundantScatterType, redundancy: 2, want: []int{4, 4, 4}},
+		{name: "failover", mode: config.FailoverScatterType, want: []int{6, 0, 0}},
+		{
+			name: "fastest",
+			mode: config.FastestScatterType,
+			rtts: []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+			want: []int{0, 6, 0},
+		},
+		{
+			name:       "fastest-n",
+			mode:       config.FastestNScatterType,
+			redundancy: 2,
+			rtts:       []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+			want:       []int{0, 6, 6},
+		},
+		{
+			name: "fastest without rtt",
+			mode: config.FastestScatterType,
+			rtts: []time.Duration{0, 20 * time.Millisecond, 0},
+			want: []int{0, 6, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := channel.NewScatterer(tt.mode, tt.redundancy)
+			outputs := newOutputs(d, 3, tt.weights...)
+			for i, rtt := range tt.rtts {
+				d.SetOutputRTT(outputs[i], rtt)
+			}
+			if got := outputs.scatter(d, 6); !slices.Equal(got, tt.want) {
+				t.Errorf("scattered %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestScattererWeightedSmooth spreads the picks of a heavy output instead of
+// sending them in a burst.
+func TestScattererWeightedSmooth(t *testing.T) {
+	d := channel.NewScatterer(config.WeightedScatterType, 0)
+	outputs := newOutputs(d, 3, 5, 1, 1)
+	var picks []int
+	for range 7 {
+		counts := outputs.scatter(d, 1)
+		picks = append(picks, slices.Index(counts, 1))
+	}
+	if want := []int{0, 0, 1, 0, 2, 0, 0}; !slices.Equal(picks, want) {
+		t.Errorf("picked %v, want %v", picks, want)
+	}
+}
+
+// TestScattererFastestHysteresis keeps the fastest output until another one
+// is faster by more than the hysteresis.
+func TestScattererFastestHysteresis(t *testing.T) {
+	d := channel.NewScatterer(config.FastestScatterType, 0)
+	outputs := newOutputs(d, 2)
+	d.SetOutputRTT(outputs[0], 100*time.Millisecond)
+	d.SetOutputRTT(outputs[1], 120*time.Millisecond)
+	steps := []struct {
+		rtt  time.Duration // of outputs[1]
+		want []int
+	}{
+		{95 * time.Millisecond, []int{1, 0}},  // within 10%
+		{91 * time.Millisecond, []int{1, 0}},  // still within
+		{85 * time.Millisecond, []int{0, 1}},  // faster by 15%
+		{90 * time.Millisecond, []int{0, 1}},  // kept, as 100ms is slower
+		{115 * time.Millisecond, []int{1, 0}}, // 115ms * 0.9 is slower than 100ms
+	}
+	for _, step := range steps {
+		d.SetOutputRTT(outputs[1], step.rtt)
+		if got := outputs.scatter(d, 1); !slices.Equal(got, step.want) {
+			t.Errorf("with rtt %v scattered %v, want %v", step.rtt, got, step.want)
+		}
+	}
+}
+
+// TestScattererFailover keeps the primary output until it fails, and does
+// not fail back once it recovers.
+func TestScattererFailover(t *testing.T) {
+	d := channel.NewScatterer(config.FailoverScatterType, 0)
+	outputs := newOutputs(d, 3)
+	steps := []struct {
+		change func()
+		want   []int
+	}{
+		{func() {}, []int{1, 0, 0}},
+		{func() { d.SetOutputAlive(outputs[0], false) }, []int{0, 1, 0}},
+		{func() { d.SetOutputAlive(outputs[0], true) }, []int{0, 1, 0}},
+		{func() { d.SetOutputLossy(outputs[1], true) }, []int{1, 0, 0}},
+		{func() { d.RemoveOutput(outputs[0]) }, []int{0, 0, 1}},
+	}
+	for i, step := range steps {
+		step.change()
+		if got := outputs.scatter(d, 1); !slices.Equal(got, step.want) {
+			t.Errorf("step %d scattered %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+// TestScattererTiers skips outputs in a worse tier than the best one, where
+// tiers are fine, standby, lossy and dead, from the best.
+func TestScattererTiers(t *testing.T) {
+	d := channel.NewScatterer(config.ConcurrentScatterType, 0)
+	outputs := newOutputs(d, 4)
+	d.SetOutputStandby(outputs[1], true)
+	d.SetOutputLossy(outputs[2], true)
+	d.SetOutputAlive(outputs[3], false)
+	steps := []struct {
+		change func()
+		want   []int
+	}{
+		{func() {}, []int{1, 0, 0, 0}},
+		{func() { d.SetOutputAlive(outputs[0], false) }, []int{0, 1, 0, 0}},
+		{func() { d.SetOutputLossy(outputs[1], true) }, []int{0, 1, 1, 0}},
+		{func() { d.SetOutputAlive(outputs[1], false) }, []int{0, 0, 1, 0}},
+		{func() { d.SetOutputAlive(outputs[2], false) }, []int{1, 1, 1, 1}}, // nothing better
+		{func() { d.SetOutputAlive(outputs[3], true) }, []int{0, 0, 0, 1}},
+	}
+	for i, step := range steps {
+		step.change()
+		if got := outputs.scatter(d, 1); !slices.Equal(got, step.want) {
+			t.Errorf("step %d scattered %v, want %v", i, got, step.want)
+		}
+	}
+}
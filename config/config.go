@@ -1,11 +1,16 @@
 package config
 
-import "time"
+import (
+	"hash/fnv"
+	"time"
+)
 
 type AppMode int
 type ConnectionType int
 type ScatterType int
 type TrafficType int
+type OverflowType int
+type QuotaAction int
 
 const (
 	NotDefined AppMode = iota
@@ -25,6 +30,11 @@ const (
 	NotDefinedScatterType ScatterType = iota
 	RoundRobinScatterType
 	ConcurrentScatterType
+	WeightedScatterType
+	FastestScatterType   // lowest-latency path only
+	FastestNScatterType  // duplicate onto the Redundancy lowest-latency paths
+	RedundantScatterType // duplicate onto Redundancy paths in rotation
+	FailoverScatterType  // one path only, kept until it fails
 )
 
 const (
@@ -33,27 +43,102 @@ const (
 	DownTrafficType
 )
 
+const (
+	DropNewestOverflowType OverflowType = iota // drop what cannot be queued
+	DropOldestOverflowType                     // drop the head of the queue to make room
+	BlockOverflowType                          // wait for room up to a timeout, then drop
+)
+
+const (
+	FailoverQuotaAction QuotaAction = iota // keep the relay as a backup, used only when no other is alive
+	DisableQuotaAction                     // stop carrying traffic on the relay
+)
+
+// QuotaPolicy limits the traffic of a relay in both directions per calendar
+// day and month of the local time.
+type QuotaPolicy struct {
+	Daily   uint64 // bytes, 0 for unlimited
+	Monthly uint64 // bytes, 0 for unlimited
+	Action  QuotaAction
+}
+
+// OverflowPolicy tells what to do when a queue of packets is full.
+type OverflowPolicy struct {
+	Type    OverflowType
+	Timeout time.Duration // only used by BlockOverflowType
+}
+
 type Config struct {
-	Mode           AppMode
-	ListenAddr     string
-	RemoteAddr     string        // not necessary in ClientMode
-	RelayServers   []RelayServer // only used in ClientMode
-	RelayType      RelayType     // only used in RelayMode
-	ChannelSize    int
-	ReportInterval time.Duration
-	ReconnectDelay time.Duration // only used in ClientMode
-	UDPTimeout     time.Duration // only used in ServerMode
-	ScatterType    ScatterType
-	MaxUDPSize     uint16
-	EnableGRO      bool
-	EnableGSO      bool
+	Mode              AppMode
+	ListenAddr        string
+	RemoteAddr        string        // not necessary in ClientMode
+	RelayServers      []RelayServer // only used in ClientMode
+	Services          []Service     // not used in RelayMode, at least one
+	RelayType         RelayType     // only used in RelayMode
+	ChannelSize       int
+	Overflow          OverflowPolicy
+	RateLimit         float64       // bytes per second of every path, 0 for unlimited
+	DedupTimeout      time.Duration // how long packet ids are remembered for deduplication
+	DedupWindow       int           // max number of packet ids remembered for deduplication
+	ReorderDelay      time.Duration // max time to hold packets for reordering, 0 for disabled
+	QuotaFile         string        // where traffic of relays is kept across restarts, empty for not kept
+	QuotaSaveInterval time.Duration // only used in ClientMode
+	ReportInterval    time.Duration
+	MetricsAddr       string        // http address serving /metrics, empty for disabled
+	APIAddr           string        // http address or unix:path serving the management api, empty for disabled
+	APIToken          string        // bearer token required by the api, empty for loopback or unix socket only
+	ReconnectDelay    time.Duration // only used in ClientMode
+	UDPTimeout        time.Duration // only used in ServerMode
+	HeartbeatInterval time.Duration // 0 for disabled, the peer sends as often as the shorter interval of both ends
+	HeartbeatTimeout  time.Duration // a path is dead without heartbeats for this long, shorter by default in failover mode
+	ProbeInterval     time.Duration // 0 for disabled
+	CongestionControl bool          // pace paths to the capacity learned from feedback
+	FeedbackInterval  time.Duration // how often the receiving end of a path reports to the sender
+	FailoverLoss      float64       // loss ratio above which a path is skipped if others are fine, 0 for disabled
+	ScatterType       ScatterType
+	Redundancy        int // number of paths each packet is sent on, for modes that use it
+	FECDataShards     int // 0 for disabled
+	FECParityShards   int
+	PSK               string // pre-shared key, empty for disabled encryption
+	Cipher            string // aead method used with PSK
+	MaxUDPSize        uint16
+	EnableGRO         bool
+	EnableGSO         bool
 }
 
 type RelayServer struct {
-	Address  string
-	ConnType ConnectionType
-	Weight   int
-	Traffic  TrafficType
+	Address   string
+	ConnType  ConnectionType
+	Weight    int  // only used in weighted scatter mode
+	Backup    bool // used only when no other relay is alive
+	Traffic   TrafficType
+	Overflow  OverflowPolicy
+	RateLimit float64 // bytes per second, 0 for unlimited
+	Quota     QuotaPolicy
+}
+
+// Service is a udp service forwarded through the tunnel. Services are
+// matched between client and server by name.
+type Service struct {
+	Name string
+	ID   uint16 // derived from Name, 0 for the default service
+	Addr string // listen address in ClientMode, remote address in ServerMode
+}
+
+// ServiceID derives the id carried in the tunnel from a service name.
+func ServiceID(name string) uint16 {
+	if name == "" {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	sum := h.Sum32()
+	id := uint16(sum) ^ uint16(sum>>16)
+	if id == 0 {
+		// reserved for the default service
+		id = 1
+	}
+	return id
 }
 
 type RelayType struct {
@@ -80,6 +165,29 @@ func ScatterTypeToString(scatterType ScatterType) string {
 		return "round-robin"
 	case ConcurrentScatterType:
 		return "concurrent"
+	case WeightedScatterType:
+		return "weighted"
+	case FastestScatterType:
+		return "fastest"
+	case FastestNScatterType:
+		return "fastest-n"
+	case RedundantScatterType:
+		return "redundant"
+	case FailoverScatterType:
+		return "failover"
+	default:
+		return "unknown"
+	}
+}
+
+func OverflowTypeToString(overflowType OverflowType) string {
+	switch overflowType {
+	case DropNewestOverflowType:
+		return "drop-newest"
+	case DropOldestOverflowType:
+		return "drop-oldest"
+	case BlockOverflowType:
+		return "block"
 	default:
 		return "unknown"
 	}
@@ -97,3 +205,14 @@ func TrafficTypeToString(trafficType TrafficType) string {
 		return "unknown"
 	}
 }
+
+func QuotaActionToString(quotaAction QuotaAction) string {
+	switch quotaAction {
+	case FailoverQuotaAction:
+		return "failover"
+	case DisableQuotaAction:
+		return "disable"
+	default:
+		return "unknown"
+	}
+}
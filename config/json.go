@@ -5,30 +5,67 @@ import (
 	"fmt"
 	"os"
 	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
 )
 
 // JSONConfig represents the JSON structure that matches Config
 type JSONConfig struct {
-	Mode           string            `json:"mode"`
-	ListenAddr     string            `json:"listen_addr"`
-	RemoteAddr     string            `json:"remote_addr,omitempty"`
-	RelayServers   []JSONRelayServer `json:"relay_servers,omitempty"`
-	RelayType      *JSONRelayType    `json:"relay_type,omitempty"`
-	ChannelSize    *int              `json:"channel_size,omitempty"`
-	ReportInterval *string           `json:"report_interval,omitempty"`
-	ReconnectDelay *string           `json:"reconnect_delay,omitempty"`
-	UDPTimeout     *string           `json:"udp_timeout,omitempty"`
-	ScatterType    *string           `json:"scatter_type,omitempty"`
-	MaxUDPSize     *uint16           `json:"max_udp_size,omitempty"`
-	EnableGSO      *bool             `json:"enable_gso,omitempty"`
-	EnableGRO      *bool             `json:"enable_gro,omitempty"`
+	Mode              string            `json:"mode"`
+	ListenAddr        string            `json:"listen_addr"`
+	RemoteAddr        string            `json:"remote_addr,omitempty"`
+	RelayServers      []JSONRelayServer `json:"relay_servers,omitempty"`
+	Services          []JSONService     `json:"services,omitempty"`
+	RelayType         *JSONRelayType    `json:"relay_type,omitempty"`
+	ChannelSize       *int              `json:"channel_size,omitempty"`
+	Overflow          *string           `json:"overflow,omitempty"`
+	OverflowTimeout   *string           `json:"overflow_timeout,omitempty"`
+	RateLimit         *float64          `json:"rate_limit,omitempty"` // Mbps
+	DedupTimeout      *string           `json:"dedup_timeout,omitempty"`
+	DedupWindow       *int              `json:"dedup_window,omitempty"`
+	ReorderDelay      *string           `json:"reorder_delay,omitempty"`
+	QuotaFile         *string           `json:"quota_file,omitempty"`
+	QuotaSaveInterval *string           `json:"quota_save_interval,omitempty"`
+	ReportInterval    *string           `json:"report_interval,omitempty"`
+	MetricsAddr       *string           `json:"metrics_addr,omitempty"`
+	APIAddr           *string           `json:"api_addr,omitempty"`
+	APIToken          string            `json:"api_token,omitempty"`
+	ReconnectDelay    *string           `json:"reconnect_delay,omitempty"`
+	UDPTimeout        *string           `json:"udp_timeout,omitempty"`
+	HeartbeatInterval *string           `json:"heartbeat_interval,omitempty"`
+	HeartbeatTimeout  *string           `json:"heartbeat_timeout,omitempty"`
+	ProbeInterval     *string           `json:"probe_interval,omitempty"`
+	CongestionControl *bool             `json:"congestion_control,omitempty"`
+	FeedbackInterval  *string           `json:"feedback_interval,omitempty"`
+	FailoverLoss      *float64          `json:"failover_loss,omitempty"`
+	ScatterType       *string           `json:"scatter_type,omitempty"`
+	Redundancy        *int              `json:"redundancy,omitempty"`
+	FECDataShards     *int              `json:"fec_data_shards,omitempty"`
+	FECParityShards   *int              `json:"fec_parity_shards,omitempty"`
+	PSK               string            `json:"psk,omitempty"`
+	Cipher            *string           `json:"cipher,omitempty"`
+	MaxUDPSize        *uint16           `json:"max_udp_size,omitempty"`
+	EnableGSO         *bool             `json:"enable_gso,omitempty"`
+	EnableGRO         *bool             `json:"enable_gro,omitempty"`
 }
 
 type JSONRelayServer struct {
-	Addr     string  `json:"addr"`
-	ConnType string  `json:"conn_type"`
-	Weight   *int    `json:"weight,omitempty"`
-	Traffic  *string `json:"traffic,omitempty"`
+	Addr            string   `json:"addr"`
+	ConnType        string   `json:"conn_type"`
+	Weight          *int     `json:"weight,omitempty"`
+	Backup          *bool    `json:"backup,omitempty"`
+	Traffic         *string  `json:"traffic,omitempty"`
+	Overflow        *string  `json:"overflow,omitempty"`
+	OverflowTimeout *string  `json:"overflow_timeout,omitempty"`
+	RateLimit       *float64 `json:"rate_limit,omitempty"`    // Mbps
+	DailyQuota      *float64 `json:"daily_quota,omitempty"`   // GB
+	MonthlyQuota    *float64 `json:"monthly_quota,omitempty"` // GB
+	QuotaAction     *string  `json:"quota_action,omitempty"`
+}
+
+type JSONService struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
 }
 
 type JSONRelayType struct {
@@ -38,9 +75,47 @@ type JSONRelayType struct {
 
 const defaultWeight = 1
 const defaultChannelSize = 64
+const defaultOverflowType = DropNewestOverflowType
+const defaultOverflowTimeout = 10 * time.Millisecond
+const defaultRateLimit = 0
+const defaultDedupTimeout = 2 * time.Second
+const defaultDedupWindow = 1 << 20
+const maxDedupWindow = 1 << 24
+const defaultReorderDelay = 0 * time.Second
+const defaultRedundancy = 2
+const defaultFECDataShards = 0
+const defaultFECParityShards = 1
+const maxFECDataShards = 64
+const maxFECParityShards = 16
+
+// A parity packet carries a shard as large as the largest data payload of
+// its group, after the shard header with conn seq, the parity header, the
+// packet ids of the group and a sealed header with sequence. It has to fit
+// a buffer, as data packets do.
+const parityOverhead = 21 + 4 + 28 + 2 + 8 + 4
+const parityOverheadPerShard = 4
+const defaultCipher = "chacha20-poly1305"
+const defaultQuotaFile = ""
+const defaultQuotaSaveInterval = 1 * time.Minute
+const defaultQuotaAction = FailoverQuotaAction
 const defaultReportInterval = 0 * time.Second
+const defaultMetricsAddr = ""
+const defaultAPIAddr = ""
 const defaultReconnectDelay = 5 * time.Second
 const defaultUDPTimeout = 10 * time.Minute
+const defaultHeartbeatInterval = 1 * time.Second
+const defaultHeartbeatTimeout = 5 * time.Second
+
+// Failover mode switches paths on heartbeat timeout, so that it detects a
+// dead path in a few hundred milliseconds by default. The interval is told
+// to the peer, which sends heartbeats as often.
+const defaultFailoverHeartbeatInterval = 100 * time.Millisecond
+const defaultFailoverHeartbeatTimeout = 500 * time.Millisecond
+const defaultProbeInterval = 1 * time.Second
+const defaultCongestionControl = false
+const defaultFeedbackInterval = 100 * time.Millisecond
+const defaultFailoverLoss = 0.0
+const defaultBackup = false
 const defaultMaxUDPSize = uint16(1472)
 const defaultEnableGRO = true
 const defaultEnableGSO = true
@@ -80,6 +155,95 @@ func convertJSONConfig(jc JSONConfig) (*Config, error) {
 		channelSize = *jc.ChannelSize
 	}
 
+	dedupWindow := defaultDedupWindow
+	if jc.DedupWindow != nil {
+		dedupWindow = *jc.DedupWindow
+	}
+	if dedupWindow < 1 || dedupWindow > maxDedupWindow {
+		return nil, fmt.Errorf("invalid dedup window: %d", dedupWindow)
+	}
+
+	redundancy := defaultRedundancy
+	if jc.Redundancy != nil {
+		redundancy = *jc.Redundancy
+	}
+	if redundancy < 1 {
+		return nil, fmt.Errorf("invalid redundancy: %d", redundancy)
+	}
+
+	fecDataShards := defaultFECDataShards
+	if jc.FECDataShards != nil {
+		fecDataShards = *jc.FECDataShards
+	}
+	if fecDataShards < 0 || fecDataShards > maxFECDataShards {
+		return nil, fmt.Errorf("invalid fec data shards: %d", fecDataShards)
+	}
+
+	fecParityShards := defaultFECParityShards
+	if jc.FECParityShards != nil {
+		fecParityShards = *jc.FECParityShards
+	}
+	if fecParityShards < 1 || fecParityShards > maxFECParityShards {
+		return nil, fmt.Errorf("invalid fec parity shards: %d", fecParityShards)
+	}
+
+	cipher := defaultCipher
+	if jc.Cipher != nil {
+		cipher = *jc.Cipher
+	}
+	if cipher != "chacha20-poly1305" && cipher != "aes-256-gcm" {
+		return nil, fmt.Errorf("invalid cipher: %s", cipher)
+	}
+
+	overflow, err := convertJSONOverflow(jc.Overflow, jc.OverflowTimeout, OverflowPolicy{
+		Type:    defaultOverflowType,
+		Timeout: defaultOverflowTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dedupTimeout := defaultDedupTimeout
+	if jc.DedupTimeout != nil {
+		d, err := time.ParseDuration(*jc.DedupTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dedup timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid dedup timeout: %s", d)
+		}
+		dedupTimeout = d
+	}
+
+	reorderDelay := defaultReorderDelay
+	if jc.ReorderDelay != nil {
+		d, err := time.ParseDuration(*jc.ReorderDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reorder delay: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid reorder delay: %s", d)
+		}
+		reorderDelay = d
+	}
+
+	quotaFile := defaultQuotaFile
+	if jc.QuotaFile != nil {
+		quotaFile = *jc.QuotaFile
+	}
+
+	quotaSaveInterval := defaultQuotaSaveInterval
+	if jc.QuotaSaveInterval != nil {
+		d, err := time.ParseDuration(*jc.QuotaSaveInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota save interval: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid quota save interval: %s", d)
+		}
+		quotaSaveInterval = d
+	}
+
 	reportInterval := defaultReportInterval
 	if jc.ReportInterval != nil {
 		d, err := time.ParseDuration(*jc.ReportInterval)
@@ -89,6 +253,16 @@ func convertJSONConfig(jc JSONConfig) (*Config, error) {
 		reportInterval = d
 	}
 
+	metricsAddr := defaultMetricsAddr
+	if jc.MetricsAddr != nil {
+		metricsAddr = *jc.MetricsAddr
+	}
+
+	apiAddr := defaultAPIAddr
+	if jc.APIAddr != nil {
+		apiAddr = *jc.APIAddr
+	}
+
 	reconnectDelay := defaultReconnectDelay
 	if jc.ReconnectDelay != nil {
 		d, err := time.ParseDuration(*jc.ReconnectDelay)
@@ -107,10 +281,76 @@ func convertJSONConfig(jc JSONConfig) (*Config, error) {
 		udpTimeout = d
 	}
 
+	scatterType := convertJSONScatterType(jc.ScatterType)
+
+	heartbeatInterval := defaultHeartbeatInterval
+	if scatterType == FailoverScatterType {
+		heartbeatInterval = defaultFailoverHeartbeatInterval
+	}
+	if jc.HeartbeatInterval != nil {
+		d, err := time.ParseDuration(*jc.HeartbeatInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid heartbeat interval: %w", err)
+		}
+		heartbeatInterval = d
+	}
+
+	heartbeatTimeout := defaultHeartbeatTimeout
+	if scatterType == FailoverScatterType {
+		heartbeatTimeout = defaultFailoverHeartbeatTimeout
+	}
+	if jc.HeartbeatTimeout != nil {
+		d, err := time.ParseDuration(*jc.HeartbeatTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid heartbeat timeout: %w", err)
+		}
+		heartbeatTimeout = d
+	}
+	if heartbeatInterval > 0 && heartbeatTimeout <= heartbeatInterval {
+		return nil, fmt.Errorf("heartbeat timeout %v is not longer than heartbeat interval %v", heartbeatTimeout, heartbeatInterval)
+	}
+
+	probeInterval := defaultProbeInterval
+	if jc.ProbeInterval != nil {
+		d, err := time.ParseDuration(*jc.ProbeInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe interval: %w", err)
+		}
+		probeInterval = d
+	}
+
+	congestionControl := defaultCongestionControl
+	if jc.CongestionControl != nil {
+		congestionControl = *jc.CongestionControl
+	}
+
+	feedbackInterval := defaultFeedbackInterval
+	if jc.FeedbackInterval != nil {
+		d, err := time.ParseDuration(*jc.FeedbackInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feedback interval: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid feedback interval: %s", d)
+		}
+		feedbackInterval = d
+	}
+
+	failoverLoss := defaultFailoverLoss
+	if jc.FailoverLoss != nil {
+		failoverLoss = *jc.FailoverLoss
+	}
+	if failoverLoss < 0 || failoverLoss >= 1 {
+		return nil, fmt.Errorf("invalid failover loss: %g", failoverLoss)
+	}
+
 	maxUDPSize := defaultMaxUDPSize
 	if jc.MaxUDPSize != nil {
 		maxUDPSize = *jc.MaxUDPSize
 	}
+	if fecDataShards > 0 && int(maxUDPSize)+parityOverhead+parityOverheadPerShard*fecDataShards > buffer.BUFFER_SIZE {
+		return nil, fmt.Errorf("max udp size too large for fec with %d data shards: %d", fecDataShards, maxUDPSize)
+	}
 
 	enableGRO := defaultEnableGRO
 	if jc.EnableGRO != nil {
@@ -122,19 +362,56 @@ func convertJSONConfig(jc JSONConfig) (*Config, error) {
 		enableGSO = *jc.EnableGSO
 	}
 
+	rateLimit, err := convertJSONRateLimit(jc.RateLimit, defaultRateLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	relayServers, err := convertJSONRelayServers(jc.RelayServers, overflow, rateLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := convertJSONServices(mode, jc)
+	if err != nil {
+		return nil, err
+	}
+
 	config := &Config{
-		Mode:           mode,
-		ListenAddr:     jc.ListenAddr,
-		RemoteAddr:     jc.RemoteAddr,
-		RelayServers:   convertJSONRelayServers(jc.RelayServers),
-		ChannelSize:    channelSize,
-		ReportInterval: reportInterval,
-		ReconnectDelay: reconnectDelay,
-		ScatterType:    convertJSONScatterType(jc.ScatterType),
-		UDPTimeout:     udpTimeout,
-		MaxUDPSize:     maxUDPSize,
-		EnableGRO:      enableGRO,
-		EnableGSO:      enableGSO,
+		Mode:              mode,
+		ListenAddr:        jc.ListenAddr,
+		RemoteAddr:        jc.RemoteAddr,
+		RelayServers:      relayServers,
+		Services:          services,
+		ChannelSize:       channelSize,
+		Overflow:          overflow,
+		RateLimit:         rateLimit,
+		DedupTimeout:      dedupTimeout,
+		DedupWindow:       dedupWindow,
+		ReorderDelay:      reorderDelay,
+		QuotaFile:         quotaFile,
+		QuotaSaveInterval: quotaSaveInterval,
+		ReportInterval:    reportInterval,
+		MetricsAddr:       metricsAddr,
+		APIAddr:           apiAddr,
+		APIToken:          jc.APIToken,
+		ReconnectDelay:    reconnectDelay,
+		ScatterType:       scatterType,
+		Redundancy:        redundancy,
+		FECDataShards:     fecDataShards,
+		FECParityShards:   fecParityShards,
+		PSK:               jc.PSK,
+		Cipher:            cipher,
+		UDPTimeout:        udpTimeout,
+		HeartbeatInterval: heartbeatInterval,
+		HeartbeatTimeout:  heartbeatTimeout,
+		ProbeInterval:     probeInterval,
+		CongestionControl: congestionControl,
+		FeedbackInterval:  feedbackInterval,
+		FailoverLoss:      failoverLoss,
+		MaxUDPSize:        maxUDPSize,
+		EnableGRO:         enableGRO,
+		EnableGSO:         enableGSO,
 	}
 
 	if jc.RelayType != nil {
@@ -144,21 +421,163 @@ func convertJSONConfig(jc JSONConfig) (*Config, error) {
 	return config, nil
 }
 
-func convertJSONRelayServers(jsrs []JSONRelayServer) []RelayServer {
+// ParseRelayServer parses a relay server as in relay_servers, taking the
+// defaults of cfg.
+func ParseRelayServer(data []byte, cfg *Config) (RelayServer, error) {
+	var jsr JSONRelayServer
+	if err := json.Unmarshal(data, &jsr); err != nil {
+		return RelayServer{}, fmt.Errorf("parsing JSON: %w", err)
+	}
+	rs, err := convertJSONRelayServers([]JSONRelayServer{jsr}, cfg.Overflow, cfg.RateLimit)
+	if err != nil {
+		return RelayServer{}, err
+	}
+	if rs[0].ConnType == NotDefinedConnectionType {
+		return RelayServer{}, fmt.Errorf("invalid relay %s: connection type not defined", jsr.Addr)
+	}
+	return rs[0], nil
+}
+
+func convertJSONRelayServers(jsrs []JSONRelayServer, defaultOverflow OverflowPolicy, defaultRateLimit float64) ([]RelayServer, error) {
 	rs := make([]RelayServer, len(jsrs))
 	for i, jsr := range jsrs {
 		weight := defaultWeight
 		if jsr.Weight != nil {
 			weight = *jsr.Weight
 		}
+		if weight < 1 {
+			return nil, fmt.Errorf("invalid weight for relay %s: %d", jsr.Addr, weight)
+		}
+		backup := defaultBackup
+		if jsr.Backup != nil {
+			backup = *jsr.Backup
+		}
+		overflow, err := convertJSONOverflow(jsr.Overflow, jsr.OverflowTimeout, defaultOverflow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay %s: %w", jsr.Addr, err)
+		}
+		rateLimit, err := convertJSONRateLimit(jsr.RateLimit, defaultRateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay %s: %w", jsr.Addr, err)
+		}
+		quota, err := convertJSONQuota(jsr.DailyQuota, jsr.MonthlyQuota, jsr.QuotaAction)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay %s: %w", jsr.Addr, err)
+		}
 		rs[i] = RelayServer{
-			Address:  jsr.Addr,
-			ConnType: convertJSONConnectionType(jsr.ConnType),
-			Weight:   weight,
-			Traffic:  convertJSONTrafficType(jsr.Traffic),
+			Address:   jsr.Addr,
+			ConnType:  convertJSONConnectionType(jsr.ConnType),
+			Weight:    weight,
+			Backup:    backup,
+			Traffic:   convertJSONTrafficType(jsr.Traffic),
+			Overflow:  overflow,
+			RateLimit: rateLimit,
+			Quota:     quota,
 		}
 	}
-	return rs
+	return rs, nil
+}
+
+// convertJSONServices falls back to a default service from listen_addr in
+// client mode or remote_addr in server mode if no service is given.
+func convertJSONServices(mode AppMode, jc JSONConfig) ([]Service, error) {
+	if mode == RelayMode {
+		return nil, nil
+	}
+	if len(jc.Services) == 0 {
+		addr := jc.RemoteAddr
+		if mode == ClientMode {
+			addr = jc.ListenAddr
+		}
+		return []Service{{Addr: addr}}, nil
+	}
+	services := make([]Service, len(jc.Services))
+	names := make(map[uint16]string, len(jc.Services))
+	for i, js := range jc.Services {
+		if js.Name == "" {
+			return nil, fmt.Errorf("invalid service: empty name")
+		}
+		if js.Addr == "" {
+			return nil, fmt.Errorf("invalid service %s: empty addr", js.Name)
+		}
+		id := ServiceID(js.Name)
+		if name, ok := names[id]; ok {
+			return nil, fmt.Errorf("invalid service %s: conflicts with %s", js.Name, name)
+		}
+		names[id] = js.Name
+		services[i] = Service{
+			Name: js.Name,
+			ID:   id,
+			Addr: js.Addr,
+		}
+	}
+	return services, nil
+}
+
+// convertJSONOverflow overrides the fields of policy that are given.
+func convertJSONOverflow(overflowType *string, timeout *string, policy OverflowPolicy) (OverflowPolicy, error) {
+	if overflowType != nil {
+		switch *overflowType {
+		case "drop-newest":
+			policy.Type = DropNewestOverflowType
+		case "drop-oldest":
+			policy.Type = DropOldestOverflowType
+		case "block":
+			policy.Type = BlockOverflowType
+		default:
+			return policy, fmt.Errorf("invalid overflow: %s", *overflowType)
+		}
+	}
+	if timeout != nil {
+		d, err := time.ParseDuration(*timeout)
+		if err != nil {
+			return policy, fmt.Errorf("invalid overflow timeout: %w", err)
+		}
+		if d <= 0 {
+			return policy, fmt.Errorf("invalid overflow timeout: %s", d)
+		}
+		policy.Timeout = d
+	}
+	return policy, nil
+}
+
+// convertJSONRateLimit converts a rate limit in Mbps to bytes per second.
+func convertJSONRateLimit(mbps *float64, rateLimit float64) (float64, error) {
+	if mbps == nil {
+		return rateLimit, nil
+	}
+	if *mbps < 0 {
+		return 0, fmt.Errorf("invalid rate limit: %g", *mbps)
+	}
+	return *mbps * 1000 * 1000 / 8, nil
+}
+
+// convertJSONQuota converts quotas in GB to bytes.
+func convertJSONQuota(daily *float64, monthly *float64, action *string) (QuotaPolicy, error) {
+	policy := QuotaPolicy{Action: defaultQuotaAction}
+	if daily != nil {
+		if *daily < 0 {
+			return policy, fmt.Errorf("invalid daily quota: %g", *daily)
+		}
+		policy.Daily = uint64(*daily * 1000 * 1000 * 1000)
+	}
+	if monthly != nil {
+		if *monthly < 0 {
+			return policy, fmt.Errorf("invalid monthly quota: %g", *monthly)
+		}
+		policy.Monthly = uint64(*monthly * 1000 * 1000 * 1000)
+	}
+	if action != nil {
+		switch *action {
+		case "failover":
+			policy.Action = FailoverQuotaAction
+		case "disable":
+			policy.Action = DisableQuotaAction
+		default:
+			return policy, fmt.Errorf("invalid quota action: %s", *action)
+		}
+	}
+	return policy, nil
 }
 
 func convertJSONRelayType(jrt JSONRelayType) RelayType {
@@ -181,6 +600,11 @@ func convertJSONConnectionType(connType string) ConnectionType {
 	}
 }
 
+// ParseScatterType parses a scatter type as in scatter_type.
+func ParseScatterType(scatterType string) ScatterType {
+	return convertJSONScatterType(&scatterType)
+}
+
 func convertJSONScatterType(scatterType *string) ScatterType {
 	if scatterType == nil {
 		return NotDefinedScatterType
@@ -190,6 +614,16 @@ func convertJSONScatterType(scatterType *string) ScatterType {
 		return RoundRobinScatterType
 	case "concurrent":
 		return ConcurrentScatterType
+	case "weighted":
+		return WeightedScatterType
+	case "fastest":
+		return FastestScatterType
+	case "fastest-n":
+		return FastestNScatterType
+	case "redundant":
+		return RedundantScatterType
+	case "failover":
+		return FailoverScatterType
 	default:
 		return NotDefinedScatterType
 	}
@@ -0,0 +1,116 @@
+package config_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/channel"
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+func loadConfig(t *testing.T, data string) (*config.Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return config.LoadFromFile(path)
+}
+
+func TestHeartbeatDefaults(t *testing.T) {
+	tests := []struct {
+		name         string
+		extra        string
+		wantInterval time.Duration
+		wantTimeout  time.Duration
+		wantErr      bool
+	}{
+		{name: "default", extra: `"scatter_type":"round-robin"`, wantInterval: time.Second, wantTimeout: 5 * time.Second},
+		{name: "failover", extra: `"scatter_type":"failover"`, wantInterval: 100 * time.Millisecond, wantTimeout: 500 * time.Millisecond},
+		{
+			name:         "failover with timeout",
+			extra:        `"scatter_type":"failover","heartbeat_timeout":"2s"`,
+			wantInterval: 100 * time.Millisecond,
+			wantTimeout:  2 * time.Second,
+		},
+		{name: "timeout within interval", extra: `"scatter_type":"failover","heartbeat_interval":"1s"`, wantErr: true},
+		{
+			name:         "disabled",
+			extra:        `"scatter_type":"failover","heartbeat_interval":"0s","heartbeat_timeout":"0s"`,
+			wantInterval: 0,
+			wantTimeout:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(t, `{"mode":"server","listen_addr":"[::1]:9001","remote_addr":"[::1]:9003",`+tt.extra+`}`)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loaded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.HeartbeatInterval != tt.wantInterval || cfg.HeartbeatTimeout != tt.wantTimeout {
+				t.Errorf("heartbeat every %v, timeout %v, want %v, %v",
+					cfg.HeartbeatInterval, cfg.HeartbeatTimeout, tt.wantInterval, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+// TestMaxUDPSizeFEC accepts a max udp size only as large as parity packets
+// of the largest payloads fit a buffer.
+func TestMaxUDPSizeFEC(t *testing.T) {
+	const dataShards, parityShards = 64, 16
+	load := func(maxUDPSize int) (*config.Config, error) {
+		return loadConfig(t, fmt.Sprintf(`{"mode":"server","listen_addr":"[::1]:9001","remote_addr":"[::1]:9003",`+
+			`"fec_data_shards":%d,"fec_parity_shards":%d,"max_udp_size":%d}`, dataShards, parityShards, maxUDPSize))
+	}
+	largest := 0
+	for size := buffer.BUFFER_SIZE; size > 0; size-- {
+		if _, err := load(size); err == nil {
+			largest = size
+			break
+		}
+	}
+	if largest < 60000 {
+		t.Fatalf("largest max udp size %d", largest)
+	}
+	cfg, err := load(largest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cipher, err := packet.NewCipher(cfg.Cipher, "psk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outputs, parity int
+	e := channel.NewFECEncoder(cfg.FECDataShards, cfg.FECParityShards, 1, cipher, func(pBuffer_ buffer.ArgPtr[*buffer.PackedBuffer]) {
+		pBuffer := pBuffer_.ToOwned()
+		defer pBuffer.Release()
+		outputs++
+		parity += len(pBuffer.Ptr.SubPackets)
+	})
+	packets := make([]*packet.Packet, dataShards)
+	for i := range packets {
+		packets[i] = &packet.Packet{
+			Buffer:   make([]byte, cfg.MaxUDPSize),
+			PacketID: uint32(i),
+			ConnSeq:  uint32(i),
+			Flags:    packet.SequencedFlag,
+		}
+	}
+	e.Encode(packets)
+	if parity != parityShards || outputs != parityShards {
+		t.Errorf("sent %d parity packets in %d buffers, want %d in %d", parity, outputs, parityShards, parityShards)
+	}
+}
@@ -0,0 +1,46 @@
+package config
+
+import "slices"
+
+// Reload merges cfg into the running config for a reload without restarting.
+// Relay servers, the scatter type, rate limits, overflow and timeouts are
+// taken from cfg, and apply to paths and sessions from then on. Settings
+// that need a restart are kept from running, and returned by name if cfg
+// changes them.
+func Reload(running *Config, cfg *Config) (*Config, []string) {
+	merged := *cfg
+	var kept []string
+	keep(&kept, "mode", &merged.Mode, running.Mode)
+	keep(&kept, "listen_addr", &merged.ListenAddr, running.ListenAddr)
+	keep(&kept, "remote_addr", &merged.RemoteAddr, running.RemoteAddr)
+	if !slices.Equal(merged.Services, running.Services) {
+		kept = append(kept, "services")
+		merged.Services = running.Services
+	}
+	keep(&kept, "relay_type", &merged.RelayType, running.RelayType)
+	keep(&kept, "channel_size", &merged.ChannelSize, running.ChannelSize)
+	keep(&kept, "dedup_timeout", &merged.DedupTimeout, running.DedupTimeout)
+	keep(&kept, "dedup_window", &merged.DedupWindow, running.DedupWindow)
+	keep(&kept, "reorder_delay", &merged.ReorderDelay, running.ReorderDelay)
+	keep(&kept, "quota_file", &merged.QuotaFile, running.QuotaFile)
+	keep(&kept, "quota_save_interval", &merged.QuotaSaveInterval, running.QuotaSaveInterval)
+	keep(&kept, "report_interval", &merged.ReportInterval, running.ReportInterval)
+	keep(&kept, "metrics_addr", &merged.MetricsAddr, running.MetricsAddr)
+	keep(&kept, "api_addr", &merged.APIAddr, running.APIAddr)
+	keep(&kept, "redundancy", &merged.Redundancy, running.Redundancy)
+	keep(&kept, "fec_data_shards", &merged.FECDataShards, running.FECDataShards)
+	keep(&kept, "fec_parity_shards", &merged.FECParityShards, running.FECParityShards)
+	keep(&kept, "psk", &merged.PSK, running.PSK)
+	keep(&kept, "cipher", &merged.Cipher, running.Cipher)
+	keep(&kept, "max_udp_size", &merged.MaxUDPSize, running.MaxUDPSize)
+	keep(&kept, "enable_gro", &merged.EnableGRO, running.EnableGRO)
+	keep(&kept, "enable_gso", &merged.EnableGSO, running.EnableGSO)
+	return &merged, kept
+}
+
+func keep[T comparable](kept *[]string, name string, field *T, running T) {
+	if *field != running {
+		*kept = append(*kept, name)
+		*field = running
+	}
+}
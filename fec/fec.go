@@ -0,0 +1,171 @@
+/*
+Package fec implements a systematic Reed-Solomon erasure code over GF(2^8).
+
+The parity rows come from a Cauchy matrix whose coefficient for parity shard
+i and data shard j is 1/(x_i + y_j) with x_i = 255-i and y_j = j. The
+coefficients do not depend on the group size, so a group may carry fewer data
+shards than configured and any square submatrix is invertible, as long as
+data and parity shards sum up to at most MaxShards.
+*/
+package fec
+
+import "errors"
+
+const MaxShards = 256
+
+var (
+	ErrTooManyShards    = errors.New("too many shards")
+	ErrTooFewShards     = errors.New("too few shards to reconstruct")
+	ErrShardSizeUnmatch = errors.New("shard size unmatched")
+)
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	// generator 2 with polynomial x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+func coefficient(parityIdx int, dataIdx int) byte {
+	return inv(byte(255-parityIdx) ^ byte(dataIdx))
+}
+
+// mulAdd sets dst ^= c * src
+func mulAdd(dst []byte, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &mulTable[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// Encode fills parity shards from data shards. All shards must be of the
+// same size.
+func Encode(data [][]byte, parity [][]byte) error {
+	if len(data)+len(parity) > MaxShards {
+		return ErrTooManyShards
+	}
+	for i, p := range parity {
+		clear(p)
+		for j, d := range data {
+			if len(d) != len(p) {
+				return ErrShardSizeUnmatch
+			}
+			mulAdd(p, d, coefficient(i, j))
+		}
+	}
+	return nil
+}
+
+// Reconstruct recovers missing data shards in place. Missing data and parity
+// shards are nil, and recovered data shards are newly allocated.
+func Reconstruct(data [][]byte, parity [][]byte, shardSize int) error {
+	if len(data)+len(parity) > MaxShards {
+		return ErrTooManyShards
+	}
+	missing := make([]int, 0, len(parity))
+	for j, d := range data {
+		if d == nil {
+			missing = append(missing, j)
+		} else if len(d) != shardSize {
+			return ErrShardSizeUnmatch
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	rows := make([]int, 0, len(missing))
+	for i, p := range parity {
+		if p == nil {
+			continue
+		}
+		if len(p) != shardSize {
+			return ErrShardSizeUnmatch
+		}
+		rows = append(rows, i)
+		if len(rows) == len(missing) {
+			break
+		}
+	}
+	if len(rows) < len(missing) {
+		return ErrTooFewShards
+	}
+
+	// remove known data shards from the chosen parity shards
+	n := len(missing)
+	rhs := make([][]byte, n)
+	for r, i := range rows {
+		rhs[r] = make([]byte, shardSize)
+		copy(rhs[r], parity[i])
+		for j, d := range data {
+			if d != nil {
+				mulAdd(rhs[r], d, coefficient(i, j))
+			}
+		}
+	}
+
+	// solve the remaining Cauchy system by Gauss-Jordan elimination
+	matrix := make([][]byte, n)
+	for r, i := range rows {
+		matrix[r] = make([]byte, n)
+		for c, j := range missing {
+			matrix[r][c] = coefficient(i, j)
+		}
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && matrix[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return ErrTooFewShards
+		}
+		matrix[c], matrix[pivot] = matrix[pivot], matrix[c]
+		rhs[c], rhs[pivot] = rhs[pivot], rhs[c]
+		scale := inv(matrix[c][c])
+		for k := range matrix[c] {
+			matrix[c][k] = mulTable[scale][matrix[c][k]]
+		}
+		for k := range rhs[c] {
+			rhs[c][k] = mulTable[scale][rhs[c][k]]
+		}
+		for r := 0; r < n; r++ {
+			if r == c || matrix[r][c] == 0 {
+				continue
+			}
+			factor := matrix[r][c]
+			for k := range matrix[r] {
+				matrix[r][k] ^= mulTable[factor][matrix[c][k]]
+			}
+			mulAdd(rhs[r], rhs[c], factor)
+		}
+	}
+	for c, j := range missing {
+		data[j] = rhs[c]
+	}
+	return nil
+}
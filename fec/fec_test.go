@@ -0,0 +1,144 @@
+package fec_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/chenx-dust/paracat/fec"
+)
+
+func randomShards(rng *rand.Rand, n int, size int) [][]byte {
+	shards := make([][]byte, n)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		rng.Read(shards[i])
+	}
+	return shards
+}
+
+// erasures calls f with every set of up to max of n shards, as a mask.
+func erasures(n int, max int, f func(lost []bool)) {
+	lost := make([]bool, n)
+	var walk func(from int, left int)
+	walk = func(from int, left int) {
+		f(lost)
+		if left == 0 {
+			return
+		}
+		for i := from; i < n; i++ {
+			lost[i] = true
+			walk(i+1, left-1)
+			lost[i] = false
+		}
+	}
+	walk(0, max)
+}
+
+// TestReconstruct recovers the data from every pattern of losses up to the
+// number of parity shards, including groups shorter than usual.
+func TestReconstruct(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, k := range []int{1, 2, 3, 4, 10} {
+		for _, m := range []int{1, 2, 3, 4} {
+			t.Run(fmt.Sprintf("%d+%d", k, m), func(t *testing.T) {
+				const size = 37
+				data := randomShards(rng, k, size)
+				parity := make([][]byte, m)
+				for i := range parity {
+					parity[i] = make([]byte, size)
+				}
+				if err := fec.Encode(data, parity); err != nil {
+					t.Fatal(err)
+				}
+				erasures(k+m, m, func(lost []bool) {
+					received := make([][]byte, k)
+					receivedParity := make([][]byte, m)
+					for j := range data {
+						if !lost[j] {
+							received[j] = data[j]
+						}
+					}
+					for i := range parity {
+						if !lost[k+i] {
+							receivedParity[i] = parity[i]
+						}
+					}
+					if err := fec.Reconstruct(received, receivedParity, size); err != nil {
+						t.Fatalf("lost %v: %v", lost, err)
+					}
+					for j := range data {
+						if !bytes.Equal(received[j], data[j]) {
+							t.Fatalf("lost %v: shard %d reconstructed wrong", lost, j)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// TestReconstructTooFew fails without touching the data when more data
+// shards are lost than parity shards received.
+func TestReconstructTooFew(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	const k, m, size = 4, 2, 16
+	data := randomShards(rng, k, size)
+	parity := make([][]byte, m)
+	for i := range parity {
+		parity[i] = make([]byte, size)
+	}
+	if err := fec.Encode(data, parity); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		lostData   []int
+		lostParity []int
+	}{
+		{name: "3 data", lostData: []int{0, 1, 2}},
+		{name: "all data", lostData: []int{0, 1, 2, 3}},
+		{name: "2 data 1 parity", lostData: []int{1, 3}, lostParity: []int{0}},
+		{name: "1 data all parity", lostData: []int{2}, lostParity: []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := append([][]byte(nil), data...)
+			receivedParity := append([][]byte(nil), parity...)
+			for _, j := range tt.lostData {
+				received[j] = nil
+			}
+			for _, i := range tt.lostParity {
+				receivedParity[i] = nil
+			}
+			if err := fec.Reconstruct(received, receivedParity, size); err != fec.ErrTooFewShards {
+				t.Fatalf("got %v, want %v", err, fec.ErrTooFewShards)
+			}
+			for _, j := range tt.lostData {
+				if received[j] != nil {
+					t.Errorf("shard %d filled on failure", j)
+				}
+			}
+		})
+	}
+}
+
+func TestShardSizeUnmatch(t *testing.T) {
+	data := [][]byte{make([]byte, 8), make([]byte, 7)}
+	parity := [][]byte{make([]byte, 8)}
+	if err := fec.Encode(data, parity); err != fec.ErrShardSizeUnmatch {
+		t.Errorf("encoding got %v, want %v", err, fec.ErrShardSizeUnmatch)
+	}
+	if err := fec.Reconstruct([][]byte{nil, data[1]}, parity, 8); err != fec.ErrShardSizeUnmatch {
+		t.Errorf("reconstructing got %v, want %v", err, fec.ErrShardSizeUnmatch)
+	}
+}
+
+func TestTooManyShards(t *testing.T) {
+	data := make([][]byte, fec.MaxShards)
+	parity := make([][]byte, 1)
+	if err := fec.Encode(data, parity); err != fec.ErrTooManyShards {
+		t.Errorf("got %v, want %v", err, fec.ErrTooManyShards)
+	}
+}
@@ -4,5 +4,6 @@ go 1.23.2
 
 require (
 	github.com/sigurn/crc8 v0.0.0-20220107193325-2243fe600f9f
+	golang.org/x/crypto v0.33.0
 	golang.org/x/sys v0.30.0
 )
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -38,17 +42,43 @@ func main() {
 
 	var application app.App
 	if cfg.Mode == config.ClientMode {
-		application = client.NewClient(cfg)
+		application, err = client.NewClient(cfg)
 	} else if cfg.Mode == config.ServerMode {
-		application = server.NewServer(cfg)
+		application, err = server.NewServer(cfg)
 	} else if cfg.Mode == config.RelayMode {
 		application = relay.NewRelay(cfg)
 	} else {
 		log.Fatalf("Invalid mode: %v", cfg.Mode)
 	}
+	if err != nil {
+		log.Fatalf("Failed to create application: %v", err)
+	}
+
+	if reloader, ok := application.(app.Reloader); ok {
+		go reloadOnSignal(*cfgFilename, reloader)
+	}
 
-	err = application.Run()
+	// stops on the first interrupt, and a second one kills at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	err = application.Run(ctx)
 	if err != nil {
 		log.Fatalf("Failed to run application: %v", err)
 	}
 }
+
+// reloadOnSignal reloads the config file on every SIGHUP. A config failing to
+// load is logged and the running one is kept.
+func reloadOnSignal(cfgFilename string, reloader app.Reloader) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Println("reloading config from", cfgFilename)
+		cfg, err := config.LoadFromFile(cfgFilename)
+		if err != nil {
+			log.Println("error reloading config:", err)
+			continue
+		}
+		reloader.Reload(cfg)
+	}
+}
@@ -0,0 +1,154 @@
+/* Metrics exposes counters in the Prometheus text format. */
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/chenx-dust/paracat/channel"
+	"github.com/chenx-dust/paracat/packet"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+type family struct {
+	help    string
+	kind    string // counter or gauge
+	samples []string
+}
+
+// Metrics collects samples for one scrape. Samples of a metric may be added
+// in any order, they are grouped when written.
+type Metrics struct {
+	families map[string]*family
+}
+
+func New() *Metrics {
+	return &Metrics{families: make(map[string]*family)}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *Metrics) add(name string, help string, kind string, value float64, labels []string) {
+	f, ok := m.families[name]
+	if !ok {
+		f = &family{help: help, kind: kind}
+		m.families[name] = f
+	}
+	var sample strings.Builder
+	sample.WriteString(name)
+	if len(labels) > 0 {
+		sample.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sample.WriteByte(',')
+			}
+			fmt.Fprintf(&sample, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		sample.WriteByte('}')
+	}
+	sample.WriteByte(' ')
+	sample.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	f.samples = append(f.samples, sample.String())
+}
+
+// Counter adds a sample of a cumulative counter. labels are pairs of name
+// and value.
+func (m *Metrics) Counter(name string, help string, value float64, labels ...string) {
+	m.add(name, help, "counter", value, labels)
+}
+
+// Gauge adds a sample of a value that goes up and down. labels are pairs of
+// name and value.
+func (m *Metrics) Gauge(name string, help string, value float64, labels ...string) {
+	m.add(name, help, "gauge", value, labels)
+}
+
+// Statistic adds the total packets and bytes of ps, as name_packets_total
+// and name_bytes_total.
+func (m *Metrics) Statistic(name string, help string, ps *packet.PacketStatistic, labels ...string) {
+	count, bandwidth := ps.Total()
+	m.Counter(name+"_packets_total", "Packets "+help, float64(count), labels...)
+	m.Counter(name+"_bytes_total", "Bytes "+help, float64(bandwidth), labels...)
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, name := range slices.Sorted(maps.Keys(m.families)) {
+		f := m.families[name]
+		written, _ := fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind)
+		n += int64(written)
+		for _, sample := range f.samples {
+			written, _ = fmt.Fprintln(bw, sample)
+			n += int64(written)
+		}
+	}
+	return n, bw.Flush()
+}
+
+// Serve serves /metrics on addr in the background until the returned server
+// is closed, with the samples added by collect on every scrape.
+func Serve(addr string, collect func(m *Metrics)) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		m := New()
+		collect(m)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteTo(w)
+	})
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Println("error serving metrics:", err)
+		}
+	}()
+	return server, nil
+}
+
+// Scatterer adds the counters of a scatterer.
+func (m *Metrics) Scatterer(s *channel.Scatterer, labels ...string) {
+	m.Statistic("paracat_scatter_in", "taken in by the scatterer.", s.StatisticIn, labels...)
+	m.Statistic("paracat_scatter_out", "sent out by the scatterer to paths.", s.StatisticOut, labels...)
+}
+
+// Gatherer adds the counters of a gatherer.
+func (m *Metrics) Gatherer(g *channel.Gatherer, labels ...string) {
+	m.Statistic("paracat_gather_in", "taken in by the gatherer from paths.", g.StatisticIn, labels...)
+	m.Statistic("paracat_gather_out", "sent out by the gatherer.", g.StatisticOut, labels...)
+	m.Statistic("paracat_gather_recovered", "recovered by fec.", g.StatisticRecovered, labels...)
+	m.Statistic("paracat_gather_duplicate", "dropped as duplicates.", g.StatisticDuplicate, labels...)
+	m.Statistic("paracat_gather_dedup_late", "older than the deduplication window.", g.StatisticDedupLate, labels...)
+	m.Statistic("paracat_gather_reordered", "put back in order.", g.StatisticReordered, labels...)
+	m.Statistic("paracat_gather_reorder_late", "released too late to be put in order.", g.StatisticLate, labels...)
+	m.Statistic("paracat_gather_dropped", "dropped on a full gatherer queue.", g.StatisticDropped, labels...)
+}
+
+// Path adds the state of a path. labels tell the path.
+func (m *Metrics) Path(alive bool, quality transport.PathQuality, congestion transport.CongestionState, labels ...string) {
+	up := 0.0
+	if alive {
+		up = 1
+	}
+	m.Gauge("paracat_path_alive", "Whether heartbeats arrive on the path.", up, labels...)
+	if quality.Valid {
+		m.Gauge("paracat_path_rtt_seconds", "Smoothed round-trip time of the path.", quality.SRTT.Seconds(), labels...)
+		m.Gauge("paracat_path_jitter_seconds", "Round-trip time variance of the path.", quality.RTTVar.Seconds(), labels...)
+		m.Gauge("paracat_path_probe_loss_ratio", "Ratio of probes lost on the path.", quality.Loss, labels...)
+	}
+	m.Gauge("paracat_path_delivery_rate_bytes_per_second", "Bytes per second received by the peer on the path.", congestion.DeliveryRate, labels...)
+	m.Gauge("paracat_path_loss_ratio", "Smoothed ratio of packets lost on the path.", congestion.Loss, labels...)
+	m.Gauge("paracat_path_pacing_rate_bytes_per_second", "Bytes per second the path is paced at, 0 for not paced.", congestion.Rate, labels...)
+}
@@ -0,0 +1,164 @@
+package packet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	NONCE_SIZE    = 12
+	TAG_SIZE      = 16
+	SEAL_OVERHEAD = NONCE_SIZE + TAG_SIZE
+)
+
+var (
+	ErrForgedPacket         = errors.New("forged packet")
+	ErrNotEncrypted         = errors.New("packet not encrypted, is psk set on the peer?")
+	ErrUnexpectedEncryption = errors.New("packet encrypted, but psk is not set")
+)
+
+// Cipher seals packets with a pre-shared key. The nonce is made of a random
+// salt chosen for the session and a sequence number, and is sent in front of
+// the ciphertext. Packet ids are not used as nonce by themselves since they
+// wrap around within seconds, but the whole header including them is
+// authenticated as additional data.
+//
+// A nil *Cipher packs and opens packets in cleartext.
+type Cipher struct {
+	aead cipher.AEAD
+	salt [4]byte
+	seq  atomic.Uint64
+
+	StatisticRejected *PacketStatistic
+}
+
+func NewCipher(method string, psk string) (*Cipher, error) {
+	mac := hmac.New(sha256.New, []byte(psk))
+	mac.Write([]byte("paracat aead key"))
+	key := mac.Sum(nil)
+
+	var aead cipher.AEAD
+	var err error
+	switch method {
+	case "aes-256-gcm":
+		var block cipher.Block
+		block, err = aes.NewCipher(key)
+		if err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	case "chacha20-poly1305":
+		aead, err = chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unknown cipher: %s", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cipher{
+		aead:              aead,
+		StatisticRejected: NewPacketStatistic(),
+	}
+	// random start of sequence as well, so that two ends sharing the key are
+	// unlikely to ever use the same nonce even if their salts collide
+	var random [12]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	copy(c.salt[:], random[:4])
+	c.seq.Store(binary.LittleEndian.Uint64(random[4:]))
+	return c, nil
+}
+
+// Pack packs p into buffer, sealing its payload if c is not nil.
+func (c *Cipher) Pack(p *Packet, buffer []byte) (length int) {
+	if c == nil {
+		return p.Pack(buffer)
+	}
+	payloadLength := p.payloadLength()
+	sealedLength := payloadLength + SEAL_OVERHEAD
+	headerSize := p.packHeader(buffer, sealedLength, p.Flags|EncryptedFlag)
+	nonce := buffer[headerSize : headerSize+NONCE_SIZE]
+	copy(nonce[:4], c.salt[:])
+	binary.LittleEndian.PutUint64(nonce[4:], c.seq.Add(1))
+	if p.sequenced() {
+		// sealed in place, as the sequence is not in front of the payload
+		plain := buffer[headerSize+NONCE_SIZE : headerSize+NONCE_SIZE+payloadLength]
+		p.packPayload(plain)
+		c.aead.Seal(plain[:0], nonce, plain, buffer[:headerSize])
+	} else {
+		c.aead.Seal(buffer[headerSize+NONCE_SIZE:headerSize+NONCE_SIZE], nonce, p.Buffer, buffer[:headerSize])
+	}
+	return headerSize + sealedLength
+}
+
+// Overhead is the most a packet grows by being packed with c.
+func (c *Cipher) Overhead() int {
+	if c == nil {
+		return HEADER_SIZE + SEQUENCE_SIZE
+	}
+	return HEADER_SIZE + SEQUENCE_SIZE + SEAL_OVERHEAD
+}
+
+// Open authenticates and decrypts an unpacked packet in place. If c is nil,
+// it only checks that the packet is not encrypted.
+func (c *Cipher) Open(p *Packet) error {
+	if c == nil {
+		if p.Flags&EncryptedFlag != 0 {
+			return ErrUnexpectedEncryption
+		}
+		return nil
+	}
+	if p.Flags&EncryptedFlag == 0 {
+		c.StatisticRejected.CountPacket(uint32(len(p.Buffer)))
+		return ErrNotEncrypted
+	}
+	if len(p.Buffer) < SEAL_OVERHEAD || p.header == nil {
+		c.StatisticRejected.CountPacket(uint32(len(p.Buffer)))
+		return ErrForgedPacket
+	}
+	nonce := p.Buffer[:NONCE_SIZE]
+	sealed := p.Buffer[NONCE_SIZE:]
+	plain, err := c.aead.Open(sealed[:0], nonce, sealed, p.header)
+	if err != nil {
+		c.StatisticRejected.CountPacket(uint32(len(p.Buffer)))
+		return ErrForgedPacket
+	}
+	p.Buffer = plain
+	p.header = nil
+	p.Flags &^= EncryptedFlag
+	if err := p.unpackSequence(); err != nil {
+		c.StatisticRejected.CountPacket(uint32(len(p.Buffer)))
+		return err
+	}
+	return nil
+}
+
+// OpenPackets opens packets in place, dropping forged ones. A mismatch of
+// encryption with the peer is logged for control packets only, which are
+// few, so that it is told without flooding the log.
+func (c *Cipher) OpenPackets(packets []*Packet) []*Packet {
+	opened := packets[:0]
+	for _, p := range packets {
+		err := c.Open(p)
+		switch err {
+		case nil:
+			opened = append(opened, p)
+		case ErrNotEncrypted, ErrUnexpectedEncryption:
+			if p.Type == ControlPacketType {
+				log.Println("error opening packet:", err)
+			}
+		}
+	}
+	return opened
+}
@@ -0,0 +1,193 @@
+package packet_test
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/chenx-dust/paracat/packet"
+)
+
+func newCipher(t *testing.T, method string, psk string) *packet.Cipher {
+	t.Helper()
+	c, err := packet.NewCipher(method, psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// sealAndOpen packs p with sealer, and unpacks and opens it with opener.
+func sealAndOpen(sealer *packet.Cipher, opener *packet.Cipher, p *packet.Packet) (*packet.Packet, error) {
+	got, _, err := packet.Unpack(pack(sealer, p))
+	if err != nil {
+		return nil, err
+	}
+	return got, opener.Open(got)
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	packets := []struct {
+		name   string
+		packet packet.Packet
+	}{
+		{"data", packet.Packet{Buffer: []byte("hello"), SessionID: 1, ServiceID: 2, ConnID: 3, PacketID: 4}},
+		{"empty", packet.Packet{PacketID: 5}},
+		{"sequenced", packet.Packet{Buffer: []byte("hi"), ConnID: 3, ConnSeq: 0xfffffffe, Flags: packet.SequencedFlag}},
+		{"control", *packet.NewHeartbeatPacket()},
+		{"large", packet.Packet{Buffer: bytes.Repeat([]byte{0xa5}, 60000)}},
+	}
+	for _, method := range []string{"aes-256-gcm", "chacha20-poly1305"} {
+		for _, tt := range packets {
+			t.Run(method+"/"+tt.name, func(t *testing.T) {
+				// each end has its own salt and sequence
+				sealer, opener := newCipher(t, method, "psk"), newCipher(t, method, "psk")
+				buffer := pack(sealer, &tt.packet)
+				if len(buffer) > len(tt.packet.Buffer)+sealer.Overhead() {
+					t.Errorf("packed %d bytes, more than overhead %d", len(buffer), sealer.Overhead())
+				}
+				if len(tt.packet.Buffer) > 4 && bytes.Contains(buffer, tt.packet.Buffer) {
+					t.Error("payload packed in cleartext")
+				}
+				got, _, err := packet.Unpack(buffer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Flags&packet.EncryptedFlag == 0 {
+					t.Error("not flagged encrypted")
+				}
+				if err := opener.Open(got); err != nil {
+					t.Fatal(err)
+				}
+				want := tt.packet
+				if want.Buffer == nil {
+					want.Buffer = []byte{}
+				}
+				if !samePacket(got, &want) || got.Flags != want.Flags {
+					t.Errorf("opened %+v, want %+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+// TestCipherNonce seals every packet with a new nonce, so that the same
+// packet never looks the same on the wire.
+func TestCipherNonce(t *testing.T) {
+	c := newCipher(t, "chacha20-poly1305", "psk")
+	other := newCipher(t, "chacha20-poly1305", "psk")
+	p := &packet.Packet{Buffer: []byte("hello"), PacketID: 1}
+	nonceOf := func(buffer []byte) []byte {
+		return buffer[packet.HEADER_SIZE : packet.HEADER_SIZE+packet.NONCE_SIZE]
+	}
+	first, second, third := pack(c, p), pack(c, p), pack(other, p)
+	if bytes.Equal(nonceOf(first), nonceOf(second)) || bytes.Equal(nonceOf(first), nonceOf(third)) {
+		t.Error("nonce reused")
+	}
+	if bytes.Equal(first[packet.HEADER_SIZE:], second[packet.HEADER_SIZE:]) {
+		t.Error("same packet sealed alike")
+	}
+	// salt is kept, sequence goes up by one
+	if !bytes.Equal(nonceOf(first)[:4], nonceOf(second)[:4]) {
+		t.Error("salt changed")
+	}
+	seq := func(nonce []byte) uint64 {
+		var v uint64
+		for i := 7; i >= 0; i-- {
+			v = v<<8 | uint64(nonce[4+i])
+		}
+		return v
+	}
+	if seq(nonceOf(second)) != seq(nonceOf(first))+1 {
+		t.Errorf("sequence went from %d to %d", seq(nonceOf(first)), seq(nonceOf(second)))
+	}
+}
+
+func TestCipherRejects(t *testing.T) {
+	c := newCipher(t, "chacha20-poly1305", "psk")
+	p := &packet.Packet{Buffer: []byte("hello"), SessionID: 1, ConnID: 2, PacketID: 3}
+	sealed := pack(c, p)
+	tamperedWith := func(i int, mask byte) []byte {
+		buffer := bytes.Clone(sealed)
+		buffer[i] ^= mask
+		return buffer
+	}
+	tampered := func(i int) []byte {
+		return tamperedWith(i, 1)
+	}
+	tests := []struct {
+		name   string
+		buffer []byte
+		opener *packet.Cipher
+		want   error
+	}{
+		{"nonce", tampered(packet.HEADER_SIZE), c, packet.ErrForgedPacket},
+		{"ciphertext", tampered(packet.HEADER_SIZE + packet.NONCE_SIZE), c, packet.ErrForgedPacket},
+		{"tag", tampered(len(sealed) - 1), c, packet.ErrForgedPacket},
+		{"session id", withCRC(tampered(6)), c, packet.ErrForgedPacket},
+		{"conn id", withCRC(tampered(12)), c, packet.ErrForgedPacket},
+		{"packet id", withCRC(tampered(16)), c, packet.ErrForgedPacket},
+		{"sequenced flag", withCRC(tamperedWith(3, byte(packet.SequencedFlag))), c, packet.ErrForgedPacket},
+		{"truncated", withLength(sealed[:packet.HEADER_SIZE+packet.SEAL_OVERHEAD-1]), c, packet.ErrForgedPacket},
+		{"other psk", sealed, newCipher(t, "chacha20-poly1305", "other"), packet.ErrForgedPacket},
+		{"other method", sealed, newCipher(t, "aes-256-gcm", "psk"), packet.ErrForgedPacket},
+		{"not encrypted", pack(nil, p), c, packet.ErrNotEncrypted},
+		{"encrypted without psk", sealed, nil, packet.ErrUnexpectedEncryption},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := packet.Unpack(tt.buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.opener.Open(got); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+	if sealed, err := sealAndOpen(c, c, p); err != nil || !samePacket(sealed, p) {
+		t.Errorf("untampered packet not opened: %v", err)
+	}
+}
+
+// withLength fixes the length of a truncated packet.
+func withLength(buffer []byte) []byte {
+	buffer = bytes.Clone(buffer)
+	length := len(buffer) - packet.HEADER_SIZE
+	buffer[4], buffer[5] = byte(length), byte(length>>8)
+	return withCRC(buffer)
+}
+
+// TestOpenPackets drops what is not opened, keeping the order of the rest.
+func TestOpenPackets(t *testing.T) {
+	c := newCipher(t, "aes-256-gcm", "psk")
+	var packets []*packet.Packet
+	for i := range 6 {
+		sealer := c
+		if i%3 == 1 {
+			sealer = nil
+		}
+		p, _, err := packet.Unpack(pack(sealer, &packet.Packet{Buffer: []byte{byte(i)}, PacketID: uint32(i)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, p)
+	}
+	opened := c.OpenPackets(packets)
+	var ids []uint32
+	for _, p := range opened {
+		ids = append(ids, p.PacketID)
+	}
+	if want := []uint32{0, 2, 3, 5}; !slices.Equal(ids, want) {
+		t.Errorf("opened %v, want %v", ids, want)
+	}
+	if count, _ := c.StatisticRejected.Total(); count != 2 {
+		t.Errorf("rejected %d, want 2", count)
+	}
+}
+
+func TestNewCipherUnknown(t *testing.T) {
+	if _, err := packet.NewCipher("rot13", "psk"); err == nil {
+		t.Error("unknown cipher created")
+	}
+}
@@ -0,0 +1,349 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/chenx-dust/paracat/config"
+)
+
+// ControlType is the first byte of a control packet's payload.
+type ControlType uint8
+
+const (
+	NotDefinedControlType ControlType = iota
+	AnnounceControlType               // client tells server the traffic direction of a path
+	HeartbeatControlType              // keepalive sent periodically by both ends of a path
+	ProbeControlType                  // timestamped probe for path quality measurement
+	EchoControlType                   // reply to a probe, carrying the same payload
+	HelloControlType                  // client offers its version and features on a new path
+	ChallengeControlType              // server challenges a path to prove the key
+	ResponseControlType               // client answers a challenge
+	AcceptControlType                 // server accepts a path with the agreed features
+	RejectControlType                 // server refuses an incompatible path, with the reason
+	FeedbackControlType               // receiver reports what arrived on a path, for congestion control
+)
+
+var ErrInvalidControl = errors.New("invalid control packet")
+
+func NewControlPacket(controlType ControlType, payload []byte) *Packet {
+	buffer := make([]byte, 1+len(payload))
+	buffer[0] = byte(controlType)
+	copy(buffer[1:], payload)
+	return &Packet{
+		Buffer: buffer,
+		Type:   ControlPacketType,
+	}
+}
+
+func (p *Packet) ControlType() ControlType {
+	if p.Type != ControlPacketType || len(p.Buffer) == 0 {
+		return NotDefinedControlType
+	}
+	return ControlType(p.Buffer[0])
+}
+
+func (p *Packet) ControlPayload() []byte {
+	if p.Type != ControlPacketType || len(p.Buffer) == 0 {
+		return nil
+	}
+	return p.Buffer[1:]
+}
+
+func NewHeartbeatPacket() *Packet {
+	return NewControlPacket(HeartbeatControlType, nil)
+}
+
+type Announce struct {
+	Traffic config.TrafficType
+	Weight  uint16
+	Standby bool // the path is used only when no other is alive
+}
+
+// announceStandby is a flag of the optional fourth byte, unknown to older
+// peers which ignore it.
+const announceStandby = 1 << 0
+
+func NewAnnouncePacket(announce Announce) *Packet {
+	var flags byte
+	if announce.Standby {
+		flags |= announceStandby
+	}
+	return NewControlPacket(AnnounceControlType, []byte{
+		byte(announce.Traffic),
+		byte(announce.Weight),
+		byte(announce.Weight >> 8),
+		flags,
+	})
+}
+
+func ParseAnnounce(p *Packet) (Announce, error) {
+	payload := p.ControlPayload()
+	if p.ControlType() != AnnounceControlType || len(payload) < 3 {
+		return Announce{}, ErrInvalidControl
+	}
+	announce := Announce{
+		Traffic: config.TrafficType(payload[0]),
+		Weight:  uint16(payload[1]) | uint16(payload[2])<<8,
+	}
+	if len(payload) >= 4 {
+		announce.Standby = payload[3]&announceStandby != 0
+	}
+	return announce, nil
+}
+
+type Probe struct {
+	Seq       uint32
+	Timestamp int64 // unix nano of the prober, only meaningful to itself
+}
+
+func (probe Probe) payload() []byte {
+	payload := make([]byte, 12)
+	for i := 0; i < 4; i++ {
+		payload[i] = byte(probe.Seq >> (8 * i))
+	}
+	for i := 0; i < 8; i++ {
+		payload[4+i] = byte(probe.Timestamp >> (8 * i))
+	}
+	return payload
+}
+
+func NewProbePacket(probe Probe) *Packet {
+	return NewControlPacket(ProbeControlType, probe.payload())
+}
+
+func NewEchoPacket(probe Probe) *Packet {
+	return NewControlPacket(EchoControlType, probe.payload())
+}
+
+// ParseProbe parses both probe and echo packets.
+func ParseProbe(p *Packet) (Probe, error) {
+	payload := p.ControlPayload()
+	controlType := p.ControlType()
+	if (controlType != ProbeControlType && controlType != EchoControlType) || len(payload) < 12 {
+		return Probe{}, ErrInvalidControl
+	}
+	probe := Probe{}
+	for i := 0; i < 4; i++ {
+		probe.Seq |= uint32(payload[i]) << (8 * i)
+	}
+	for i := 0; i < 8; i++ {
+		probe.Timestamp |= int64(payload[4+i]) << (8 * i)
+	}
+	return probe, nil
+}
+
+// Feedback reports what arrived on a path. Counters start with the path and
+// wrap, only differences between two feedbacks are meaningful.
+type Feedback struct {
+	Timestamp int64  // unix nano of the reporting end, only meaningful to itself
+	Sent      uint32 // packets sent on the path before this one
+	Received  uint32 // packets received on the path
+	Bytes     uint64 // bytes received on the path
+	// MarkSent is Sent of the latest feedback from the peer, and
+	// MarkReceived the packets received by its arrival. Packets are
+	// delivered in order mostly, so the peer tells the loss between two
+	// marks without matching the times of both ends.
+	MarkSent     uint32
+	MarkReceived uint32
+}
+
+const FEEDBACK_SIZE = 32
+
+func NewFeedbackPacket(feedback Feedback) *Packet {
+	payload := make([]byte, FEEDBACK_SIZE)
+	putUint64(payload[0:], uint64(feedback.Timestamp))
+	putUint32(payload[8:], feedback.Sent)
+	putUint32(payload[12:], feedback.Received)
+	putUint64(payload[16:], feedback.Bytes)
+	putUint32(payload[24:], feedback.MarkSent)
+	putUint32(payload[28:], feedback.MarkReceived)
+	return NewControlPacket(FeedbackControlType, payload)
+}
+
+func ParseFeedback(p *Packet) (Feedback, error) {
+	payload := p.ControlPayload()
+	if p.ControlType() != FeedbackControlType || len(payload) < FEEDBACK_SIZE {
+		return Feedback{}, ErrInvalidControl
+	}
+	return Feedback{
+		Timestamp:    int64(getUint64(payload[0:])),
+		Sent:         getUint32(payload[8:]),
+		Received:     getUint32(payload[12:]),
+		Bytes:        getUint64(payload[16:]),
+		MarkSent:     getUint32(payload[24:]),
+		MarkReceived: getUint32(payload[28:]),
+	}, nil
+}
+
+// Features are what a peer is able to do beyond the bare protocol.
+type Features uint16
+
+const (
+	EncryptionFeature Features = 1 << iota // packets are sealed with a psk
+	FECFeature                             // parity packets are understood
+	FeedbackFeature                        // feedback packets are understood and sent
+	SequenceFeature                        // sequenced packets are understood
+)
+
+// MandatoryFeatures must be the same on both ends, otherwise they cannot
+// read each other. Other features are used only if both ends have them.
+const MandatoryFeatures = EncryptionFeature
+
+var featureNames = []string{"encryption", "fec", "feedback", "sequence"}
+
+func (features Features) String() string {
+	names := make([]string, 0, len(featureNames))
+	for i, name := range featureNames {
+		if features&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Hello is what a peer offers on a new path. Accept carries the same, with
+// the agreed features instead.
+type Hello struct {
+	Version  uint8
+	Features Features
+	// HeartbeatInterval is how often the peer sends heartbeats on its own,
+	// 0 for never. It is sent in milliseconds, rounded up.
+	HeartbeatInterval time.Duration
+}
+
+const HELLO_SIZE = 7
+
+func (hello Hello) payload() []byte {
+	payload := []byte{hello.Version, byte(hello.Features), byte(hello.Features >> 8), 0, 0, 0, 0}
+	interval := hello.HeartbeatInterval / time.Millisecond
+	if hello.HeartbeatInterval%time.Millisecond != 0 {
+		interval++
+	}
+	putUint32(payload[3:], uint32(min(interval, math.MaxUint32)))
+	return payload
+}
+
+func parseHello(payload []byte) Hello {
+	return Hello{
+		Version:           payload[0],
+		Features:          Features(payload[1]) | Features(payload[2])<<8,
+		HeartbeatInterval: time.Duration(getUint32(payload[3:])) * time.Millisecond,
+	}
+}
+
+func NewHelloPacket(hello Hello) *Packet {
+	return NewControlPacket(HelloControlType, hello.payload())
+}
+
+func ParseHello(p *Packet) (Hello, error) {
+	payload := p.ControlPayload()
+	if p.ControlType() != HelloControlType || len(payload) < HELLO_SIZE {
+		return Hello{}, ErrInvalidControl
+	}
+	return parseHello(payload), nil
+}
+
+func NewAcceptPacket(hello Hello) *Packet {
+	return NewControlPacket(AcceptControlType, hello.payload())
+}
+
+func ParseAccept(p *Packet) (Hello, error) {
+	payload := p.ControlPayload()
+	if p.ControlType() != AcceptControlType || len(payload) < HELLO_SIZE {
+		return Hello{}, ErrInvalidControl
+	}
+	return parseHello(payload), nil
+}
+
+func NewRejectPacket(reason string) *Packet {
+	return NewControlPacket(RejectControlType, []byte(reason))
+}
+
+func ParseReject(p *Packet) (string, error) {
+	if p.ControlType() != RejectControlType {
+		return "", ErrInvalidControl
+	}
+	return string(p.ControlPayload()), nil
+}
+
+// Negotiate agrees on the features of local and remote, or tells why they
+// are incompatible.
+func Negotiate(local, remote Hello) (Features, error) {
+	if local.Version != remote.Version {
+		return 0, fmt.Errorf("incompatible protocol version %d, expected %d", remote.Version, local.Version)
+	}
+	if (local.Features^remote.Features)&MandatoryFeatures != 0 {
+		return 0, fmt.Errorf("incompatible features %s, expected %s", remote.Features&MandatoryFeatures, local.Features&MandatoryFeatures)
+	}
+	return local.Features & remote.Features, nil
+}
+
+const (
+	COOKIE_SIZE   = 16
+	AUTH_MAC_SIZE = 32
+)
+
+type Challenge struct {
+	Timestamp int64 // unix nano of the server
+	Cookie    [COOKIE_SIZE]byte
+}
+
+func (challenge Challenge) payload() []byte {
+	payload := make([]byte, 8, 8+COOKIE_SIZE)
+	for i := 0; i < 8; i++ {
+		payload[i] = byte(challenge.Timestamp >> (8 * i))
+	}
+	return append(payload, challenge.Cookie[:]...)
+}
+
+func parseChallenge(payload []byte) Challenge {
+	challenge := Challenge{}
+	for i := 0; i < 8; i++ {
+		challenge.Timestamp |= int64(payload[i]) << (8 * i)
+	}
+	copy(challenge.Cookie[:], payload[8:8+COOKIE_SIZE])
+	return challenge
+}
+
+func NewChallengePacket(challenge Challenge) *Packet {
+	return NewControlPacket(ChallengeControlType, challenge.payload())
+}
+
+func ParseChallenge(p *Packet) (Challenge, error) {
+	payload := p.ControlPayload()
+	if p.ControlType() != ChallengeControlType || len(payload) < 8+COOKIE_SIZE {
+		return Challenge{}, ErrInvalidControl
+	}
+	return parseChallenge(payload), nil
+}
+
+// Response echoes the challenge, so that the server does not need to keep it.
+// The hello is repeated for the same reason.
+type Response struct {
+	Challenge Challenge
+	MAC       [AUTH_MAC_SIZE]byte
+	Hello     Hello
+}
+
+func NewResponsePacket(response Response) *Packet {
+	payload := append(response.Challenge.payload(), response.MAC[:]...)
+	return NewControlPacket(ResponseControlType, append(payload, response.Hello.payload()...))
+}
+
+func ParseResponse(p *Packet) (Response, error) {
+	payload := p.ControlPayload()
+	if p.ControlType() != ResponseControlType || len(payload) < 8+COOKIE_SIZE+AUTH_MAC_SIZE+HELLO_SIZE {
+		return Response{}, ErrInvalidControl
+	}
+	response := Response{Challenge: parseChallenge(payload)}
+	copy(response.MAC[:], payload[8+COOKIE_SIZE:])
+	response.Hello = parseHello(payload[8+COOKIE_SIZE+AUTH_MAC_SIZE:])
+	return response, nil
+}
@@ -0,0 +1,203 @@
+package packet_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+func TestNegotiate(t *testing.T) {
+	const all = packet.EncryptionFeature | packet.FECFeature | packet.FeedbackFeature | packet.SequenceFeature
+	tests := []struct {
+		name    string
+		local   packet.Hello
+		remote  packet.Hello
+		want    packet.Features
+		wantErr bool
+	}{
+		{
+			name:   "same",
+			local:  packet.Hello{Version: packet.VERSION, Features: all},
+			remote: packet.Hello{Version: packet.VERSION, Features: all},
+			want:   all,
+		},
+		{
+			name:   "optional features of one end",
+			local:  packet.Hello{Version: packet.VERSION, Features: packet.FECFeature | packet.SequenceFeature},
+			remote: packet.Hello{Version: packet.VERSION, Features: packet.FECFeature | packet.FeedbackFeature},
+			want:   packet.FECFeature,
+		},
+		{
+			name:   "older peer",
+			local:  packet.Hello{Version: packet.VERSION, Features: all},
+			remote: packet.Hello{Version: packet.VERSION, Features: packet.EncryptionFeature | packet.FECFeature},
+			want:   packet.EncryptionFeature | packet.FECFeature,
+		},
+		{
+			name:   "unknown features",
+			local:  packet.Hello{Version: packet.VERSION, Features: packet.FECFeature},
+			remote: packet.Hello{Version: packet.VERSION, Features: packet.FECFeature | 1<<15},
+			want:   packet.FECFeature,
+		},
+		{
+			name:    "encryption on one end",
+			local:   packet.Hello{Version: packet.VERSION, Features: packet.EncryptionFeature},
+			remote:  packet.Hello{Version: packet.VERSION},
+			wantErr: true,
+		},
+		{
+			name:    "encryption on the other end",
+			local:   packet.Hello{Version: packet.VERSION, Features: packet.FECFeature},
+			remote:  packet.Hello{Version: packet.VERSION, Features: packet.EncryptionFeature | packet.FECFeature},
+			wantErr: true,
+		},
+		{
+			name:    "version",
+			local:   packet.Hello{Version: packet.VERSION},
+			remote:  packet.Hello{Version: packet.VERSION + 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := packet.Negotiate(tt.local, tt.remote)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("agreed on %s, want %s", got, tt.want)
+			}
+			// both ends agree alike
+			if reverse, _ := packet.Negotiate(tt.remote, tt.local); reverse != got {
+				t.Errorf("reversed agreed on %s, want %s", reverse, got)
+			}
+		})
+	}
+}
+
+func TestFeaturesString(t *testing.T) {
+	tests := []struct {
+		features packet.Features
+		want     string
+	}{
+		{0, "none"},
+		{packet.EncryptionFeature, "encryption"},
+		{packet.FECFeature | packet.SequenceFeature, "fec,sequence"},
+	}
+	for _, tt := range tests {
+		if got := tt.features.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// roundTrip packs p and unpacks it, as control packets go on the wire.
+func roundTrip(t *testing.T, p *packet.Packet) *packet.Packet {
+	t.Helper()
+	got, _, err := packet.Unpack(pack(nil, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	hello := packet.Hello{
+		Version: packet.VERSION, Features: packet.FECFeature | packet.SequenceFeature, HeartbeatInterval: 100 * time.Millisecond,
+	}
+	if got, err := packet.ParseHello(roundTrip(t, packet.NewHelloPacket(hello))); err != nil || got != hello {
+		t.Errorf("hello %+v, %v, want %+v", got, err, hello)
+	}
+	if got, err := packet.ParseAccept(roundTrip(t, packet.NewAcceptPacket(hello))); err != nil || got != hello {
+		t.Errorf("accept %+v, %v, want %+v", got, err, hello)
+	}
+	if _, err := packet.ParseAccept(roundTrip(t, packet.NewHelloPacket(hello))); err != packet.ErrInvalidControl {
+		t.Errorf("hello parsed as accept: %v", err)
+	}
+	if got, err := packet.ParseReject(roundTrip(t, packet.NewRejectPacket("no"))); err != nil || got != "no" {
+		t.Errorf("reject %q, %v", got, err)
+	}
+
+	probe := packet.Probe{Seq: 0xfffffff0, Timestamp: -12345}
+	if got, err := packet.ParseProbe(roundTrip(t, packet.NewProbePacket(probe))); err != nil || got != probe {
+		t.Errorf("probe %+v, %v, want %+v", got, err, probe)
+	}
+	if got, err := packet.ParseProbe(roundTrip(t, packet.NewEchoPacket(probe))); err != nil || got != probe {
+		t.Errorf("echo %+v, %v, want %+v", got, err, probe)
+	}
+
+	feedback := packet.Feedback{
+		Timestamp: 1 << 62, Sent: 1, Received: 2, Bytes: 1 << 40, MarkSent: 3, MarkReceived: 0xffffffff,
+	}
+	if got, err := packet.ParseFeedback(roundTrip(t, packet.NewFeedbackPacket(feedback))); err != nil || got != feedback {
+		t.Errorf("feedback %+v, %v, want %+v", got, err, feedback)
+	}
+
+	announce := packet.Announce{Traffic: config.UpTrafficType, Weight: 300, Standby: true}
+	if got, err := packet.ParseAnnounce(roundTrip(t, packet.NewAnnouncePacket(announce))); err != nil || got != announce {
+		t.Errorf("announce %+v, %v, want %+v", got, err, announce)
+	}
+
+	challenge := packet.Challenge{Timestamp: 42, Cookie: [packet.COOKIE_SIZE]byte{1, 2, 3}}
+	if got, err := packet.ParseChallenge(roundTrip(t, packet.NewChallengePacket(challenge))); err != nil || got != challenge {
+		t.Errorf("challenge %+v, %v, want %+v", got, err, challenge)
+	}
+	response := packet.Response{Challenge: challenge, MAC: [packet.AUTH_MAC_SIZE]byte{9}, Hello: hello}
+	if got, err := packet.ParseResponse(roundTrip(t, packet.NewResponsePacket(response))); err != nil || got != response {
+		t.Errorf("response %+v, %v, want %+v", got, err, response)
+	}
+}
+
+func TestHelloHeartbeatInterval(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		want     time.Duration
+	}{
+		{0, 0}, // disabled
+		{time.Second, time.Second},
+		{time.Microsecond, time.Millisecond}, // rounded up, not to disabled
+		{1500 * time.Microsecond, 2 * time.Millisecond},
+		{math.MaxInt64, math.MaxUint32 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		hello := packet.Hello{Version: packet.VERSION, HeartbeatInterval: tt.interval}
+		got, err := packet.ParseHello(roundTrip(t, packet.NewHelloPacket(hello)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.HeartbeatInterval != tt.want {
+			t.Errorf("interval %v told as %v, want %v", tt.interval, got.HeartbeatInterval, tt.want)
+		}
+	}
+}
+
+// TestControlTooShort rejects control packets cut short, e.g. from an older
+// peer.
+func TestControlTooShort(t *testing.T) {
+	short := func(p *packet.Packet) *packet.Packet {
+		p.Buffer = p.Buffer[:len(p.Buffer)-1]
+		return p
+	}
+	if _, err := packet.ParseHello(short(packet.NewHelloPacket(packet.Hello{}))); err != packet.ErrInvalidControl {
+		t.Errorf("hello: %v", err)
+	}
+	if _, err := packet.ParseProbe(short(packet.NewProbePacket(packet.Probe{}))); err != packet.ErrInvalidControl {
+		t.Errorf("probe: %v", err)
+	}
+	if _, err := packet.ParseFeedback(short(packet.NewFeedbackPacket(packet.Feedback{}))); err != packet.ErrInvalidControl {
+		t.Errorf("feedback: %v", err)
+	}
+	if _, err := packet.ParseChallenge(short(packet.NewChallengePacket(packet.Challenge{}))); err != packet.ErrInvalidControl {
+		t.Errorf("challenge: %v", err)
+	}
+	if _, err := packet.ParseResponse(short(packet.NewResponsePacket(packet.Response{}))); err != packet.ErrInvalidControl {
+		t.Errorf("response: %v", err)
+	}
+	data := &packet.Packet{Buffer: []byte{byte(packet.HeartbeatControlType)}}
+	if data.ControlType() != packet.NotDefinedControlType {
+		t.Error("data packet taken as control")
+	}
+}
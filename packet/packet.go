@@ -1,66 +1,245 @@
 package packet
 
 import (
-	"bytes"
 	"errors"
 
 	"github.com/sigurn/crc8"
 )
 
+type PacketType uint8
+
+const (
+	DataPacketType PacketType = iota
+	ControlPacketType
+	ParityPacketType
+)
+
 type Packet struct {
-	Buffer   []byte
-	ConnID   uint16
-	PacketID uint16
+	Buffer []byte
+	// SessionID identifies a client. It is chosen by the client and echoed by
+	// the server in the traffic of the session.
+	SessionID uint32
+	ServiceID uint16
+	ConnID    uint32
+	PacketID  uint32
+	// ConnSeq is the sequence of a data packet within its connection, set
+	// with SequencedFlag. Packet ids are shared by all connections, so that
+	// a gap of them does not tell which connection misses a packet.
+	ConnSeq  uint32
+	Type     PacketType
+	Version  uint8 // wire format, VERSION if 0 when packing
+	Flags    Flags
+	WireSize int // bytes taken on the wire, set by Unpack
+
+	header []byte // raw header of an unpacked packet, for authentication
 }
 
+// Flags tell how a packet is packed. Unknown flags are ignored, so that new
+// ones can be added without breaking older peers as long as they are
+// negotiated first.
+type Flags uint8
+
+const (
+	EncryptedFlag Flags = 1 << iota // payload is sealed by Cipher
+	// SequencedFlag tells that ConnSeq is in front of the payload of a data
+	// packet, and that the shards of a parity packet carry it as well
+	SequencedFlag
+)
+
 var (
 	ErrPacketTooShort     = errors.New("packet too short")
 	ErrInvalidMagicNumber = errors.New("invalid magic number")
 	ErrInvalidCRC         = errors.New("invalid crc")
+	ErrInvalidVersion     = errors.New("invalid version")
+	ErrInvalidType        = errors.New("invalid packet type")
+	ErrInvalidSequence    = errors.New("invalid sequence")
 	table                 = crc8.MakeTable(crc8.CRC8_MAXIM)
 )
 
+/*
+Header of the current version, in little endian:
+
+	magic(1) version(1) type(1) flags(1) length(2)
+	session id(4) service id(2) conn id(4) packet id(4) crc8(1)
+
+followed by conn seq(4) of a sequenced data packet, counted in length and
+sealed with the payload.
+
+Legacy header of data packets, with no session or service:
+
+	magic(1) length(2) conn id(2) packet id(2) crc8(1)
+*/
 const (
-	MAGIC_NUMBER = 0xa1
-	HEADER_SIZE  = 8
+	MAGIC_NUMBER  = 0xa5
+	VERSION       = 2
+	HEADER_SIZE   = 21
+	SEQUENCE_SIZE = 4
+
+	LEGACY_MAGIC_NUMBER = 0xa1
+	LEGACY_VERSION      = 1
+	LEGACY_HEADER_SIZE  = 8
 )
 
 func (p *Packet) Pack(buffer []byte) (length int) {
+	payloadLength := p.payloadLength()
+	headerSize := p.packHeader(buffer, payloadLength, p.Flags)
+	p.packPayload(buffer[headerSize:])
+	return headerSize + payloadLength
+}
+
+// sequenced reports whether ConnSeq goes with the payload.
+func (p *Packet) sequenced() bool {
+	return p.Flags&SequencedFlag != 0 && p.Type == DataPacketType && p.Version != LEGACY_VERSION
+}
+
+// payloadLength is the length of the payload on the wire, before sealing.
+func (p *Packet) payloadLength() int {
+	if p.sequenced() {
+		return SEQUENCE_SIZE + len(p.Buffer)
+	}
+	return len(p.Buffer)
+}
+
+func (p *Packet) packPayload(buffer []byte) {
+	if p.sequenced() {
+		putUint32(buffer, p.ConnSeq)
+		buffer = buffer[SEQUENCE_SIZE:]
+	}
+	copy(buffer, p.Buffer)
+}
+
+// unpackSequence takes ConnSeq from the front of the payload of a sequenced
+// data packet, once it is opened.
+func (p *Packet) unpackSequence() error {
+	if !p.sequenced() {
+		return nil
+	}
+	if len(p.Buffer) < SEQUENCE_SIZE {
+		return ErrInvalidSequence
+	}
+	p.ConnSeq = getUint32(p.Buffer)
+	p.Buffer = p.Buffer[SEQUENCE_SIZE:]
+	return nil
+}
+
+func (p *Packet) packHeader(buffer []byte, payloadLength int, flags Flags) (headerSize int) {
+	if p.Version == LEGACY_VERSION {
+		return p.packLegacyHeader(buffer, payloadLength)
+	}
 	buffer[0] = MAGIC_NUMBER
-	buffer[1] = byte(len(p.Buffer))
-	buffer[2] = byte(len(p.Buffer) >> 8)
+	buffer[1] = VERSION
+	buffer[2] = byte(p.Type)
+	buffer[3] = byte(flags)
+	buffer[4] = byte(payloadLength)
+	buffer[5] = byte(payloadLength >> 8)
+	putUint32(buffer[6:], p.SessionID)
+	buffer[10] = byte(p.ServiceID)
+	buffer[11] = byte(p.ServiceID >> 8)
+	putUint32(buffer[12:], p.ConnID)
+	putUint32(buffer[16:], p.PacketID)
+	buffer[HEADER_SIZE-1] = crc8.Checksum(buffer[:HEADER_SIZE-1], table)
+	return HEADER_SIZE
+}
+
+func (p *Packet) packLegacyHeader(buffer []byte, payloadLength int) (headerSize int) {
+	buffer[0] = LEGACY_MAGIC_NUMBER
+	buffer[1] = byte(payloadLength)
+	buffer[2] = byte(payloadLength >> 8)
 	buffer[3] = byte(p.ConnID)
 	buffer[4] = byte(p.ConnID >> 8)
 	buffer[5] = byte(p.PacketID)
 	buffer[6] = byte(p.PacketID >> 8)
-	crc := crc8.Checksum(buffer[:7], table)
-	buffer[7] = crc
-	copy(buffer[HEADER_SIZE:], p.Buffer)
-	return HEADER_SIZE + len(p.Buffer)
+	buffer[LEGACY_HEADER_SIZE-1] = crc8.Checksum(buffer[:LEGACY_HEADER_SIZE-1], table)
+	return LEGACY_HEADER_SIZE
+}
+
+func putUint32(buffer []byte, v uint32) {
+	buffer[0] = byte(v)
+	buffer[1] = byte(v >> 8)
+	buffer[2] = byte(v >> 16)
+	buffer[3] = byte(v >> 24)
+}
+
+func getUint32(buffer []byte) uint32 {
+	return uint32(buffer[0]) | uint32(buffer[1])<<8 | uint32(buffer[2])<<16 | uint32(buffer[3])<<24
+}
+
+func putUint64(buffer []byte, v uint64) {
+	putUint32(buffer, uint32(v))
+	putUint32(buffer[4:], uint32(v>>32))
+}
+
+func getUint64(buffer []byte) uint64 {
+	return uint64(getUint32(buffer)) | uint64(getUint32(buffer[4:]))<<32
+}
+
+// headerSize returns the header size by the magic number, or 0 if it is not
+// a magic number.
+func headerSize(magic byte) int {
+	switch magic {
+	case MAGIC_NUMBER:
+		return HEADER_SIZE
+	case LEGACY_MAGIC_NUMBER:
+		return LEGACY_HEADER_SIZE
+	default:
+		return 0
+	}
 }
 
 func Unpack(buffer []byte) (*Packet, int, error) {
-	if len(buffer) < HEADER_SIZE {
+	if len(buffer) == 0 {
 		return nil, 0, ErrPacketTooShort
 	}
-	if buffer[0] != MAGIC_NUMBER {
+	size := headerSize(buffer[0])
+	if size == 0 {
 		return nil, 0, ErrInvalidMagicNumber
 	}
-	crc := crc8.Checksum(buffer[:HEADER_SIZE-1], table)
-	if crc != buffer[HEADER_SIZE-1] {
+	if len(buffer) < size {
+		return nil, 0, ErrPacketTooShort
+	}
+	crc := crc8.Checksum(buffer[:size-1], table)
+	if crc != buffer[size-1] {
 		return nil, 0, ErrInvalidCRC
 	}
-	length := int(buffer[1]) | int(buffer[2])<<8
-	if length > len(buffer)-HEADER_SIZE {
+	var packet *Packet
+	var length int
+	if size == LEGACY_HEADER_SIZE {
+		length = int(buffer[1]) | int(buffer[2])<<8
+		packet = &Packet{
+			ConnID:   uint32(buffer[3]) | uint32(buffer[4])<<8,
+			PacketID: uint32(buffer[5]) | uint32(buffer[6])<<8,
+			Version:  LEGACY_VERSION,
+		}
+	} else {
+		if buffer[1] != VERSION {
+			return nil, 0, ErrInvalidVersion
+		}
+		if PacketType(buffer[2]) > ParityPacketType {
+			return nil, 0, ErrInvalidType
+		}
+		length = int(buffer[4]) | int(buffer[5])<<8
+		packet = &Packet{
+			SessionID: getUint32(buffer[6:]),
+			ServiceID: uint16(buffer[10]) | uint16(buffer[11])<<8,
+			ConnID:    getUint32(buffer[12:]),
+			PacketID:  getUint32(buffer[16:]),
+			Type:      PacketType(buffer[2]),
+			Version:   VERSION,
+			Flags:     Flags(buffer[3]),
+		}
+	}
+	if length > len(buffer)-size {
 		return nil, 0, ErrPacketTooShort
 	}
-	packet := &Packet{
-		Buffer:   buffer[HEADER_SIZE : HEADER_SIZE+length],
-		ConnID:   uint16(buffer[3]) | uint16(buffer[4])<<8,
-		PacketID: uint16(buffer[5]) | uint16(buffer[6])<<8,
+	packet.Buffer = buffer[size : size+length]
+	packet.header = buffer[:size]
+	packet.WireSize = size + length
+	if packet.Flags&EncryptedFlag == 0 {
+		if err := packet.unpackSequence(); err != nil {
+			return nil, 0, err
+		}
 	}
-	parsed := HEADER_SIZE + length
-	return packet, parsed, nil
+	return packet, size + length, nil
 }
 
 func ParsePacket(buffer []byte) ([]*Packet, int, error) {
@@ -71,16 +250,16 @@ func ParsePacket(buffer []byte) ([]*Packet, int, error) {
 		case nil:
 			packets = append(packets, packet)
 			ptr += parsed
-		case ErrInvalidMagicNumber, ErrInvalidCRC:
-			offset := bytes.IndexByte(buffer[ptr+1:], MAGIC_NUMBER)
+		case ErrInvalidMagicNumber, ErrInvalidCRC, ErrInvalidVersion, ErrInvalidType, ErrInvalidSequence:
+			offset := indexMagicNumber(buffer[ptr+1:])
 			if offset == -1 {
 				return packets, 0, nil
 			}
 			ptr += offset + 1
 		case ErrPacketTooShort:
 			remainingBytes := len(buffer) - ptr
-			if remainingBytes >= HEADER_SIZE {
-				offset := bytes.IndexByte(buffer[ptr+1:], MAGIC_NUMBER)
+			if remainingBytes >= headerSize(buffer[ptr]) {
+				offset := indexMagicNumber(buffer[ptr+1:])
 				if offset == -1 {
 					return packets, 0, nil
 				}
@@ -94,3 +273,12 @@ func ParsePacket(buffer []byte) ([]*Packet, int, error) {
 	}
 	return packets, 0, nil
 }
+
+func indexMagicNumber(buffer []byte) int {
+	for i, b := range buffer {
+		if headerSize(b) != 0 {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,210 @@
+package packet_test
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/chenx-dust/paracat/packet"
+	"github.com/sigurn/crc8"
+)
+
+// pack packs p with c, nil for cleartext.
+func pack(c *packet.Cipher, p *packet.Packet) []byte {
+	buffer := make([]byte, len(p.Buffer)+c.Overhead())
+	return buffer[:c.Pack(p, buffer)]
+}
+
+func samePacket(got *packet.Packet, want *packet.Packet) bool {
+	return bytes.Equal(got.Buffer, want.Buffer) &&
+		got.SessionID == want.SessionID && got.ServiceID == want.ServiceID &&
+		got.ConnID == want.ConnID && got.PacketID == want.PacketID &&
+		got.ConnSeq == want.ConnSeq && got.Type == want.Type
+}
+
+func TestPackUnpack(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet packet.Packet
+		want   packet.Packet // as unpacked
+		size   int
+	}{
+		{
+			name: "data",
+			packet: packet.Packet{
+				Buffer: []byte("hello"), SessionID: 0xdeadbeef, ServiceID: 0x1234,
+				ConnID: 0x89abcdef, PacketID: 0xfedcba98,
+			},
+			want: packet.Packet{
+				Buffer: []byte("hello"), SessionID: 0xdeadbeef, ServiceID: 0x1234,
+				ConnID: 0x89abcdef, PacketID: 0xfedcba98, Version: packet.VERSION,
+			},
+			size: packet.HEADER_SIZE + 5,
+		},
+		{
+			name:   "empty",
+			packet: packet.Packet{PacketID: 1},
+			want:   packet.Packet{Buffer: []byte{}, PacketID: 1, Version: packet.VERSION},
+			size:   packet.HEADER_SIZE,
+		},
+		{
+			name:   "sequenced",
+			packet: packet.Packet{Buffer: []byte("hi"), ConnID: 7, ConnSeq: 0x01020304, Flags: packet.SequencedFlag},
+			want: packet.Packet{
+				Buffer: []byte("hi"), ConnID: 7, ConnSeq: 0x01020304,
+				Version: packet.VERSION, Flags: packet.SequencedFlag,
+			},
+			size: packet.HEADER_SIZE + packet.SEQUENCE_SIZE + 2,
+		},
+		{
+			name:   "sequenced control",
+			packet: *flagged(packet.NewHeartbeatPacket(), packet.SequencedFlag),
+			want: packet.Packet{
+				Buffer: []byte{byte(packet.HeartbeatControlType)}, Type: packet.ControlPacketType,
+				Version: packet.VERSION, Flags: packet.SequencedFlag,
+			},
+			size: packet.HEADER_SIZE + 1,
+		},
+		{
+			name: "legacy data",
+			packet: packet.Packet{
+				Buffer: []byte("hello"), SessionID: 5, ServiceID: 6,
+				ConnID: 0x1234, PacketID: 0xabcd, Version: packet.LEGACY_VERSION,
+			},
+			want: packet.Packet{
+				Buffer: []byte("hello"), ConnID: 0x1234, PacketID: 0xabcd, Version: packet.LEGACY_VERSION,
+			},
+			size: packet.LEGACY_HEADER_SIZE + 5,
+		},
+		{
+			name: "legacy truncated ids",
+			packet: packet.Packet{
+				Buffer: []byte("x"), ConnID: 0x12345678, PacketID: 0x9abcdef0, Version: packet.LEGACY_VERSION,
+			},
+			want: packet.Packet{
+				Buffer: []byte("x"), ConnID: 0x5678, PacketID: 0xdef0, Version: packet.LEGACY_VERSION,
+			},
+			size: packet.LEGACY_HEADER_SIZE + 1,
+		},
+		{
+			name: "legacy sequenced",
+			packet: packet.Packet{
+				Buffer: []byte("x"), ConnSeq: 9, Flags: packet.SequencedFlag, Version: packet.LEGACY_VERSION,
+			},
+			want: packet.Packet{Buffer: []byte("x"), Version: packet.LEGACY_VERSION},
+			size: packet.LEGACY_HEADER_SIZE + 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := pack(nil, &tt.packet)
+			if len(buffer) != tt.size {
+				t.Errorf("packed %d bytes, want %d", len(buffer), tt.size)
+			}
+			got, parsed, err := packet.Unpack(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed != len(buffer) || got.WireSize != len(buffer) {
+				t.Errorf("parsed %d bytes, wire size %d, want %d", parsed, got.WireSize, len(buffer))
+			}
+			if !samePacket(got, &tt.want) || got.Version != tt.want.Version || got.Flags != tt.want.Flags {
+				t.Errorf("unpacked %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func flagged(p *packet.Packet, flags packet.Flags) *packet.Packet {
+	p.Flags |= flags
+	return p
+}
+
+func TestUnpackErrors(t *testing.T) {
+	valid := pack(nil, &packet.Packet{Buffer: []byte("hello"), PacketID: 1})
+	modified := func(i int, b byte) []byte {
+		buffer := bytes.Clone(valid)
+		buffer[i] = b
+		return buffer
+	}
+	tests := []struct {
+		name   string
+		buffer []byte
+		want   error
+	}{
+		{"empty", nil, packet.ErrPacketTooShort},
+		{"magic", modified(0, 0x00), packet.ErrInvalidMagicNumber},
+		{"interim legacy magic", modified(0, 0xa2), packet.ErrInvalidMagicNumber},
+		{"short header", valid[:packet.HEADER_SIZE-1], packet.ErrPacketTooShort},
+		{"short payload", valid[:len(valid)-1], packet.ErrPacketTooShort},
+		{"crc", modified(packet.HEADER_SIZE-1, valid[packet.HEADER_SIZE-1]^1), packet.ErrInvalidCRC},
+		{"field", modified(8, valid[8]^1), packet.ErrInvalidCRC},
+		{"version", withCRC(modified(1, 3)), packet.ErrInvalidVersion},
+		{"type", withCRC(modified(2, 3)), packet.ErrInvalidType},
+		{"short sequence", withCRC(packShortSequence()), packet.ErrInvalidSequence},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := packet.Unpack(tt.buffer); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// packShortSequence packs a sequenced data packet with a payload shorter
+// than its sequence.
+func packShortSequence() []byte {
+	buffer := pack(nil, &packet.Packet{Buffer: []byte("abc")})
+	buffer[3] = byte(packet.SequencedFlag)
+	return buffer
+}
+
+// TestParsePacket finds packets in a stream, skipping what is not.
+func TestParsePacket(t *testing.T) {
+	first := pack(nil, &packet.Packet{Buffer: []byte("first"), PacketID: 1})
+	second := pack(nil, &packet.Packet{Buffer: []byte("second"), PacketID: 2})
+	corrupt := bytes.Clone(second)
+	corrupt[8] ^= 1
+	tests := []struct {
+		name      string
+		stream    []byte
+		wantIDs   []uint32
+		remaining int
+	}{
+		{"two", concat(first, second), []uint32{1, 2}, 0},
+		{"garbage between", concat(first, []byte{0, 1, 2, 3}, second), []uint32{1, 2}, 0},
+		{"garbage with magic", concat([]byte{packet.MAGIC_NUMBER, 7, packet.LEGACY_MAGIC_NUMBER}, first), []uint32{1}, 0},
+		{"corrupt between", concat(first, corrupt, second), []uint32{1, 2}, 0},
+		{"short sequence between", concat(first, withCRC(packShortSequence()), second), []uint32{1, 2}, 0},
+		{"partial header", concat(first, second[:10]), []uint32{1}, 10},
+		{"only garbage", []byte{0, 1, 2}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packets, remaining, err := packet.ParsePacket(tt.stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []uint32
+			for _, p := range packets {
+				ids = append(ids, p.PacketID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) || remaining != tt.remaining {
+				t.Errorf("parsed %v with %d remaining, want %v with %d", ids, remaining, tt.wantIDs, tt.remaining)
+			}
+		})
+	}
+}
+
+func concat(buffers ...[]byte) []byte {
+	return bytes.Join(buffers, nil)
+}
+
+var table = crc8.MakeTable(crc8.CRC8_MAXIM)
+
+// withCRC fixes the crc of a modified header.
+func withCRC(buffer []byte) []byte {
+	buffer[packet.HEADER_SIZE-1] = crc8.Checksum(buffer[:packet.HEADER_SIZE-1], table)
+	return buffer
+}
@@ -0,0 +1,55 @@
+package packet
+
+import "errors"
+
+var ErrInvalidParity = errors.New("invalid parity packet")
+
+// Parity is a forward error correction shard protecting a group of data
+// packets. The group id is carried in the PacketID field of the header.
+type Parity struct {
+	GroupID   uint32
+	Index     uint8
+	PacketIDs []uint32 // data packets of the group, in shard order
+	Shard     []byte
+}
+
+const parityHeaderSize = 2
+
+func NewParityPacket(parity Parity) *Packet {
+	buffer := make([]byte, parityHeaderSize+4*len(parity.PacketIDs)+len(parity.Shard))
+	buffer[0] = byte(len(parity.PacketIDs))
+	buffer[1] = parity.Index
+	ptr := parityHeaderSize
+	for _, id := range parity.PacketIDs {
+		putUint32(buffer[ptr:], id)
+		ptr += 4
+	}
+	copy(buffer[ptr:], parity.Shard)
+	return &Packet{
+		Buffer:   buffer,
+		PacketID: parity.GroupID,
+		Type:     ParityPacketType,
+	}
+}
+
+// ParseParity parses a parity packet. The shard refers to the packet buffer.
+func ParseParity(p *Packet) (Parity, error) {
+	if p.Type != ParityPacketType || len(p.Buffer) < parityHeaderSize {
+		return Parity{}, ErrInvalidParity
+	}
+	count := int(p.Buffer[0])
+	ptr := parityHeaderSize + 4*count
+	if count == 0 || len(p.Buffer) <= ptr {
+		return Parity{}, ErrInvalidParity
+	}
+	parity := Parity{
+		GroupID:   p.PacketID,
+		Index:     p.Buffer[1],
+		PacketIDs: make([]uint32, count),
+		Shard:     p.Buffer[ptr:],
+	}
+	for i := range parity.PacketIDs {
+		parity.PacketIDs[i] = getUint32(p.Buffer[parityHeaderSize+4*i:])
+	}
+	return parity, nil
+}
@@ -4,9 +4,13 @@ import (
 	"sync/atomic"
 )
 
+// PacketStatistic counts packets and their bytes, both since the last
+// GetAndReset and in total since creation.
 type PacketStatistic struct {
-	packetCount atomic.Uint32
-	bandwidth   atomic.Uint64
+	packetCount    atomic.Uint32
+	bandwidth      atomic.Uint64
+	totalCount     atomic.Uint64
+	totalBandwidth atomic.Uint64
 }
 
 func NewPacketStatistic() *PacketStatistic {
@@ -14,8 +18,14 @@ func NewPacketStatistic() *PacketStatistic {
 }
 
 func (ps *PacketStatistic) CountPacket(size uint32) {
-	ps.packetCount.Add(1)
-	ps.bandwidth.Add(uint64(size))
+	ps.CountPackets(1, uint64(size))
+}
+
+func (ps *PacketStatistic) CountPackets(count uint32, size uint64) {
+	ps.packetCount.Add(count)
+	ps.bandwidth.Add(size)
+	ps.totalCount.Add(uint64(count))
+	ps.totalBandwidth.Add(size)
 }
 
 func (ps *PacketStatistic) GetAndReset() (count uint32, bandwidth uint64) {
@@ -23,3 +33,9 @@ func (ps *PacketStatistic) GetAndReset() (count uint32, bandwidth uint64) {
 	bandwidth = ps.bandwidth.Swap(0)
 	return
 }
+
+// Total returns what is counted since creation, which is not reset by
+// GetAndReset.
+func (ps *PacketStatistic) Total() (count uint64, bandwidth uint64) {
+	return ps.totalCount.Load(), ps.totalBandwidth.Load()
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"time"
+
+	"github.com/chenx-dust/paracat/packet"
+)
+
+// challengeLifetime bounds how long a challenge can be answered.
+const challengeLifetime = 30 * time.Second
+
+// Authenticator runs a challenge-response handshake with a pre-shared key.
+// Challenges are stateless: the cookie is a MAC of the peer address and the
+// timestamp under a secret only known to the server, so unauthenticated
+// peers cost nothing until they answer correctly.
+type Authenticator struct {
+	psk    []byte
+	secret [32]byte
+}
+
+func NewAuthenticator(psk string) (*Authenticator, error) {
+	a := &Authenticator{psk: []byte(psk)}
+	if _, err := rand.Read(a.secret[:]); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func timestampBytes(timestamp int64) []byte {
+	b := make([]byte, 8)
+	for i := 0; i < 8; i++ {
+		b[i] = byte(timestamp >> (8 * i))
+	}
+	return b
+}
+
+func (a *Authenticator) cookie(peer string, timestamp int64) (cookie [packet.COOKIE_SIZE]byte) {
+	mac := hmac.New(sha256.New, a.secret[:])
+	mac.Write([]byte(peer))
+	mac.Write(timestampBytes(timestamp))
+	copy(cookie[:], mac.Sum(nil))
+	return
+}
+
+func (a *Authenticator) mac(challenge packet.Challenge) (sum [packet.AUTH_MAC_SIZE]byte) {
+	mac := hmac.New(sha256.New, a.psk)
+	mac.Write([]byte("paracat auth"))
+	mac.Write(timestampBytes(challenge.Timestamp))
+	mac.Write(challenge.Cookie[:])
+	copy(sum[:], mac.Sum(nil))
+	return
+}
+
+// Challenge creates a challenge for peer, which is the remote address of
+// the path as seen by the server.
+func (a *Authenticator) Challenge(peer string) packet.Challenge {
+	timestamp := time.Now().UnixNano()
+	return packet.Challenge{
+		Timestamp: timestamp,
+		Cookie:    a.cookie(peer, timestamp),
+	}
+}
+
+func (a *Authenticator) Respond(challenge packet.Challenge) packet.Response {
+	return packet.Response{
+		Challenge: challenge,
+		MAC:       a.mac(challenge),
+	}
+}
+
+// Verify checks that response answers a recent challenge sent to peer.
+func (a *Authenticator) Verify(peer string, response packet.Response) bool {
+	age := time.Since(time.Unix(0, response.Challenge.Timestamp))
+	if age < 0 || age > challengeLifetime {
+		return false
+	}
+	cookie := a.cookie(peer, response.Challenge.Timestamp)
+	if !hmac.Equal(cookie[:], response.Challenge.Cookie[:]) {
+		return false
+	}
+	mac := a.mac(response.Challenge)
+	return hmac.Equal(mac[:], response.MAC[:])
+}
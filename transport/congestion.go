@@ -0,0 +1,291 @@
+package transport
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+const (
+	// congestionLoss is the smoothed loss ratio taken as congestion. Lower
+	// loss is taken as random, e.g. on radio links.
+	congestionLoss = 0.05
+	// congestionDecrease is the share of the delivery rate paced to on
+	// congestion.
+	congestionDecrease = 0.85
+	// congestionIncrease is the least rate added on every feedback while the
+	// path is fully used, in bytes per second. Fast paths add a share of
+	// their rate instead, so that they do not take ages to grow.
+	congestionIncrease      = 64 * 1024
+	congestionIncreaseShare = 1.0 / 16
+	// congestionBusy is the share of the rate sent above which a path is
+	// taken as fully used. Paths not fully used do not grow.
+	congestionBusy = 0.8
+	// congestionSamples is the least number of packets a loss sample is
+	// taken over, so that a few packets do not make a big ratio.
+	congestionSamples = 16
+	minPacingRate     = 64 * 1024
+	// pacingBurst is how far sending may get ahead of the rate after a pause.
+	pacingBurst = 10 * time.Millisecond
+	// lossyRecovery is the share of the lossy threshold the loss has to fall
+	// below for a lossy path to be fine again, so that it does not flap.
+	lossyRecovery = 0.5
+)
+
+// Congestion learns the capacity of a path from the feedback of its peer,
+// and paces sending to it. The rate is cut to a share of the delivery rate
+// whenever the loss rises above a threshold, and raised step by step while
+// the path is fully used otherwise (AIMD). A path is not paced until its
+// first congestion.
+type Congestion struct {
+	enabled  bool // pacing, feedback is counted and sent anyway
+	interval time.Duration
+	rtt      func() time.Duration
+	onRate   func(rate float64)
+	feedback atomic.Bool // the peer understands and sends feedback
+	// feedbackCh passes feedback ahead of the packets queued on the path,
+	// so that its sent count is what goes on the wire before it
+	feedbackCh chan buffer.ArgPtr[*buffer.PackedBuffer]
+
+	receivedPackets atomic.Uint32
+	receivedBytes   atomic.Uint64
+	mark            atomic.Uint64 // sent of the latest peer feedback << 32 | received by then
+
+	mutex         sync.Mutex
+	sentPackets   uint32
+	sentBytes     uint64
+	nextSend      time.Time
+	last          packet.Feedback
+	lastValid     bool
+	lastSentBytes uint64
+	lastSentAt    time.Time
+	lossSent      uint32 // mark of the latest loss sample
+	lossReceived  uint32
+	lossValid     bool    // a mark is taken
+	rate          float64 // bytes per second, 0 for not paced
+	deliveryRate  float64 // bytes per second
+	loss          float64
+	lossy         bool
+	lastDecrease  time.Time
+}
+
+// NewCongestion creates the congestion control of a path. Feedback is sent
+// every interval, and rtt tells the round-trip time of the path, 0 for
+// unknown. onRate is called with every new pacing rate.
+func NewCongestion(enabled bool, interval time.Duration, rtt func() time.Duration, onRate func(rate float64)) *Congestion {
+	return &Congestion{
+		enabled:    enabled,
+		interval:   interval,
+		rtt:        rtt,
+		onRate:     onRate,
+		feedbackCh: make(chan buffer.ArgPtr[*buffer.PackedBuffer], 1),
+	}
+}
+
+// SetFeedback tells whether the peer understands feedback.
+func (cc *Congestion) SetFeedback(enabled bool) {
+	cc.feedback.Store(enabled)
+}
+
+// Received counts what arrived on the path, to be reported to the peer.
+func (cc *Congestion) Received(packets int, bytes int) {
+	cc.receivedPackets.Add(uint32(packets))
+	cc.receivedBytes.Add(uint64(bytes))
+}
+
+// Pace counts what is sent on the path, and tells how long to wait before
+// sending it.
+func (cc *Congestion) Pace(packets int, bytes int) time.Duration {
+	now := time.Now()
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.sentPackets += uint32(packets)
+	cc.sentBytes += uint64(bytes)
+	if cc.rate == 0 {
+		return 0
+	}
+	if earliest := now.Add(-pacingBurst); cc.nextSend.Before(earliest) {
+		cc.nextSend = earliest
+	}
+	var wait time.Duration
+	if cc.nextSend.After(now) {
+		wait = cc.nextSend.Sub(now)
+	}
+	cc.nextSend = cc.nextSend.Add(time.Duration(float64(bytes) / cc.rate * float64(time.Second)))
+	return wait
+}
+
+// pace waits until pBuffer may be sent by both cc and limiter, and reports
+// false if ctx is done meanwhile.
+func pace[T cancelableContext](ctx T, cc *Congestion, limiter *TokenBucket, pBuffer *buffer.PackedBuffer) bool {
+	wait := max(cc.Pace(len(pBuffer.SubPackets), pBuffer.TotalSize), limiter.Take(pBuffer.TotalSize))
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// nextToSend takes the next buffer to send on a path, feedback first, and
+// reports false if ctx is done.
+func nextToSend[T cancelableContext](ctx T, inChan <-chan buffer.ArgPtr[*buffer.PackedBuffer], cc *Congestion) (buffer.ArgPtr[*buffer.PackedBuffer], bool) {
+	select {
+	case pBuffer := <-cc.feedbackCh:
+		return pBuffer, true
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return buffer.ArgPtr[*buffer.PackedBuffer]{}, false
+	case pBuffer := <-cc.feedbackCh:
+		return pBuffer, true
+	case pBuffer := <-inChan:
+		return pBuffer, true
+	}
+}
+
+// HandleFeedback marks the feedback of the peer for the next own one, and
+// updates the estimation of the path and the pacing rate if enabled.
+func (cc *Congestion) HandleFeedback(p *packet.Packet) {
+	feedback, err := packet.ParseFeedback(p)
+	if err != nil {
+		return
+	}
+	cc.mark.Store(uint64(feedback.Sent)<<32 | uint64(cc.receivedPackets.Load()))
+	now := time.Now()
+	rtt := cc.rtt()
+	cc.mutex.Lock()
+	rate, changed := cc.update(feedback, now, rtt)
+	cc.mutex.Unlock()
+	if changed && cc.onRate != nil {
+		cc.onRate(rate)
+	}
+}
+
+// update should be called with mutex held.
+func (cc *Congestion) update(feedback packet.Feedback, now time.Time, rtt time.Duration) (float64, bool) {
+	last, lastValid := cc.last, cc.lastValid
+	cc.last, cc.lastValid = feedback, true
+	sentRate := float64(cc.sentBytes-cc.lastSentBytes) / now.Sub(cc.lastSentAt).Seconds()
+	cc.lastSentBytes, cc.lastSentAt = cc.sentBytes, now
+	elapsed := time.Duration(feedback.Timestamp - last.Timestamp)
+	if !lastValid || elapsed <= 0 {
+		// the first one, or reordered
+		return cc.rate, false
+	}
+	cc.deliveryRate = float64(feedback.Bytes-last.Bytes) / elapsed.Seconds()
+	if !cc.lossValid {
+		// loss is counted from the first mark, as packets before it may be
+		// dropped on purpose, e.g. by the server before the path is accepted
+		if feedback.MarkSent != 0 || feedback.MarkReceived != 0 {
+			cc.lossSent, cc.lossReceived, cc.lossValid = feedback.MarkSent, feedback.MarkReceived, true
+		}
+	} else if sent := feedback.MarkSent - cc.lossSent; int32(sent) >= congestionSamples {
+		received := feedback.MarkReceived - cc.lossReceived
+		loss := 0.0
+		if received < sent {
+			loss = 1 - float64(received)/float64(sent)
+		}
+		cc.loss = (cc.loss + loss) / 2
+		cc.lossSent, cc.lossReceived = feedback.MarkSent, feedback.MarkReceived
+	}
+	if !cc.enabled {
+		return cc.rate, false
+	}
+
+	rate := cc.rate
+	if cc.loss > congestionLoss {
+		// the loss of a cut shows up a round trip later at least
+		if now.Sub(cc.lastDecrease) > max(2*rtt, 4*cc.interval) {
+			rate = max(cc.deliveryRate*congestionDecrease, minPacingRate)
+			cc.lastDecrease = now
+		}
+	} else if rate > 0 && sentRate >= rate*congestionBusy {
+		rate += max(congestionIncrease, rate*congestionIncreaseShare)
+	}
+	if rate == cc.rate {
+		return rate, false
+	}
+	cc.rate = rate
+	return rate, true
+}
+
+// Lossy tells whether the loss of the path is above threshold, or has not
+// fallen well below it since. A threshold of 0 is never crossed.
+func (cc *Congestion) Lossy(threshold float64) bool {
+	if threshold <= 0 {
+		return false
+	}
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.loss > threshold {
+		cc.lossy = true
+	} else if cc.loss < threshold*lossyRecovery {
+		cc.lossy = false
+	}
+	return cc.lossy
+}
+
+// CongestionState is what is learned about a path.
+type CongestionState struct {
+	Rate         float64 // pacing rate in bytes per second, 0 for not paced
+	DeliveryRate float64 // bytes per second received by the peer
+	Loss         float64 // smoothed ratio of packets lost
+}
+
+func (cc *Congestion) State() CongestionState {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return CongestionState{
+		Rate:         cc.rate,
+		DeliveryRate: cc.deliveryRate,
+		Loss:         cc.loss,
+	}
+}
+
+// Drain releases the feedback not sent yet, once the path is closed.
+func (cc *Congestion) Drain() {
+	buffer.Drain(cc.feedbackCh)
+}
+
+// FeedbackLoop reports what arrived on the path to the peer, if it
+// understands feedback and anything arrived since the last report.
+func FeedbackLoop[T cancelableContext](ctx T, cc *Congestion, sender ControlSender) {
+	sender.ch = cc.feedbackCh
+	ticker := time.NewTicker(cc.interval)
+	defer ticker.Stop()
+	var lastReceived uint32
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		received := cc.receivedPackets.Load()
+		if !cc.feedback.Load() || received == lastReceived {
+			continue
+		}
+		lastReceived = received
+		mark := cc.mark.Load()
+		cc.mutex.Lock()
+		sent := cc.sentPackets
+		cc.mutex.Unlock()
+		sender.Send(packet.NewFeedbackPacket(packet.Feedback{
+			Timestamp:    time.Now().UnixNano(),
+			Sent:         sent,
+			Received:     received,
+			Bytes:        cc.receivedBytes.Load(),
+			MarkSent:     uint32(mark >> 32),
+			MarkReceived: uint32(mark),
+		}))
+	}
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/packet"
+)
+
+// FilterControlPackets passes control packets to handleControl and returns the
+// remaining data packets. handleControl must not keep the packet after return.
+func FilterControlPackets(packets []*packet.Packet, handleControl func(*packet.Packet)) []*packet.Packet {
+	dataPackets := packets[:0]
+	for _, p := range packets {
+		if p.Type == packet.ControlPacketType {
+			handleControl(p)
+			continue
+		}
+		dataPackets = append(dataPackets, p)
+	}
+	return dataPackets
+}
+
+// ControlSender queues control packets on a path's send channel.
+type ControlSender struct {
+	ch        chan<- buffer.ArgPtr[*buffer.PackedBuffer]
+	cipher    *packet.Cipher
+	sessionID uint32
+}
+
+func NewControlSender(ch chan<- buffer.ArgPtr[*buffer.PackedBuffer], cipher *packet.Cipher, sessionID uint32) ControlSender {
+	return ControlSender{ch: ch, cipher: cipher, sessionID: sessionID}
+}
+
+// Send packs p into a new buffer and queues it without blocking.
+func (sender ControlSender) Send(p *packet.Packet) bool {
+	p.SessionID = sender.sessionID
+	pBuffer := buffer.NewPackedBuffer()
+	size := sender.cipher.Pack(p, pBuffer.Ptr.Buffer[:])
+	pBuffer.Ptr.SubPackets = append(pBuffer.Ptr.SubPackets, size)
+	pBuffer.Ptr.TotalSize = size
+	select {
+	case sender.ch <- pBuffer.MoveArg():
+		return true
+	default:
+		pBuffer.Release()
+		return false
+	}
+}
+
+// AnnounceLoop repeats an announcement on lossy paths, so that the peer
+// learns it even if some of them are dropped or the peer restarts. announce
+// is called every time for the latest one.
+func AnnounceLoop[T cancelableContext](ctx T, sender ControlSender, announce func() *packet.Packet, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sender.Send(announce())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
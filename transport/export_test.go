@@ -0,0 +1,27 @@
+package transport
+
+import "time"
+
+// SetClock makes the bucket take the time from now, starting full.
+func (tb *TokenBucket) SetClock(now func() time.Time) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.now = now
+	tb.last = now()
+	tb.tokens = tb.capacity
+}
+
+// SetClock makes the quota take the time from now.
+func (q *Quota) SetClock(now func() time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.now = now
+}
+
+func (hb *Heartbeat) SendInterval() time.Duration {
+	return hb.sendInterval()
+}
+
+func (hb *Heartbeat) EffectiveTimeout() time.Duration {
+	return hb.effectiveTimeout()
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/chenx-dust/paracat/packet"
+)
+
+// heartbeatMissedLimit is how many heartbeats of the peer may be missed at
+// least before a path is dead, whatever the timeout is.
+const heartbeatMissedLimit = 3
+
+// Heartbeat tracks the liveness of a path from the heartbeats sent by its
+// peer. A path starts alive, and onChange is called on every transition.
+//
+// Both ends tell their intervals in hello and accept. Heartbeats are then
+// sent as often as either end asks for, so that an end in failover mode
+// hears from a peer with a longer interval as often as it wants to.
+type Heartbeat struct {
+	interval time.Duration
+	timeout  time.Duration
+	// peerInterval is that of the hello or accept of the peer, negative
+	// until it arrives
+	peerInterval atomic.Int64
+	changed      chan struct{}
+	lastSeen     atomic.Int64
+	alive        atomic.Bool
+	onChange     func(alive bool)
+}
+
+func NewHeartbeat(interval time.Duration, timeout time.Duration, onChange func(alive bool)) *Heartbeat {
+	hb := &Heartbeat{
+		interval: interval,
+		timeout:  timeout,
+		changed:  make(chan struct{}, 1),
+		onChange: onChange,
+	}
+	hb.peerInterval.Store(-1)
+	hb.lastSeen.Store(time.Now().UnixNano())
+	hb.alive.Store(true)
+	return hb
+}
+
+// Interval is how often this end asks for heartbeats, to be told to the
+// peer.
+func (hb *Heartbeat) Interval() time.Duration {
+	return hb.interval
+}
+
+// SetPeerInterval takes the heartbeat interval the peer told.
+func (hb *Heartbeat) SetPeerInterval(interval time.Duration) {
+	if hb.peerInterval.Swap(int64(interval)) == int64(interval) {
+		return
+	}
+	if interval == 0 {
+		// no heartbeats are coming
+		hb.Received()
+	}
+	select {
+	case hb.changed <- struct{}{}:
+	default:
+	}
+}
+
+// sendInterval is how often both ends send heartbeats, the interval of this
+// end until the peer tells its own.
+func (hb *Heartbeat) sendInterval() time.Duration {
+	if peer := time.Duration(hb.peerInterval.Load()); peer > 0 {
+		return min(hb.interval, peer)
+	}
+	return hb.interval
+}
+
+// effectiveTimeout is how long the path may go without heartbeats before it
+// is dead, 0 if the peer sends none.
+func (hb *Heartbeat) effectiveTimeout() time.Duration {
+	if hb.peerInterval.Load() == 0 {
+		return 0
+	}
+	return max(hb.timeout, heartbeatMissedLimit*hb.sendInterval())
+}
+
+func (hb *Heartbeat) Received() {
+	hb.lastSeen.Store(time.Now().UnixNano())
+	if hb.alive.CompareAndSwap(false, true) {
+		hb.onChange(true)
+	}
+}
+
+func (hb *Heartbeat) Alive() bool {
+	return hb.alive.Load()
+}
+
+func (hb *Heartbeat) check() {
+	timeout := hb.effectiveTimeout()
+	if timeout == 0 {
+		return
+	}
+	lastSeen := time.Unix(0, hb.lastSeen.Load())
+	if time.Since(lastSeen) > timeout && hb.alive.CompareAndSwap(true, false) {
+		hb.onChange(false)
+	}
+}
+
+// HeartbeatLoop sends heartbeats on the path and marks the path dead when the
+// peer's heartbeats stop arriving. Does nothing if interval is zero.
+func HeartbeatLoop[T cancelableContext](ctx T, hb *Heartbeat, sender ControlSender) {
+	if hb.interval <= 0 {
+		return
+	}
+	heartbeat := packet.NewHeartbeatPacket()
+	ticker := time.NewTicker(hb.sendInterval())
+	defer ticker.Stop()
+	for {
+		sender.Send(heartbeat)
+		select {
+		case <-ctx.Done():
+			return
+		case <-hb.changed:
+			ticker.Reset(hb.sendInterval())
+		case <-ticker.C:
+		}
+		hb.check()
+	}
+}
@@ -0,0 +1,124 @@
+package transport_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+func TestHeartbeatIntervals(t *testing.T) {
+	const notTold = -1
+	tests := []struct {
+		name         string
+		interval     time.Duration
+		timeout      time.Duration
+		peer         time.Duration
+		wantInterval time.Duration
+		wantTimeout  time.Duration
+	}{
+		{"not told", time.Second, 5 * time.Second, notTold, time.Second, 5 * time.Second},
+		{"peer in failover mode", time.Second, 5 * time.Second, 100 * time.Millisecond, 100 * time.Millisecond, 5 * time.Second},
+		{"in failover mode", 100 * time.Millisecond, 500 * time.Millisecond, time.Second, 100 * time.Millisecond, 500 * time.Millisecond},
+		{"peer disabled", 100 * time.Millisecond, 500 * time.Millisecond, 0, 100 * time.Millisecond, 0},
+		{"timeout within missed limit", time.Second, 1500 * time.Millisecond, time.Second, time.Second, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hb := transport.NewHeartbeat(tt.interval, tt.timeout, func(bool) {})
+			if tt.peer != notTold {
+				hb.SetPeerInterval(tt.peer)
+			}
+			if got := hb.SendInterval(); got != tt.wantInterval {
+				t.Errorf("sent every %v, want %v", got, tt.wantInterval)
+			}
+			if got := hb.EffectiveTimeout(); got != tt.wantTimeout {
+				t.Errorf("timeout %v, want %v", got, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+type loopContext struct {
+	context.Context
+	cancel context.CancelFunc
+}
+
+func (ctx loopContext) Cancel() {
+	ctx.cancel()
+}
+
+// heartbeatEnd runs the heartbeat loop of one end of a path, whose
+// heartbeats are passed to the other end while up is set.
+type heartbeatEnd struct {
+	hb    *transport.Heartbeat
+	ch    chan buffer.ArgPtr[*buffer.PackedBuffer]
+	dead  atomic.Int32 // times the path went dead
+	alive atomic.Bool
+}
+
+func newHeartbeatEnd(interval time.Duration, timeout time.Duration) *heartbeatEnd {
+	end := &heartbeatEnd{ch: make(chan buffer.ArgPtr[*buffer.PackedBuffer], 16)}
+	end.alive.Store(true)
+	end.hb = transport.NewHeartbeat(interval, timeout, func(alive bool) {
+		end.alive.Store(alive)
+		if !alive {
+			end.dead.Add(1)
+		}
+	})
+	return end
+}
+
+func (end *heartbeatEnd) run(ctx loopContext, peer *heartbeatEnd, up *atomic.Bool) {
+	go transport.HeartbeatLoop(ctx, end.hb, transport.NewControlSender(end.ch, nil, 0))
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case pBuffer_ := <-end.ch:
+				pBuffer := pBuffer_.ToOwned()
+				pBuffer.Release()
+				if up.Load() {
+					peer.hb.Received()
+				}
+			}
+		}
+	}()
+}
+
+// TestHeartbeatFailoverPeer keeps a path alive between an end in failover
+// mode and a peer with the default interval, and still finds it dead fast.
+func TestHeartbeatFailoverPeer(t *testing.T) {
+	failover := newHeartbeatEnd(20*time.Millisecond, 100*time.Millisecond)
+	peer := newHeartbeatEnd(time.Second, 5*time.Second)
+	// as told in hello and accept
+	failover.hb.SetPeerInterval(peer.hb.Interval())
+	peer.hb.SetPeerInterval(failover.hb.Interval())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var up atomic.Bool
+	up.Store(true)
+	failover.run(loopContext{ctx, cancel}, peer, &up)
+	peer.run(loopContext{ctx, cancel}, failover, &up)
+
+	time.Sleep(500 * time.Millisecond)
+	if n := failover.dead.Load(); n != 0 {
+		t.Fatalf("path went dead %d times while up", n)
+	}
+	up.Store(false)
+	start := time.Now()
+	for failover.alive.Load() {
+		if time.Since(start) > time.Second {
+			t.Fatal("path not dead a second after going down")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("path dead %v after going down, want within the timeout", elapsed)
+	}
+}
@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chenx-dust/paracat/packet"
+)
+
+const (
+	probeWindow     = 64
+	minProbeTimeout = 1 * time.Second
+)
+
+type PathQuality struct {
+	SRTT   time.Duration // smoothed round-trip time
+	RTTVar time.Duration // round-trip time variance, a.k.a. jitter
+	Loss   float64       // ratio of lost probes in the recent window
+	Valid  bool          // false until the first echo arrives
+}
+
+type probeRecord struct {
+	seq    uint32
+	sentAt time.Time
+	echoed bool
+}
+
+// Prober measures the quality of a path by timestamped probes echoed back
+// by the peer. RTT is smoothed the same way as TCP (RFC 6298), and a probe
+// is counted lost once it is older than the retransmission timeout.
+type Prober struct {
+	interval time.Duration
+
+	mutex   sync.Mutex
+	seq     uint32
+	records [probeWindow]probeRecord
+	srtt    time.Duration
+	rttvar  time.Duration
+	valid   bool
+}
+
+func NewProber(interval time.Duration) *Prober {
+	return &Prober{interval: interval}
+}
+
+func (pr *Prober) nextProbe() *packet.Packet {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	now := time.Now()
+	pr.seq++
+	pr.records[pr.seq%probeWindow] = probeRecord{seq: pr.seq, sentAt: now}
+	return packet.NewProbePacket(packet.Probe{Seq: pr.seq, Timestamp: now.UnixNano()})
+}
+
+func (pr *Prober) HandleEcho(p *packet.Packet) {
+	probe, err := packet.ParseProbe(p)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	record := &pr.records[probe.Seq%probeWindow]
+	if record.seq != probe.Seq || record.echoed || record.sentAt.UnixNano() != probe.Timestamp {
+		return
+	}
+	record.echoed = true
+	rtt := now.Sub(record.sentAt)
+	if !pr.valid {
+		pr.srtt = rtt
+		pr.rttvar = rtt / 2
+		pr.valid = true
+		return
+	}
+	diff := pr.srtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	pr.rttvar = (3*pr.rttvar + diff) / 4
+	pr.srtt = (7*pr.srtt + rtt) / 8
+}
+
+func (pr *Prober) timeout() time.Duration {
+	timeout := pr.srtt + 4*pr.rttvar
+	if timeout < minProbeTimeout {
+		timeout = minProbeTimeout
+	}
+	return timeout
+}
+
+func (pr *Prober) Quality() PathQuality {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	deadline := time.Now().Add(-pr.timeout())
+	total := 0
+	lost := 0
+	for _, record := range pr.records {
+		if record.seq == 0 || record.sentAt.After(deadline) {
+			continue
+		}
+		total++
+		if !record.echoed {
+			lost++
+		}
+	}
+	quality := PathQuality{
+		SRTT:   pr.srtt,
+		RTTVar: pr.rttvar,
+		Valid:  pr.valid,
+	}
+	if total > 0 {
+		quality.Loss = float64(lost) / float64(total)
+	}
+	return quality
+}
+
+// Echo replies to a probe packet from the peer on the same path.
+func Echo(sender ControlSender, p *packet.Packet) {
+	probe, err := packet.ParseProbe(p)
+	if err != nil {
+		return
+	}
+	sender.Send(packet.NewEchoPacket(probe))
+}
+
+// ProbeLoop sends probes on the path. Does nothing if interval is zero.
+func ProbeLoop[T cancelableContext](ctx T, pr *Prober, sender ControlSender) {
+	if pr.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(pr.interval)
+	defer ticker.Stop()
+	for {
+		sender.Send(pr.nextProbe())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
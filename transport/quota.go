@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chenx-dust/paracat/config"
+)
+
+// QuotaUsage is the traffic of a path in both directions, kept across
+// restarts.
+type QuotaUsage struct {
+	Day     string `json:"day"`   // local date the daily bytes are counted in, as 2006-01-02
+	Month   string `json:"month"` // as 2006-01
+	Daily   uint64 `json:"daily"`
+	Monthly uint64 `json:"monthly"`
+	Total   uint64 `json:"total"`
+}
+
+// Quota accounts the traffic of a path against its policy.
+type Quota struct {
+	policy config.QuotaPolicy
+	now    func() time.Time
+	mutex  sync.Mutex
+	usage  QuotaUsage
+}
+
+// NewQuota creates the accounting of a path, going on from usage.
+func NewQuota(policy config.QuotaPolicy, usage QuotaUsage) *Quota {
+	return &Quota{
+		policy: policy,
+		now:    time.Now,
+		usage:  usage,
+	}
+}
+
+// roll starts over the counters of a past day or month. Should be called
+// with mutex held.
+func (q *Quota) roll(now time.Time) {
+	if day := now.Format(time.DateOnly); q.usage.Day != day {
+		q.usage.Day = day
+		q.usage.Daily = 0
+	}
+	if month := now.Format("2006-01"); q.usage.Month != month {
+		q.usage.Month = month
+		q.usage.Monthly = 0
+	}
+}
+
+// Count adds bytes sent or received on the path.
+func (q *Quota) Count(bytes uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.roll(q.now())
+	q.usage.Daily += bytes
+	q.usage.Monthly += bytes
+	q.usage.Total += bytes
+}
+
+// Exceeded reports whether the path is over its daily or monthly quota.
+func (q *Quota) Exceeded() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.roll(q.now())
+	return (q.policy.Daily > 0 && q.usage.Daily >= q.policy.Daily) ||
+		(q.policy.Monthly > 0 && q.usage.Monthly >= q.policy.Monthly)
+}
+
+func (q *Quota) Action() config.QuotaAction {
+	return q.policy.Action
+}
+
+func (q *Quota) Usage() QuotaUsage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.roll(q.now())
+	return q.usage
+}
@@ -0,0 +1,106 @@
+package transport_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/config"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+func newQuota(policy config.QuotaPolicy, usage transport.QuotaUsage, c *clock) *transport.Quota {
+	q := transport.NewQuota(policy, usage)
+	q.SetClock(c.now)
+	return q
+}
+
+func TestQuotaRollover(t *testing.T) {
+	c := &clock{t: time.Date(2024, 1, 31, 23, 59, 0, 0, time.Local)}
+	q := newQuota(config.QuotaPolicy{}, transport.QuotaUsage{}, c)
+	steps := []struct {
+		after time.Duration
+		count uint64
+		want  transport.QuotaUsage
+	}{
+		{0, 100, transport.QuotaUsage{Day: "2024-01-31", Month: "2024-01", Daily: 100, Monthly: 100, Total: 100}},
+		{30 * time.Second, 10, transport.QuotaUsage{Day: "2024-01-31", Month: "2024-01", Daily: 110, Monthly: 110, Total: 110}},
+		{time.Minute, 0, transport.QuotaUsage{Day: "2024-02-01", Month: "2024-02", Total: 110}}, // new month
+		{time.Hour, 50, transport.QuotaUsage{Day: "2024-02-01", Month: "2024-02", Daily: 50, Monthly: 50, Total: 160}},
+		{24 * time.Hour, 20, transport.QuotaUsage{Day: "2024-02-02", Month: "2024-02", Daily: 20, Monthly: 70, Total: 180}}, // new day
+		{30 * 24 * time.Hour, 0, transport.QuotaUsage{Day: "2024-03-03", Month: "2024-03", Total: 180}},
+	}
+	for i, step := range steps {
+		c.advance(step.after)
+		q.Count(step.count)
+		if got := q.Usage(); got != step.want {
+			t.Errorf("step %d: usage %+v, want %+v", i, got, step.want)
+		}
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	c := &clock{t: time.Date(2024, 2, 26, 12, 0, 0, 0, time.Local)}
+	q := newQuota(config.QuotaPolicy{Daily: 100, Monthly: 250}, transport.QuotaUsage{}, c)
+	steps := []struct {
+		after time.Duration
+		count uint64
+		want  bool
+	}{
+		{0, 99, false},
+		{0, 1, true}, // daily
+		{12 * time.Hour, 0, false},
+		{0, 99, false},
+		{24 * time.Hour, 60, true}, // monthly
+		{24 * time.Hour, 0, true},  // still, on the 29th
+		{24 * time.Hour, 0, false}, // March
+	}
+	for i, step := range steps {
+		c.advance(step.after)
+		q.Count(step.count)
+		if got := q.Exceeded(); got != step.want {
+			t.Errorf("step %d: exceeded %v, want %v, usage %+v", i, got, step.want, q.Usage())
+		}
+	}
+}
+
+// TestQuotaRestart goes on from the usage saved before a restart, as kept
+// in the quota file.
+func TestQuotaRestart(t *testing.T) {
+	policy := config.QuotaPolicy{Daily: 100}
+	c := &clock{t: time.Date(2024, 5, 10, 8, 0, 0, 0, time.Local)}
+	q := newQuota(policy, transport.QuotaUsage{}, c)
+	q.Count(100)
+	data, err := json.Marshal(q.Usage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restart := func() *transport.Quota {
+		var usage transport.QuotaUsage
+		if err := json.Unmarshal(data, &usage); err != nil {
+			t.Fatal(err)
+		}
+		return newQuota(policy, usage, c)
+	}
+
+	c.advance(time.Hour)
+	q = restart()
+	if !q.Exceeded() {
+		t.Error("quota not exceeded after a restart on the same day")
+	}
+	q.Count(10)
+	want := transport.QuotaUsage{Day: "2024-05-10", Month: "2024-05", Daily: 110, Monthly: 110, Total: 110}
+	if got := q.Usage(); got != want {
+		t.Errorf("usage %+v, want %+v", got, want)
+	}
+
+	c.advance(24 * time.Hour)
+	q = restart()
+	if q.Exceeded() {
+		t.Error("quota exceeded after a restart on a new day")
+	}
+	want = transport.QuotaUsage{Day: "2024-05-11", Month: "2024-05", Monthly: 100, Total: 100}
+	if got := q.Usage(); got != want {
+		t.Errorf("usage %+v, want %+v", got, want)
+	}
+}
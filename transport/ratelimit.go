@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+)
+
+// rateLimitBurst is how much a rate-limited path may send at once after a
+// pause, in time of its rate. A bucket holds a full buffer at least.
+const rateLimitBurst = 50 * time.Millisecond
+
+// TokenBucket limits the rate of a path. A nil TokenBucket is unlimited.
+type TokenBucket struct {
+	rate     float64 // bytes per second
+	capacity float64
+
+	mutex  sync.Mutex
+	tokens float64 // negative when sending has to wait
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewTokenBucket creates a bucket of rate in bytes per second, or returns
+// nil if rate is 0.
+func NewTokenBucket(rate float64) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	capacity := max(rate*rateLimitBurst.Seconds(), buffer.BUFFER_SIZE)
+	return &TokenBucket{
+		rate:     rate,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+		now:      time.Now,
+	}
+}
+
+// refill should be called with mutex held.
+func (tb *TokenBucket) refill(now time.Time) {
+	tb.tokens = min(tb.tokens+now.Sub(tb.last).Seconds()*tb.rate, tb.capacity)
+	tb.last = now
+}
+
+// Take takes bytes from the bucket, and tells how long to wait before
+// sending them.
+func (tb *TokenBucket) Take(bytes int) time.Duration {
+	if tb == nil {
+		return 0
+	}
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.refill(tb.now())
+	tb.tokens -= float64(bytes)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// Exhausted reports whether the bucket is empty, so that anything more sent
+// would wait.
+func (tb *TokenBucket) Exhausted() bool {
+	if tb == nil {
+		return false
+	}
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.refill(tb.now())
+	return tb.tokens <= 0
+}
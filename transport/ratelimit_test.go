@@ -0,0 +1,83 @@
+package transport_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chenx-dust/paracat/buffer"
+	"github.com/chenx-dust/paracat/transport"
+)
+
+// clock is a time moved on by hand.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestTokenBucket(t *testing.T) {
+	const rate = 1e6 // a burst of 50ms is less than a buffer
+	c := &clock{t: time.Now()}
+	tb := transport.NewTokenBucket(rate)
+	tb.SetClock(c.now)
+	steps := []struct {
+		after time.Duration
+		take  int
+		want  time.Duration
+	}{
+		{0, buffer.BUFFER_SIZE, 0}, // burst of a buffer
+		{0, 1000, time.Millisecond},
+		{0, 1000, 2 * time.Millisecond}, // waits add up
+		{10 * time.Millisecond, 8000, 0},
+		{0, 1000, time.Millisecond},
+		{time.Hour, buffer.BUFFER_SIZE, 0}, // refilled up to the burst only
+		{0, rate, time.Second},
+	}
+	for i, step := range steps {
+		c.advance(step.after)
+		if got := tb.Take(step.take); got != step.want {
+			t.Errorf("step %d: took %d after %v, wait %v, want %v", i, step.take, step.after, got, step.want)
+		}
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	const rate = 1e8 // a burst of 50ms is 5MB
+	c := &clock{t: time.Now()}
+	tb := transport.NewTokenBucket(rate)
+	tb.SetClock(c.now)
+	for range 50 {
+		if tb.Exhausted() {
+			t.Fatal("exhausted within burst")
+		}
+		if wait := tb.Take(100000); wait != 0 {
+			t.Fatalf("waited %v within burst", wait)
+		}
+	}
+	if !tb.Exhausted() {
+		t.Error("not exhausted after burst")
+	}
+	c.advance(time.Millisecond)
+	if tb.Exhausted() {
+		t.Error("exhausted after refill")
+	}
+	if wait := tb.Take(200000); wait != time.Millisecond {
+		t.Errorf("waited %v beyond refill, want 1ms", wait)
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	tb := transport.NewTokenBucket(0)
+	if tb != nil {
+		t.Fatal("unlimited bucket created")
+	}
+	if tb.Take(1<<30) != 0 || tb.Exhausted() {
+		t.Error("unlimited bucket limits")
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"net"
 
 	"github.com/chenx-dust/paracat/buffer"
-	"github.com/chenx-dust/paracat/channel"
 	"github.com/chenx-dust/paracat/packet"
 )
 
@@ -15,9 +14,14 @@ type cancelableContext interface {
 	Cancel()
 }
 
-func ReceiveTCPLoop[T cancelableContext](ctx T, conn *net.TCPConn, gatherer *channel.Gatherer) {
+// ReceiveTCPLoop receives and opens packets from conn, and passes them to
+// handlePackets, which takes the ownership.
+func ReceiveTCPLoop[T cancelableContext](ctx T, conn *net.TCPConn, cipher *packet.Cipher, handlePackets func(buffer.WithBufferArg[[]*packet.Packet])) {
 	defer ctx.Cancel()
 	pBuffer := buffer.NewPackedBuffer()
+	defer func() {
+		pBuffer.Release()
+	}()
 	start := 0
 	for {
 		select {
@@ -41,7 +45,7 @@ func ReceiveTCPLoop[T cancelableContext](ctx T, conn *net.TCPConn, gatherer *cha
 			continue
 		}
 		withBuffer := buffer.WithBuffer[[]*packet.Packet]{
-			Thing:  packets,
+			Thing:  cipher.OpenPackets(packets),
 			Buffer: pBuffer.Move(),
 		}
 		newBuffer := buffer.NewPackedBuffer()
@@ -53,31 +57,43 @@ func ReceiveTCPLoop[T cancelableContext](ctx T, conn *net.TCPConn, gatherer *cha
 		}
 		start = remain
 		pBuffer = newBuffer.Move()
-		gatherer.Forward(withBuffer.MoveArg())
+		if len(withBuffer.Thing) == 0 {
+			withBuffer.Release()
+			continue
+		}
+		handlePackets(withBuffer.MoveArg())
 	}
 }
 
-func SendTCPLoop[T cancelableContext](ctx T, conn *net.TCPConn, inChan <-chan buffer.ArgPtr[*buffer.PackedBuffer]) {
+// SendTCPLoop sends buffers from inChan and feedback of cc, paced by cc and
+// limited by limiter. What is sent is counted in sent.
+func SendTCPLoop[T cancelableContext](ctx T, conn *net.TCPConn, inChan <-chan buffer.ArgPtr[*buffer.PackedBuffer], cc *Congestion, limiter *TokenBucket, sent *packet.PacketStatistic) {
 	defer ctx.Cancel()
 	for {
-		select {
-		case <-ctx.Done():
+		data_, ok := nextToSend(ctx, inChan, cc)
+		if !ok {
 			return
-		case data_ := <-inChan:
-			data := data_.ToOwned()
-			n, err := conn.Write(data.Ptr.Buffer[:data.Ptr.TotalSize])
-			if err != nil {
-				log.Println("error sending packet:", err)
+		}
+		data := data_.ToOwned()
+		if !pace(ctx, cc, limiter, data.Ptr) {
+			data.Release()
+			return
+		}
+		n, err := conn.Write(data.Ptr.Buffer[:data.Ptr.TotalSize])
+		if n == data.Ptr.TotalSize {
+			sent.CountPackets(uint32(len(data.Ptr.SubPackets)), uint64(n))
+		}
+		if err != nil {
+			log.Println("error sending packet:", err)
+			if err == io.EOF {
 				data.Release()
-				if err == io.EOF {
-					ctx.Cancel()
-					return
-				}
-			}
-			if n != data.Ptr.TotalSize {
-				log.Println("error writing to tcp: wrote", n, "bytes instead of", data.Ptr.TotalSize)
+				ctx.Cancel()
+				return
 			}
-			data.Release()
 		}
+		if n != data.Ptr.TotalSize {
+			log.Println("error writing to tcp: wrote", n, "bytes instead of", data.Ptr.TotalSize)
+		}
+		data.Release()
 	}
 }
@@ -96,7 +96,9 @@ func ReceiveUDPRawPackets(conn *net.UDPConn) (buffer.OwnedPtr[*buffer.PackedBuff
 	return packedBuffer.Move(), udpAddr, nil
 }
 
-func ReceiveUDPPackets(conn *net.UDPConn) (buffer.WithBuffer[[]*packet.Packet], *net.UDPAddr, error) {
+// ReceiveUDPPackets receives and unpacks packets, dropping those failed to
+// be opened by cipher.
+func ReceiveUDPPackets(conn *net.UDPConn, cipher *packet.Cipher) (buffer.WithBuffer[[]*packet.Packet], *net.UDPAddr, error) {
 	rawPackets, udpAddr, err := ReceiveUDPRawPackets(conn)
 	if err != nil {
 		return buffer.WithBuffer[[]*packet.Packet]{Buffer: rawPackets.Move()}, nil, err
@@ -117,7 +119,7 @@ func ReceiveUDPPackets(conn *net.UDPConn) (buffer.WithBuffer[[]*packet.Packet],
 		nowPtr += slice
 	}
 	return buffer.WithBuffer[[]*packet.Packet]{
-		Thing:  packets,
+		Thing:  cipher.OpenPackets(packets),
 		Buffer: rawPackets.Move(),
 	}, udpAddr, nil
 }
@@ -184,22 +186,52 @@ func SendUDPPackets(conn *net.UDPConn, dstAddr *net.UDPAddr, pBuffer_ buffer.Bor
 	return nil
 }
 
-func SendUDPLoop[T cancelableContext](ctx T, conn *net.UDPConn, dstAddr *net.UDPAddr, inChan <-chan buffer.ArgPtr[*buffer.PackedBuffer], enableGSO bool) {
+// SendUDPPayloads sends payloads to dstAddr, packed in as many buffers as
+// they take.
+func SendUDPPayloads(conn *net.UDPConn, dstAddr *net.UDPAddr, payloads [][]byte, enableGSO bool) error {
+	pBuffer := buffer.NewPackedBuffer()
+	defer func() {
+		pBuffer.Release()
+	}()
+	for _, payload := range payloads {
+		if pBuffer.Ptr.TotalSize+len(payload) > buffer.BUFFER_SIZE {
+			if err := SendUDPPackets(conn, dstAddr, pBuffer.BorrowArg(), enableGSO); err != nil {
+				return err
+			}
+			pBuffer.Release()
+			pBuffer = buffer.NewPackedBuffer()
+		}
+		pBuffer.Ptr.SubPackets = append(pBuffer.Ptr.SubPackets, len(payload))
+		copy(pBuffer.Ptr.Buffer[pBuffer.Ptr.TotalSize:], payload)
+		pBuffer.Ptr.TotalSize += len(payload)
+	}
+	return SendUDPPackets(conn, dstAddr, pBuffer.BorrowArg(), enableGSO)
+}
+
+// SendUDPLoop sends buffers from inChan and feedback of cc, paced by cc and
+// limited by limiter. What is sent is counted in sent.
+func SendUDPLoop[T cancelableContext](ctx T, conn *net.UDPConn, dstAddr *net.UDPAddr, inChan <-chan buffer.ArgPtr[*buffer.PackedBuffer], cc *Congestion, limiter *TokenBucket, sent *packet.PacketStatistic, enableGSO bool) {
 	defer ctx.Cancel()
 	for {
-		select {
-		case <-ctx.Done():
+		pBuffer_, ok := nextToSend(ctx, inChan, cc)
+		if !ok {
 			return
-		case pBuffer_ := <-inChan:
-			pBuffer := pBuffer_.ToOwned()
-			err := SendUDPPackets(conn, dstAddr, pBuffer.BorrowArg(), enableGSO)
+		}
+		pBuffer := pBuffer_.ToOwned()
+		if !pace(ctx, cc, limiter, pBuffer.Ptr) {
 			pBuffer.Release()
-			if err != nil {
-				log.Println("error sending packet:", err)
-				if err == io.EOF {
-					ctx.Cancel()
-					return
-				}
+			return
+		}
+		err := SendUDPPackets(conn, dstAddr, pBuffer.BorrowArg(), enableGSO)
+		if err == nil {
+			sent.CountPackets(uint32(len(pBuffer.Ptr.SubPackets)), uint64(pBuffer.Ptr.TotalSize))
+		}
+		pBuffer.Release()
+		if err != nil {
+			log.Println("error sending packet:", err)
+			if err == io.EOF {
+				ctx.Cancel()
+				return
 			}
 		}
 	}